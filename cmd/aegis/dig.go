@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/simplyzetax/aegis/internal/config"
+	"github.com/simplyzetax/aegis/internal/dns"
+)
+
+// runDig implements "aegis dig", which answers a query the way Aegis would and
+// explains how: the rules that matched or were skipped, cache and upstream use
+func runDig(args []string) error {
+	flags := flag.NewFlagSet("dig", flag.ContinueOnError)
+	qtype := flags.String("type", "", "query type, e.g. A, AAAA or PTR (default A, PTR for addresses)")
+	client := flags.String("client", "127.0.0.1", "client IP to answer as, for ACLs and client groups")
+	server := flags.String("server", "", "also ask a running Aegis at this address, e.g. 127.0.0.1:53")
+	tcp := flags.Bool("tcp", false, "ask the running server over TCP")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: aegis dig [flags] name|address [type]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Like dig, the type may follow the name
+	rest := flags.Args()
+	if len(rest) == 0 || len(rest) > 2 {
+		flags.Usage()
+		return fmt.Errorf("expected a name and an optional type")
+	}
+	if len(rest) == 2 {
+		*qtype = rest[1]
+	}
+
+	r, err := dns.NewQuery(rest[0], *qtype)
+	if err != nil {
+		return err
+	}
+
+	if *server != "" {
+		if err := digServer(*server, *tcp, r); err != nil {
+			return err
+		}
+		fmt.Println()
+		fmt.Println(";; Trace of the same query against " + config.GetConfigPath() + ":")
+	}
+
+	trace, err := dns.TraceQuery(r, *client)
+	if err != nil {
+		return err
+	}
+	for _, line := range trace.Lines() {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// digServer sends r to a running server and prints its answer
+func digServer(address string, tcp bool, r *mdns.Msg) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+
+	c := &mdns.Client{Net: "udp"}
+	if tcp {
+		c.Net = "tcp"
+	}
+	resp, rtt, err := c.Exchange(r.Copy(), address)
+	if err != nil {
+		return fmt.Errorf("query %s: %v", address, err)
+	}
+
+	fmt.Println(resp.String())
+	fmt.Printf(";; Query time: %dms\n;; SERVER: %s (%s)\n", rtt.Milliseconds(), address, c.Net)
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/gofiber/fiber/v2"
@@ -21,6 +25,20 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Subcommands need neither admin rights nor the menu
+	if len(os.Args) > 1 && os.Args[1] == "querylog" {
+		if err := runQueryLog(os.Args[2:]); err != nil {
+			log.Fatalf("querylog: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dig" {
+		if err := runDig(os.Args[2:]); err != nil {
+			log.Fatalf("dig: %v", err)
+		}
+		return
+	}
+
 	// Show platform information
 	log.Debugf("Platform: %s", platform.GetPlatform())
 	log.Debugf("IsAdmin: %t", platform.IsAdmin())
@@ -69,6 +87,10 @@ func main() {
 			if err := manageCertificates(); err != nil {
 				log.Errorf("Certificate management error: %v", err)
 			}
+		case "dig":
+			if err := ui.QueryToolForm(); err != nil {
+				log.Errorf("Query tool error: %v", err)
+			}
 		case "config":
 			showConfiguration()
 		case "exit":
@@ -110,6 +132,11 @@ func startProxyServer() error {
 		return fmt.Errorf("invalid certificate %s: %v", selectedCert, err)
 	}
 
+	// Pick the interface to serve other devices on
+	if err := selectLANInterface(); err != nil {
+		return err
+	}
+
 	// Start DNS server
 	log.Info("Starting DNS server...")
 	dnsPort, err := dns.StartService()
@@ -122,6 +149,12 @@ func startProxyServer() error {
 		log.Warnf("DNS test failed: %v", err)
 	}
 
+	// Start encrypted DNS listeners
+	proxyCert := ssl.LoadCert(selectedCert)
+	if err := dns.StartSecureListeners(proxyCert); err != nil {
+		log.Warnf("Failed to start encrypted DNS listeners: %v", err)
+	}
+
 	// Create and configure Fiber app
 	app := fiber.New(fiber.Config{
 		BodyLimit:       1024 * 1024 * 1024, // 1GB
@@ -137,6 +170,9 @@ func startProxyServer() error {
 		DisableStartupMessage: true,
 	})
 
+	// Serve DNS-over-HTTPS on the proxy listener if enabled
+	mountDoH(app)
+
 	// Set up the proxy handler
 	app.All("*", proxy.Handler)
 
@@ -145,12 +181,13 @@ func startProxyServer() error {
 	log.Infof("🔒 Using certificate: %s", selectedCert)
 	log.Infof("⬆️  Upstream URL: %s", config.Config.Proxy.UpstreamURL)
 	log.Infof("🌐 DNS server running on port %s", dnsPort)
+	logEncryptedDNS()
 
-	enabledRedirects := config.GetEnabledRedirects()
+	enabledRedirects := config.GetActiveRedirects(time.Now())
 	if len(enabledRedirects) > 0 {
 		log.Info("📋 Active DNS redirects:")
 		for _, redirect := range enabledRedirects {
-			log.Infof("   %s -> %s (%s)", redirect.Domain, redirect.Target, redirect.Description)
+			log.Infof("   %s -> %s (%s)", redirect.Domain, redirect.Summary(), redirect.Description)
 		}
 	} else {
 		log.Warn("⚠️  No DNS redirects configured!")
@@ -162,10 +199,107 @@ func startProxyServer() error {
 		dns.StopService()
 	}()
 
+	logLANInstructions(dnsPort)
+
 	// Start HTTPS server
-	address := ":" + config.Config.Proxy.Port
-	log.Infof("✅ Server ready! Listening on https://localhost%s", address)
-	return app.ListenTLSWithCertificate(address, ssl.LoadCert(selectedCert))
+	address := net.JoinHostPort(dns.ListenHost(), config.Config.Proxy.Port)
+	log.Infof("✅ Server ready! Listening on https://%s", net.JoinHostPort(serverHost(), config.Config.Proxy.Port))
+	return listenTLS(app, address, proxyCert)
+}
+
+// mountDoH registers the DNS-over-HTTPS endpoint when it shares the proxy listener.
+// It must be called before the catch-all proxy route.
+func mountDoH(app *fiber.App) {
+	doh := config.Config.DNS.DoH
+	if !doh.Enabled || doh.Port != "" {
+		return
+	}
+
+	app.Get(doh.Path, dns.DoHHandler)
+	app.Post(doh.Path, dns.DoHHandler)
+}
+
+// logEncryptedDNS shows where the DoH and DoT endpoints are reachable
+func logEncryptedDNS() {
+	dnsConfig := config.Config.DNS
+	if dnsConfig.DoH.Enabled {
+		port := dnsConfig.DoH.Port
+		if port == "" {
+			port = config.Config.Proxy.Port
+		}
+		log.Infof("🔐 DNS-over-HTTPS: https://%s%s", net.JoinHostPort(dns.ClientHost(), port), dnsConfig.DoH.Path)
+	}
+	if dnsConfig.DoT.Enabled {
+		log.Infof("🔐 DNS-over-TLS: %s", net.JoinHostPort(dns.ClientHost(), dnsConfig.DoT.Port))
+	}
+}
+
+// selectLANInterface asks which interface to serve on when LAN mode is on,
+// no interface is configured and there is more than one candidate
+func selectLANInterface() error {
+	if !config.Config.LAN.Enabled || config.Config.LAN.Interface != "" {
+		return nil
+	}
+
+	interfaces, err := dns.LANInterfaces()
+	if err != nil || len(interfaces) < 2 {
+		return nil // StartService picks the only one or reports the error
+	}
+
+	var names, labels []string
+	for _, iface := range interfaces {
+		names = append(names, iface.Name)
+		labels = append(labels, iface.String())
+	}
+	name, err := ui.LANInterfaceForm(names, labels)
+	if err != nil {
+		return fmt.Errorf("interface selection failed: %v", err)
+	}
+	config.Config.LAN.Interface = name
+	return nil
+}
+
+// serverHost returns the host name shown for the proxy listener
+func serverHost() string {
+	if host := dns.ListenHost(); host != "" {
+		return host
+	}
+	return "localhost"
+}
+
+// logLANInstructions tells what other devices need to use Aegis in LAN mode
+func logLANInstructions(dnsPort string) {
+	host := dns.ListenHost()
+	if host == "" {
+		return
+	}
+
+	log.Info("📱 LAN mode: configure your devices with")
+	log.Infof("   DNS server: %s", host)
+	if dnsPort != ":53" {
+		log.Warnf("   DNS is running on port %s, but most devices can only use port 53", strings.TrimPrefix(dnsPort, ":"))
+	}
+	log.Info("   and install the proxy certificate on them so they trust it")
+}
+
+// listenTLS serves app over TLS. When DoH shares the proxy listener with its own
+// certificate, both certificates are offered: clients connecting by IP send no
+// SNI and get the first (DoH) certificate, while game clients asking for their
+// host name get the proxy certificate.
+func listenTLS(app *fiber.App, address string, proxyCert tls.Certificate) error {
+	doh := config.Config.DNS.DoH
+	if !doh.Enabled || doh.Port != "" || doh.Certificate == "" {
+		return app.ListenTLSWithCertificate(address, proxyCert)
+	}
+
+	listener, err := tls.Listen("tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{ssl.LoadCert(doh.Certificate), proxyCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	return app.Listener(listener)
 }
 
 // manageCertificates handles certificate management
@@ -179,8 +313,18 @@ func showConfiguration() {
 	log.Infof("   Log Level: %s", config.Config.LogLevel)
 	log.Infof("   Proxy Upstream: %s", config.Config.Proxy.UpstreamURL)
 	log.Infof("   Proxy Port: %s", config.Config.Proxy.Port)
-	log.Infof("   DNS Upstream: %s", config.Config.DNS.UpstreamDNS)
+	log.Infof("   DNS Upstream: %s (%s)", strings.Join(config.Config.DNS.UpstreamDNS, ", "), config.Config.DNS.UpstreamStrategy)
+	for _, zone := range config.Config.DNS.ForwardZones {
+		log.Infof("   DNS Forward Zone: %s -> %s", zone.Domain, strings.Join(zone.Upstreams, ", "))
+	}
 	log.Infof("   DNS Auto-Manage: %t", config.Config.DNS.AutoManageSystem)
+	if config.Config.LAN.Enabled {
+		iface := config.Config.LAN.Interface
+		if iface == "" {
+			iface = "auto"
+		}
+		log.Infof("   LAN Mode: %s", iface)
+	}
 	log.Infof("   Proxy Headers: %v", config.Config.Proxy.Headers)
 
 	log.Infof("   DNS Redirects (%d total):", len(config.Config.DNS.Redirects))
@@ -189,16 +333,108 @@ func showConfiguration() {
 		if !redirect.Enabled {
 			status = "❌"
 		}
-		log.Infof("     %d. %s %s -> %s (%s)", i+1, status, redirect.Domain, redirect.Target, redirect.Description)
+		log.Infof("     %d. %s %s -> %s (%s)", i+1, status, redirect.Domain, redirect.Summary(), redirect.Description)
+	}
+
+	for _, group := range config.Config.DNS.ClientGroups {
+		members := strings.Join(append(append([]string{}, group.Networks...), group.MACs...), ", ")
+		fallback := ", then global redirects"
+		if group.IgnoreGlobalRedirects {
+			fallback = ""
+		}
+		log.Infof("   Client Group %s (%s): %d redirects%s", group.Name, members, len(group.Redirects), fallback)
+		for i, redirect := range group.Redirects {
+			status := "✅"
+			if !redirect.Enabled {
+				status = "❌"
+			}
+			log.Infof("     %d. %s %s -> %s (%s)", i+1, status, redirect.Domain, redirect.Summary(), redirect.Description)
+		}
+	}
+
+	if transitions := config.UpcomingTransitions(time.Now()); len(transitions) > 0 {
+		log.Info("   Upcoming redirect changes:")
+		for _, transition := range transitions {
+			change := "turns off"
+			if transition.Active {
+				change = "turns on"
+			}
+			scope := ""
+			if transition.Group != "" {
+				scope = fmt.Sprintf(" (client group %s)", transition.Group)
+			}
+			log.Infof("     %s: %s %s%s", transition.Time.Local().Format("Mon Jan 2 15:04"), transition.Redirect.Domain, change, scope)
+		}
 	}
 
 	// Show DNS service status if running
 	if status := dns.GetServiceStatus(); status["running"].(bool) {
 		log.Info("🌐 DNS Service Status:")
 		log.Infof("   Port: %s", status["port"])
+		if listeners, ok := status["listeners"].([]string); ok {
+			log.Infof("   Listening on: %s", strings.Join(listeners, ", "))
+		}
+		if lan, ok := status["lan"]; ok {
+			log.Infof("   LAN interface: %s", lan)
+		}
 		log.Infof("   Active redirects: %d", status["enabled_count"])
 		log.Infof("   Total redirects: %d", status["total_count"])
-		log.Infof("   Upstream DNS: %s", status["upstream_dns"])
+		log.Infof("   Upstream strategy: %s", status["upstream_strategy"])
+		if upstreams, ok := status["upstreams"].([]map[string]interface{}); ok {
+			for _, upstream := range upstreams {
+				health := "🟢"
+				if !upstream["healthy"].(bool) {
+					health = "🔴"
+				}
+				log.Infof("   %s %s: %.1fms avg, %d queries, %d errors",
+					health, upstream["address"], upstream["latency_ms"], upstream["queries"], upstream["errors"])
+			}
+		}
+		if zones, ok := status["forward_zones"].([]map[string]interface{}); ok {
+			for _, zone := range zones {
+				log.Infof("   Forward zone %s (%s):", zone["domain"], zone["strategy"])
+				for _, upstream := range zone["upstreams"].([]map[string]interface{}) {
+					health := "🟢"
+					if !upstream["healthy"].(bool) {
+						health = "🔴"
+					}
+					log.Infof("     %s %s: %.1fms avg, %d queries, %d errors",
+						health, upstream["address"], upstream["latency_ms"], upstream["queries"], upstream["errors"])
+				}
+			}
+		}
+		if targets, ok := status["redirect_targets"].([]map[string]interface{}); ok {
+			for _, target := range targets {
+				if err, failed := target["error"]; failed {
+					log.Infof("   🔴 Redirect target %s: %s", target["name"], err)
+					continue
+				}
+				log.Infof("   Redirect target %s: %s", target["name"], target["addresses"])
+			}
+		}
+		if cache, ok := status["cache"].(map[string]interface{}); ok {
+			log.Infof("   Cache: %d entries, %d hits, %d misses (%.1f%% hit rate), %d prefetched, %d stale served",
+				cache["entries"], cache["hits"], cache["misses"], cache["hit_rate"], cache["prefetches"], cache["stale_served"])
+		}
+		if rateLimit, ok := status["rate_limit"].(map[string]interface{}); ok {
+			log.Infof("   Rate limiting: %d responses dropped, %d slipped, %d queries over quota",
+				rateLimit["dropped"], rateLimit["slipped"], rateLimit["quota_exceeded"])
+		}
+		if dnssec, ok := status["dnssec"].(map[string]interface{}); ok {
+			log.Infof("   DNSSEC: %d secure, %d insecure, %d bogus answers",
+				dnssec["secure"], dnssec["insecure"], dnssec["bogus"])
+		}
+		log.Infof("   ANY queries minimized: %d", status["any_minimized"])
+		if blocklist, ok := status["blocklist"].(map[string]interface{}); ok {
+			log.Infof("   Blocklists: %d domains, %d queries blocked", blocklist["domains"], blocklist["blocked"])
+			for _, source := range blocklist["sources"].([]map[string]interface{}) {
+				if source["error"] != "" {
+					log.Infof("     🔴 %s: %s", source["name"], source["error"])
+					continue
+				}
+				log.Infof("     %s: %d domains, %d blocked (%s)", source["name"], source["domains"], source["blocked"], source["response"])
+			}
+		}
 	} else {
 		log.Info("🌐 DNS Service: Not running")
 	}
@@ -255,6 +491,11 @@ func runSimpleMode() error {
 		log.Infof("Certificate %s installed successfully", certName)
 	}
 
+	// Pick the interface to serve other devices on
+	if err := selectLANInterface(); err != nil {
+		return err
+	}
+
 	// Start DNS server
 	log.Info("Starting DNS server...")
 	dnsPort, err := dns.StartService()
@@ -267,6 +508,12 @@ func runSimpleMode() error {
 		log.Warnf("DNS test failed: %v", err)
 	}
 
+	// Start encrypted DNS listeners
+	proxyCert := ssl.LoadCert(certName)
+	if err := dns.StartSecureListeners(proxyCert); err != nil {
+		log.Warnf("Failed to start encrypted DNS listeners: %v", err)
+	}
+
 	// Create and configure Fiber app
 	app := fiber.New(fiber.Config{
 		BodyLimit:       1024 * 1024 * 1024, // 1GB
@@ -282,6 +529,9 @@ func runSimpleMode() error {
 		DisableStartupMessage: true,
 	})
 
+	// Serve DNS-over-HTTPS on the proxy listener if enabled
+	mountDoH(app)
+
 	// Set up the proxy handler
 	app.All("*", proxy.Handler)
 
@@ -290,13 +540,14 @@ func runSimpleMode() error {
 	log.Infof("🔒 Using certificate: %s", certName)
 	log.Infof("⬆️  Upstream URL: %s", config.Config.Proxy.UpstreamURL)
 	log.Infof("🌐 DNS server running on port %s", dnsPort)
+	logEncryptedDNS()
 	log.Infof("📍 Domain: %s", domain)
 
-	enabledRedirects := config.GetEnabledRedirects()
+	enabledRedirects := config.GetActiveRedirects(time.Now())
 	if len(enabledRedirects) > 0 {
 		log.Info("📋 Active DNS redirects:")
 		for _, redirect := range enabledRedirects {
-			log.Infof("   %s -> %s (%s)", redirect.Domain, redirect.Target, redirect.Description)
+			log.Infof("   %s -> %s (%s)", redirect.Domain, redirect.Summary(), redirect.Description)
 		}
 	} else {
 		log.Warn("⚠️  No DNS redirects configured!")
@@ -308,9 +559,11 @@ func runSimpleMode() error {
 		dns.StopService()
 	}()
 
+	logLANInstructions(dnsPort)
+
 	// Start HTTPS server
-	address := ":" + config.Config.Proxy.Port
-	log.Infof("✅ Simple Mode ready! Listening on https://localhost%s", address)
-	log.Infof("💡 Point your applications to use DNS server 127.0.0.1:%s", strings.TrimPrefix(dnsPort, ":"))
-	return app.ListenTLSWithCertificate(address, ssl.LoadCert(certName))
+	address := net.JoinHostPort(dns.ListenHost(), config.Config.Proxy.Port)
+	log.Infof("✅ Simple Mode ready! Listening on https://%s", net.JoinHostPort(serverHost(), config.Config.Proxy.Port))
+	log.Infof("💡 Point your applications to use DNS server %s:%s", dns.ClientHost(), strings.TrimPrefix(dnsPort, ":"))
+	return listenTLS(app, address, proxyCert)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/simplyzetax/aegis/internal/config"
+	"github.com/simplyzetax/aegis/internal/dns"
+)
+
+// runQueryLog implements "aegis querylog", which prints and follows the DNS query log
+func runQueryLog(args []string) error {
+	flags := flag.NewFlagSet("querylog", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing new queries as they are logged")
+	lines := flags.Int("n", 50, "number of past queries to print (0 for all)")
+	domains := flags.String("domain", "", "comma-separated domain patterns, e.g. *.epicgames.com")
+	qtype := flags.String("type", "", "only this query type, e.g. A or AAAA")
+	client := flags.String("client", "", "only queries from this client IP")
+	rcode := flags.String("rcode", "", "only this response code, e.g. NXDOMAIN")
+	redirected := flags.Bool("redirected", false, "only queries answered by a redirect")
+	blocked := flags.Bool("blocked", false, "only queries answered by a block list")
+	since := flags.Duration("since", 0, "only queries from the last duration, e.g. 30m")
+	all := flags.Bool("all", false, "include rotated log files")
+	asJSON := flags.Bool("json", false, "print raw JSON lines")
+	path := flags.String("file", config.Config.DNS.QueryLog.Path, "query log file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter := dns.QueryLogFilter{
+		Type:       *qtype,
+		Client:     *client,
+		Rcode:      *rcode,
+		Redirected: *redirected,
+		Blocked:    *blocked,
+	}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	if *domains != "" {
+		filter.Domain = dns.NewMatcher[struct{}]()
+		for _, pattern := range strings.Split(*domains, ",") {
+			if err := filter.Domain.Insert(strings.TrimSpace(pattern), struct{}{}); err != nil {
+				return fmt.Errorf("invalid domain pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	show := func(entry dns.QueryLogEntry) {
+		if !*asJSON {
+			fmt.Println(entry.String())
+			return
+		}
+		line, _ := json.Marshal(entry)
+		fmt.Println(string(line))
+	}
+
+	entries, err := dns.ReadQueryLog(*path, *all, filter)
+	if err != nil {
+		return err
+	}
+	if *lines > 0 && len(entries) > *lines {
+		entries = entries[len(entries)-*lines:]
+	}
+	for _, entry := range entries {
+		show(entry)
+	}
+
+	if !*follow {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	return dns.FollowQueryLog(*path, filter, stop, show)
+}
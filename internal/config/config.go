@@ -2,14 +2,23 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 )
 
 var Config *AppConfig
 
+// SystemUpstream in upstream_dns stands for the resolvers the system used
+// before Aegis took over, such as the ones DHCP assigned
+const SystemUpstream = "system"
+
 // Load reads the configuration from file or creates default config
 func Load() error {
 	viper.SetConfigFile("config.json")
@@ -60,31 +69,22 @@ func Save() error {
 
 // AddRedirect adds a new DNS redirect to the configuration
 func AddRedirect(redirect DNSRedirect) error {
-	Config.DNS.Redirects = append(Config.DNS.Redirects, redirect)
-	return Save()
+	return AddGroupRedirect("", redirect)
+}
+
+// UpdateRedirect replaces the DNS redirect at index
+func UpdateRedirect(index int, redirect DNSRedirect) error {
+	return UpdateGroupRedirect("", index, redirect)
 }
 
 // RemoveRedirect removes a DNS redirect by index
 func RemoveRedirect(index int) error {
-	if index < 0 || index >= len(Config.DNS.Redirects) {
-		return fmt.Errorf("invalid redirect index: %d", index)
-	}
-
-	Config.DNS.Redirects = append(
-		Config.DNS.Redirects[:index],
-		Config.DNS.Redirects[index+1:]...,
-	)
-	return Save()
+	return RemoveGroupRedirect("", index)
 }
 
 // ToggleRedirect enables/disables a DNS redirect by index
 func ToggleRedirect(index int) error {
-	if index < 0 || index >= len(Config.DNS.Redirects) {
-		return fmt.Errorf("invalid redirect index: %d", index)
-	}
-
-	Config.DNS.Redirects[index].Enabled = !Config.DNS.Redirects[index].Enabled
-	return Save()
+	return ToggleGroupRedirect("", index)
 }
 
 // GetEnabledRedirects returns only the enabled DNS redirects
@@ -101,8 +101,165 @@ func GetEnabledRedirects() []DNSRedirect {
 // validate checks if the configuration is valid
 func validate() error {
 
-	if Config.DNS.UpstreamDNS == "" {
-		Config.DNS.UpstreamDNS = "1.1.1.1:53"
+	// Without upstreams, keep resolving the way the network intends
+	if len(Config.DNS.UpstreamDNS) == 0 {
+		Config.DNS.UpstreamDNS = []string{SystemUpstream}
+	}
+
+	switch Config.DNS.UpstreamStrategy {
+	case "":
+		Config.DNS.UpstreamStrategy = "failover"
+	case "failover", "parallel", "fastest":
+	default:
+		return fmt.Errorf("unknown upstream_strategy %q (expected failover, parallel or fastest)", Config.DNS.UpstreamStrategy)
+	}
+
+	for i, zone := range Config.DNS.ForwardZones {
+		if zone.Domain == "" {
+			return fmt.Errorf("forward zone %d: domain is required", i)
+		}
+		if len(zone.Upstreams) == 0 {
+			return fmt.Errorf("forward zone %s: at least one upstream is required", zone.Domain)
+		}
+		switch zone.Strategy {
+		case "", "failover", "parallel", "fastest":
+		default:
+			return fmt.Errorf("forward zone %s: unknown strategy %q", zone.Domain, zone.Strategy)
+		}
+	}
+
+	if Config.DNS.ACL.DefaultAction == "" {
+		Config.DNS.ACL.DefaultAction = "allow"
+	}
+	if !isACLAction(Config.DNS.ACL.DefaultAction) {
+		return fmt.Errorf("unknown acl default_action %q (expected allow, refuse, drop or forward-only)", Config.DNS.ACL.DefaultAction)
+	}
+	for i, list := range Config.DNS.ACL.Lists {
+		if !isACLAction(list.Action) {
+			return fmt.Errorf("acl list %d: unknown action %q (expected allow, refuse, drop or forward-only)", i, list.Action)
+		}
+		for _, network := range list.Networks {
+			if _, err := ParseNetwork(network); err != nil {
+				return fmt.Errorf("acl list %d: %v", i, err)
+			}
+		}
+	}
+
+	rateLimit := &Config.DNS.RateLimit
+	if rateLimit.ResponsesPerSecond < 0 || rateLimit.Slip < 0 || rateLimit.QueriesPerSecond < 0 || rateLimit.Burst < 0 {
+		return fmt.Errorf("rate_limit values must not be negative")
+	}
+	if rateLimit.IPv4PrefixLength == 0 {
+		rateLimit.IPv4PrefixLength = 24
+	}
+	if rateLimit.IPv6PrefixLength == 0 {
+		rateLimit.IPv6PrefixLength = 56
+	}
+	if rateLimit.IPv4PrefixLength > 32 || rateLimit.IPv6PrefixLength > 128 {
+		return fmt.Errorf("rate_limit prefix lengths must be at most 32 (IPv4) and 128 (IPv6)")
+	}
+
+	if Config.DNS.Port == "" {
+		Config.DNS.Port = "53"
+	}
+	if _, err := strconv.ParseUint(Config.DNS.Port, 10, 16); err != nil {
+		return fmt.Errorf("invalid dns port %q", Config.DNS.Port)
+	}
+	for _, address := range Config.DNS.Listen {
+		if _, _, err := ParseListenAddress(address, Config.DNS.Port); err != nil {
+			return err
+		}
+	}
+
+	if Config.DNS.HealthCheckInterval == "" {
+		Config.DNS.HealthCheckInterval = "30s"
+	}
+	if _, err := ParseDuration(Config.DNS.HealthCheckInterval); err != nil {
+		return fmt.Errorf("invalid health_check_interval: %v", err)
+	}
+
+	if Config.DNS.DoH.Path == "" {
+		Config.DNS.DoH.Path = "/dns-query"
+	}
+	if !strings.HasPrefix(Config.DNS.DoH.Path, "/") {
+		return fmt.Errorf("doh path must start with /")
+	}
+	if Config.DNS.DoT.Port == "" {
+		Config.DNS.DoT.Port = "853"
+	}
+
+	if Config.DNS.Cache.StaleTTL == "" {
+		Config.DNS.Cache.StaleTTL = "24h"
+	}
+	if Config.DNS.Cache.MaxEntries < 0 {
+		return fmt.Errorf("cache max_entries must not be negative")
+	}
+	for name, value := range map[string]string{
+		"max_ttl":          Config.DNS.Cache.MaxTTL,
+		"max_negative_ttl": Config.DNS.Cache.MaxNegativeTTL,
+		"stale_ttl":        Config.DNS.Cache.StaleTTL,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid cache %s: %v", name, err)
+		}
+	}
+
+	if Config.DNS.QueryLog.Path == "" {
+		Config.DNS.QueryLog.Path = "logs/queries.jsonl"
+	}
+	if Config.DNS.QueryLog.MaxSizeMB < 0 || Config.DNS.QueryLog.MaxBackups < 0 {
+		return fmt.Errorf("query_log max_size_mb and max_backups must not be negative")
+	}
+	if Config.DNS.QueryLog.RotateInterval != "" {
+		if _, err := ParseDuration(Config.DNS.QueryLog.RotateInterval); err != nil {
+			return fmt.Errorf("invalid query_log rotate_interval: %v", err)
+		}
+	}
+
+	if Config.DNS.Blocklists.ReloadInterval == "" {
+		Config.DNS.Blocklists.ReloadInterval = "5m"
+	}
+	if _, err := ParseDuration(Config.DNS.Blocklists.ReloadInterval); err != nil {
+		return fmt.Errorf("invalid blocklists reload_interval: %v", err)
+	}
+	for i, source := range Config.DNS.Blocklists.Sources {
+		if source.Path == "" {
+			return fmt.Errorf("blocklist source %d: path is required", i)
+		}
+		switch source.Format {
+		case "", "hosts", "adblock", "rpz":
+		default:
+			return fmt.Errorf("blocklist source %d: unknown format %q (expected hosts, adblock or rpz)", i, source.Format)
+		}
+		switch source.Response {
+		case "", "nxdomain", "zero", "refused":
+		default:
+			return fmt.Errorf("blocklist source %d: unknown response %q (expected nxdomain, zero or refused)", i, source.Response)
+		}
+	}
+
+	for _, anchor := range Config.DNS.DNSSEC.TrustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return fmt.Errorf("invalid dnssec trust anchor: %v", err)
+		}
+		if ds, ok := rr.(*dns.DS); !ok || ds.Hdr.Name != "." {
+			return fmt.Errorf("dnssec trust anchor %q must be a DS record for the root", anchor)
+		}
+	}
+
+	groups := map[string]bool{}
+	for i, group := range Config.DNS.ClientGroups {
+		if err := validateClientGroup(group); err != nil {
+			return fmt.Errorf("client group %d: %v", i, err)
+		}
+		if groups[group.Name] {
+			return fmt.Errorf("client group %d: duplicate name %q", i, group.Name)
+		}
+		groups[group.Name] = true
 	}
 
 	if Config.Proxy.UpstreamURL == "" {
@@ -111,17 +268,103 @@ func validate() error {
 
 	// Validate DNS redirects
 	for i, redirect := range Config.DNS.Redirects {
-		if redirect.Domain == "" {
-			return fmt.Errorf("redirect %d: domain is required", i)
-		}
-		if redirect.Target == "" {
-			return fmt.Errorf("redirect %d: target is required", i)
+		if err := validateRedirect(redirect); err != nil {
+			return fmt.Errorf("redirect %d: %v", i, err)
 		}
 	}
 
 	return nil
 }
 
+// isACLAction reports whether action is a known ACL action
+func isACLAction(action string) bool {
+	switch action {
+	case "allow", "refuse", "drop", "forward-only":
+		return true
+	}
+	return false
+}
+
+// ParseNetwork parses a CIDR such as "192.168.1.0/24", or a single IP as a
+// network containing only that address
+func ParseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", value)
+	}
+	return network, nil
+}
+
+// ParseListenAddress parses a DNS listen address: "host:port", "[ipv6]:port",
+// ":port" for every address, or a bare IP using defaultPort. A "udp://" or
+// "tcp://" prefix listens on only that protocol. It returns the networks to
+// bind, such as "udp4" and "tcp4", and the address.
+func ParseListenAddress(value, defaultPort string) ([]string, string, error) {
+	protocols := []string{"udp", "tcp"}
+	address := value
+	if scheme, rest, ok := strings.Cut(value, "://"); ok {
+		if scheme != "udp" && scheme != "tcp" {
+			return nil, "", fmt.Errorf("listen address %q: unknown protocol %q (expected udp or tcp)", value, scheme)
+		}
+		protocols = []string{scheme}
+		address = rest
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), defaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, "", fmt.Errorf("listen address %q: invalid port %q", value, port)
+	}
+
+	// Without a host the socket accepts IPv4 and IPv6; an explicit address
+	// binds only its own family, so "0.0.0.0:53" and "[::]:53" can coexist
+	family := ""
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, "", fmt.Errorf("listen address %q: host must be an IP address", value)
+		}
+		family = "6"
+		if ip.To4() != nil {
+			family = "4"
+		}
+	}
+
+	networks := make([]string, 0, len(protocols))
+	for _, protocol := range protocols {
+		networks = append(networks, protocol+family)
+	}
+	return networks, net.JoinHostPort(host, port), nil
+}
+
+// ParseDuration parses a duration setting such as "30s" or "5m". A bare "0"
+// is accepted and means disabled.
+func ParseDuration(value string) (time.Duration, error) {
+	if value == "0" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	return d, nil
+}
+
 // setLogLevel configures the log level
 func setLogLevel(level string) {
 	switch level {
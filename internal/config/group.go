@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validateClientGroup checks a client group's addresses and redirects
+func validateClientGroup(group ClientGroup) error {
+	if group.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(group.Networks) == 0 && len(group.MACs) == 0 {
+		return fmt.Errorf("group %s needs at least one network or MAC address", group.Name)
+	}
+	for _, network := range group.Networks {
+		if _, err := ParseNetwork(network); err != nil {
+			return fmt.Errorf("group %s: %v", group.Name, err)
+		}
+	}
+	for _, mac := range group.MACs {
+		if _, err := ParseMAC(mac); err != nil {
+			return fmt.Errorf("group %s: %v", group.Name, err)
+		}
+	}
+	for i, redirect := range group.Redirects {
+		if err := validateRedirect(redirect); err != nil {
+			return fmt.Errorf("group %s redirect %d: %v", group.Name, i, err)
+		}
+	}
+	return nil
+}
+
+// ParseMAC parses a hardware address in the notations arp prints, including
+// macOS's unpadded "a:b:c:d:e:f" and Windows' "aa-bb-cc-dd-ee-ff"
+func ParseMAC(value string) (net.HardwareAddr, error) {
+	value = strings.TrimSpace(value)
+	sep := ":"
+	if strings.Contains(value, "-") {
+		sep = "-"
+	}
+
+	parts := strings.Split(value, sep)
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+
+	mac, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q", value)
+	}
+	return mac, nil
+}
+
+// clientGroupIndex returns the index of the named client group, or -1
+func clientGroupIndex(name string) int {
+	for i, group := range Config.DNS.ClientGroups {
+		if group.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddClientGroup adds a new client group to the configuration
+func AddClientGroup(group ClientGroup) error {
+	if err := validateClientGroup(group); err != nil {
+		return err
+	}
+	if clientGroupIndex(group.Name) >= 0 {
+		return fmt.Errorf("a client group named %s already exists", group.Name)
+	}
+
+	Config.DNS.ClientGroups = append(Config.DNS.ClientGroups, group)
+	return Save()
+}
+
+// UpdateClientGroup replaces the client group at index
+func UpdateClientGroup(index int, group ClientGroup) error {
+	if index < 0 || index >= len(Config.DNS.ClientGroups) {
+		return fmt.Errorf("invalid client group index: %d", index)
+	}
+	if err := validateClientGroup(group); err != nil {
+		return err
+	}
+	if existing := clientGroupIndex(group.Name); existing >= 0 && existing != index {
+		return fmt.Errorf("a client group named %s already exists", group.Name)
+	}
+
+	Config.DNS.ClientGroups[index] = group
+	return Save()
+}
+
+// RemoveClientGroup removes a client group and its redirects by index
+func RemoveClientGroup(index int) error {
+	if index < 0 || index >= len(Config.DNS.ClientGroups) {
+		return fmt.Errorf("invalid client group index: %d", index)
+	}
+
+	Config.DNS.ClientGroups = append(
+		Config.DNS.ClientGroups[:index],
+		Config.DNS.ClientGroups[index+1:]...,
+	)
+	return Save()
+}
+
+// redirectList returns the redirects of the named client group, or the
+// global redirects when group is empty
+func redirectList(group string) (*[]DNSRedirect, error) {
+	if group == "" {
+		return &Config.DNS.Redirects, nil
+	}
+
+	index := clientGroupIndex(group)
+	if index < 0 {
+		return nil, fmt.Errorf("unknown client group %s", group)
+	}
+	return &Config.DNS.ClientGroups[index].Redirects, nil
+}
+
+// GroupRedirects returns the redirects of the named client group, or the
+// global redirects when group is empty
+func GroupRedirects(group string) []DNSRedirect {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return nil
+	}
+	return *redirects
+}
+
+// AddGroupRedirect adds a DNS redirect to a client group, or to the global
+// redirects when group is empty
+func AddGroupRedirect(group string, redirect DNSRedirect) error {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return err
+	}
+	if err := validateRedirect(redirect); err != nil {
+		return err
+	}
+
+	*redirects = append(*redirects, redirect)
+	return Save()
+}
+
+// UpdateGroupRedirect replaces the DNS redirect at index of a client group
+func UpdateGroupRedirect(group string, index int, redirect DNSRedirect) error {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(*redirects) {
+		return fmt.Errorf("invalid redirect index: %d", index)
+	}
+	if err := validateRedirect(redirect); err != nil {
+		return err
+	}
+
+	(*redirects)[index] = redirect
+	return Save()
+}
+
+// RemoveGroupRedirect removes a DNS redirect of a client group by index
+func RemoveGroupRedirect(group string, index int) error {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(*redirects) {
+		return fmt.Errorf("invalid redirect index: %d", index)
+	}
+
+	*redirects = append((*redirects)[:index], (*redirects)[index+1:]...)
+	return Save()
+}
+
+// ToggleGroupRedirect enables/disables a DNS redirect of a client group by index
+func ToggleGroupRedirect(group string, index int) error {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(*redirects) {
+		return fmt.Errorf("invalid redirect index: %d", index)
+	}
+
+	(*redirects)[index].Enabled = !(*redirects)[index].Enabled
+	return Save()
+}
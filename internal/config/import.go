@@ -0,0 +1,400 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Import formats
+const (
+	ImportHosts = "hosts" // "127.0.0.1 api.example.com" lines
+	ImportZone  = "zone"  // RFC 1035 master file
+)
+
+// Import actions
+const (
+	ImportAdd       = "add"       // new redirect
+	ImportUpdate    = "update"    // redirect from an earlier import of the same file changed
+	ImportUnchanged = "unchanged" // redirect from an earlier import of the same file is identical
+	ImportConflict  = "conflict"  // domain already has a redirect from elsewhere
+	ImportRemove    = "remove"    // redirect from an earlier import is gone from the file
+)
+
+// ImportChange is one step of applying an import to the configured redirects
+type ImportChange struct {
+	Action   string
+	Redirect DNSRedirect // the imported redirect, or the one to remove
+	Index    int         // index of the existing redirect, -1 for ImportAdd
+}
+
+// Existing returns the configured redirect the change updates, replaces or
+// removes, or nil for an addition
+func (c ImportChange) Existing() *DNSRedirect {
+	if c.Index < 0 || c.Index >= len(Config.DNS.Redirects) {
+		return nil
+	}
+	return &Config.DNS.Redirects[c.Index]
+}
+
+// ImportRedirects parses a hosts or zone file into redirects. format is
+// ImportHosts, ImportZone or empty to decide by file name; origin is the zone
+// apex for zone files without $ORIGIN and is derived from the file name when
+// empty. Every redirect records the file's absolute path as its source.
+// Entries that can't become redirects are returned as warnings.
+func ImportRedirects(path, format, origin string) ([]DNSRedirect, []string, error) {
+	source, err := ImportSource(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if format == "" {
+		format = importFormat(source)
+	}
+
+	var redirects []DNSRedirect
+	var warnings []string
+	switch format {
+	case ImportHosts:
+		redirects, warnings, err = ParseHosts(file)
+	case ImportZone:
+		if origin == "" {
+			origin = zoneOrigin(source)
+		}
+		redirects, warnings, err = ParseZone(file, origin, source)
+	default:
+		return nil, nil, fmt.Errorf("unknown import format %q (expected hosts or zone)", format)
+	}
+	if err != nil {
+		return nil, warnings, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	for i := range redirects {
+		redirects[i].Source = source
+		redirects[i].Description = fmt.Sprintf("Imported from %s", filepath.Base(source))
+	}
+	return redirects, warnings, nil
+}
+
+// ImportSource returns the source recorded on the redirects imported from path
+func ImportSource(path string) (string, error) {
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid path %q: %v", path, err)
+	}
+	return source, nil
+}
+
+// importFormat guesses the format of a file from its name
+func importFormat(path string) string {
+	base := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasPrefix(base, "db."), strings.HasSuffix(base, ".zone"), strings.HasSuffix(base, ".db"):
+		return ImportZone
+	default:
+		return ImportHosts
+	}
+}
+
+// zoneOrigin derives the zone apex from names such as "db.example.com" or
+// "example.com.zone", falling back to the root
+func zoneOrigin(path string) string {
+	base := strings.ToLower(filepath.Base(path))
+	base = strings.TrimPrefix(base, "db.")
+	base = strings.TrimSuffix(base, ".zone")
+	base = strings.TrimSuffix(base, ".db")
+	if _, ok := dns.IsDomainName(base); ok && strings.Contains(base, ".") {
+		return dns.Fqdn(base)
+	}
+	return "."
+}
+
+// ParseHosts parses hosts file lines ("192.168.1.10 api.example.com api2")
+// into one redirect per name, answering with every address listed for it.
+// Names of the local machine such as localhost are skipped.
+func ParseHosts(r io.Reader) ([]DNSRedirect, []string, error) {
+	var redirects []DNSRedirect
+	var warnings []string
+	byName := map[string]int{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			warnings = append(warnings, fmt.Sprintf("line %d: expected an IP address followed by names", line))
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if isLocalHostName(name) {
+				continue
+			}
+			if !isHostName(name) {
+				warnings = append(warnings, fmt.Sprintf("line %d: %q is not a domain name", line, name))
+				continue
+			}
+
+			i, ok := byName[name]
+			if !ok {
+				i = len(redirects)
+				byName[name] = i
+				redirects = append(redirects, DNSRedirect{Domain: name, Enabled: true})
+			}
+			addAddressTarget(&redirects[i], ip)
+		}
+	}
+	return redirects, warnings, scanner.Err()
+}
+
+// isLocalHostName reports whether a hosts entry names the local machine
+func isLocalHostName(name string) bool {
+	switch name {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback",
+		"ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts":
+		return true
+	}
+	return false
+}
+
+// isHostName reports whether name is made of letters, digits, hyphens and
+// underscores separated by dots
+func isHostName(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addAddressTarget adds ip to the redirect's address targets unless present
+func addAddressTarget(redirect *DNSRedirect, ip net.IP) {
+	value := ip.String()
+	ipv4, ipv6 := redirect.AddressTargets()
+	for _, existing := range append(ipv4, ipv6...) {
+		if existing == value {
+			return
+		}
+	}
+
+	switch {
+	case redirect.Target == "":
+		redirect.Target = value
+	case ip.To4() != nil:
+		redirect.IPv4 = append(redirect.IPv4, value)
+	default:
+		redirect.IPv6 = append(redirect.IPv6, value)
+	}
+}
+
+// ParseZone parses an RFC 1035 master file into one redirect per owner name
+// from its A, AAAA, CNAME, TXT and SRV records. Wildcard owners become
+// "*.domain" patterns. SOA and NS records are ignored and other types are
+// reported as warnings; $INCLUDE is refused. filename is only used in messages.
+func ParseZone(r io.Reader, origin, filename string) ([]DNSRedirect, []string, error) {
+	var redirects []DNSRedirect
+	var warnings []string
+	byName := map[string]int{}
+	skipped := map[string]int{}
+
+	parser := dns.NewZoneParser(r, dns.Fqdn(origin), filename)
+	parser.SetIncludeAllowed(false)
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		switch header.Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			continue
+		case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeSRV:
+		default:
+			skipped[dns.TypeToString[header.Rrtype]]++
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(header.Name, "."))
+		if name == "" {
+			warnings = append(warnings, fmt.Sprintf("skipping %s record for the root", dns.TypeToString[header.Rrtype]))
+			continue
+		}
+
+		i, ok := byName[name]
+		if !ok {
+			i = len(redirects)
+			byName[name] = i
+			redirects = append(redirects, DNSRedirect{Domain: name, Enabled: true})
+		}
+		redirect := &redirects[i]
+
+		switch record := rr.(type) {
+		case *dns.A:
+			addAddressTarget(redirect, record.A)
+		case *dns.AAAA:
+			addAddressTarget(redirect, record.AAAA)
+		case *dns.CNAME:
+			redirect.CNAME = strings.TrimSuffix(record.Target, ".")
+		case *dns.TXT:
+			redirect.TXT = append(redirect.TXT, strings.Join(record.Txt, ""))
+		case *dns.SRV:
+			redirect.SRV = append(redirect.SRV, SRVRecord{
+				Priority: record.Priority,
+				Weight:   record.Weight,
+				Port:     record.Port,
+				Target:   strings.TrimSuffix(record.Target, "."),
+			})
+		}
+
+		// A name's answers share the lowest TTL of its records
+		if redirect.TTL == 0 || header.Ttl < redirect.TTL {
+			redirect.TTL = header.Ttl
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, warnings, err
+	}
+
+	for rrtype, count := range skipped {
+		warnings = append(warnings, fmt.Sprintf("skipping %d %s records (only A, AAAA, CNAME, TXT and SRV can be redirected)", count, rrtype))
+	}
+
+	valid := redirects[:0]
+	for _, redirect := range redirects {
+		if err := validateRedirect(redirect); err != nil {
+			warnings = append(warnings, fmt.Sprintf("skipping %s: %v", redirect.Domain, err))
+			continue
+		}
+		valid = append(valid, redirect)
+	}
+	return valid, warnings, nil
+}
+
+// PlanImport compares the redirects imported from source with the configured
+// ones. A domain that an earlier import of the same source already added is
+// updated in place; a domain configured by hand or from another source is a
+// conflict. Redirects from source that are no longer in the file are removed,
+// all of them when the file is now empty.
+func PlanImport(source string, imported []DNSRedirect) []ImportChange {
+	var changes []ImportChange
+	seen := map[int]bool{}
+
+	for _, redirect := range imported {
+		index := -1
+		for i, existing := range Config.DNS.Redirects {
+			if strings.EqualFold(existing.Domain, redirect.Domain) {
+				index = i
+				break
+			}
+		}
+
+		change := ImportChange{Action: ImportAdd, Redirect: redirect, Index: index}
+		if index >= 0 {
+			seen[index] = true
+			existing := Config.DNS.Redirects[index]
+			switch {
+			case existing.Source != redirect.Source:
+				change.Action = ImportConflict
+			case sameRecords(existing, redirect):
+				change.Action = ImportUnchanged
+			default:
+				change.Action = ImportUpdate
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	for i, existing := range Config.DNS.Redirects {
+		if existing.Source == source && !seen[i] {
+			changes = append(changes, ImportChange{Action: ImportRemove, Redirect: existing, Index: i})
+		}
+	}
+	return changes
+}
+
+// sameRecords reports whether two redirects answer with the same records
+func sameRecords(a, b DNSRedirect) bool {
+	a.Description, b.Description = "", ""
+	a.Enabled, b.Enabled = false, false
+	keepSchedule(&a, b)
+	return reflect.DeepEqual(a, b)
+}
+
+// keepSchedule copies the time window and schedule of existing onto redirect
+func keepSchedule(redirect *DNSRedirect, existing DNSRedirect) {
+	redirect.ActiveFrom = existing.ActiveFrom
+	redirect.ActiveUntil = existing.ActiveUntil
+	redirect.Schedule = existing.Schedule
+	redirect.ScheduleDuration = existing.ScheduleDuration
+}
+
+// ApplyImport applies the chosen changes and saves the configuration once.
+// Updates and replaced conflicts keep the existing redirect's position,
+// description, enabled state and schedule; additions are appended.
+func ApplyImport(changes []ImportChange) error {
+	redirects := append([]DNSRedirect{}, Config.DNS.Redirects...)
+	removed := map[int]bool{}
+
+	for _, change := range changes {
+		if change.Action != ImportRemove {
+			if err := validateRedirect(change.Redirect); err != nil {
+				return fmt.Errorf("redirect %s: %v", change.Redirect.Domain, err)
+			}
+		}
+		if change.Action != ImportAdd && (change.Index < 0 || change.Index >= len(redirects)) {
+			return fmt.Errorf("invalid redirect index: %d", change.Index)
+		}
+
+		switch change.Action {
+		case ImportAdd:
+			redirects = append(redirects, change.Redirect)
+		case ImportUpdate, ImportConflict:
+			existing := redirects[change.Index]
+			redirect := change.Redirect
+			redirect.Enabled = existing.Enabled
+			keepSchedule(&redirect, existing)
+			if existing.Description != "" {
+				redirect.Description = existing.Description
+			}
+			redirects[change.Index] = redirect
+		case ImportRemove:
+			removed[change.Index] = true
+		}
+	}
+
+	kept := redirects[:0]
+	for i, redirect := range redirects {
+		if !removed[i] {
+			kept = append(kept, redirect)
+		}
+	}
+
+	Config.DNS.Redirects = kept
+	return Save()
+}
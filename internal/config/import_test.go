@@ -0,0 +1,152 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	input := `# comment
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+192.168.1.10 api.example.com API2.Example.com. # trailing comment
+192.168.1.11 api.example.com
+fd00::10 api.example.com
+192.168.1.10 api.example.com
+not-an-ip example.com
+192.168.1.12
+192.168.1.13 bad!name.example.com
+`
+	redirects, warnings, err := ParseHosts(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DNSRedirect{
+		{Domain: "api.example.com", Target: "192.168.1.10", IPv4: []string{"192.168.1.11"}, IPv6: []string{"fd00::10"}, Enabled: true},
+		{Domain: "api2.example.com", Target: "192.168.1.10", Enabled: true},
+	}
+	if !reflect.DeepEqual(redirects, want) {
+		t.Errorf("redirects = %+v\nwant %+v", redirects, want)
+	}
+	if len(warnings) != 3 {
+		t.Errorf("warnings = %q, want one each for lines 8, 9 and 10", warnings)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	input := `$TTL 600
+@        IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300
+@        IN NS  ns.example.com.
+api      IN A     192.168.1.10
+api  300 IN AAAA  fd00::10
+*.cdn    IN A     192.168.1.20
+www      IN CNAME api
+_sip._udp IN SRV 10 5 5060 sip.example.com.
+info     IN TXT   "hello " "world"
+mail     IN MX    10 mx.example.com.
+`
+	redirects, warnings, err := ParseZone(strings.NewReader(input), "example.com", "db.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DNSRedirect{
+		{Domain: "api.example.com", Target: "192.168.1.10", IPv6: []string{"fd00::10"}, TTL: 300, Enabled: true},
+		{Domain: "*.cdn.example.com", Target: "192.168.1.20", TTL: 600, Enabled: true},
+		{Domain: "www.example.com", CNAME: "api.example.com", TTL: 600, Enabled: true},
+		{Domain: "_sip._udp.example.com", SRV: []SRVRecord{{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}}, TTL: 600, Enabled: true},
+		{Domain: "info.example.com", TXT: []string{"hello world"}, TTL: 600, Enabled: true},
+	}
+	if !reflect.DeepEqual(redirects, want) {
+		t.Errorf("redirects = %+v\nwant %+v", redirects, want)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "MX") {
+		t.Errorf("warnings = %q, want one about the MX record", warnings)
+	}
+}
+
+func TestParseZoneRejectsInclude(t *testing.T) {
+	input := "$INCLUDE /etc/passwd\napi IN A 192.168.1.10\n"
+	if _, _, err := ParseZone(strings.NewReader(input), "example.com", "db.example.com"); err == nil {
+		t.Error("$INCLUDE was accepted")
+	}
+}
+
+func TestImportFormat(t *testing.T) {
+	tests := []struct {
+		path, format, origin string
+	}{
+		{"/etc/hosts", ImportHosts, "."},
+		{"db.example.com", ImportZone, "example.com."},
+		{"example.com.zone", ImportZone, "example.com."},
+		{"lan.db", ImportZone, "."},
+	}
+	for _, tt := range tests {
+		if format := importFormat(tt.path); format != tt.format {
+			t.Errorf("importFormat(%q) = %q, want %q", tt.path, format, tt.format)
+		}
+		if origin := zoneOrigin(tt.path); origin != tt.origin {
+			t.Errorf("zoneOrigin(%q) = %q, want %q", tt.path, origin, tt.origin)
+		}
+	}
+}
+
+func TestPlanImport(t *testing.T) {
+	const source = "/srv/hosts"
+	imported := func(domain, target string) DNSRedirect {
+		return DNSRedirect{Domain: domain, Target: target, Enabled: true, Source: source, Description: "Imported from hosts"}
+	}
+
+	Config = &AppConfig{}
+	Config.DNS.Redirects = []DNSRedirect{
+		{Domain: "same.example.com", Target: "192.168.1.1", Source: source, Description: "kept", Schedule: "0 18 * * fri", ScheduleDuration: "2h"},
+		{Domain: "changed.example.com", Target: "192.168.1.1", Source: source},
+		{Domain: "manual.example.com", Target: "127.0.0.1", Enabled: true},
+		{Domain: "other.example.com", Target: "127.0.0.1", Source: "/srv/other"},
+		{Domain: "gone.example.com", Target: "192.168.1.1", Source: source},
+	}
+	t.Cleanup(func() { Config = nil })
+
+	changes := PlanImport(source, []DNSRedirect{
+		imported("same.example.com", "192.168.1.1"),
+		imported("Changed.example.com", "192.168.1.2"),
+		imported("manual.example.com", "192.168.1.3"),
+		imported("other.example.com", "192.168.1.4"),
+		imported("new.example.com", "192.168.1.5"),
+	})
+
+	want := []struct {
+		action, domain string
+		index          int
+	}{
+		{ImportUnchanged, "same.example.com", 0},
+		{ImportUpdate, "Changed.example.com", 1},
+		{ImportConflict, "manual.example.com", 2},
+		{ImportConflict, "other.example.com", 3},
+		{ImportAdd, "new.example.com", -1},
+		{ImportRemove, "gone.example.com", 4},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes, want %d: %+v", len(changes), len(want), changes)
+	}
+	for i, change := range changes {
+		if change.Action != want[i].action || change.Redirect.Domain != want[i].domain || change.Index != want[i].index {
+			t.Errorf("change %d = %s %s at %d, want %s %s at %d", i,
+				change.Action, change.Redirect.Domain, change.Index, want[i].action, want[i].domain, want[i].index)
+		}
+	}
+
+	// An emptied file removes everything earlier imports of it added
+	var removed []string
+	for _, change := range PlanImport(source, nil) {
+		if change.Action != ImportRemove {
+			t.Errorf("unexpected %s of %s for an empty file", change.Action, change.Redirect.Domain)
+		}
+		removed = append(removed, change.Redirect.Domain)
+	}
+	if want := []string{"same.example.com", "changed.example.com", "gone.example.com"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v for an empty file, want %v", removed, want)
+	}
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IsExclusion reports whether the redirect is a "!domain" exclusion
+func (r DNSRedirect) IsExclusion() bool {
+	return strings.HasPrefix(strings.TrimSpace(r.Domain), "!")
+}
+
+// AddressTargets returns the redirect's IPv4 and IPv6 targets, including the
+// legacy single Target field
+func (r DNSRedirect) AddressTargets() (ipv4, ipv6 []string) {
+	all := append([]string{}, r.IPv4...)
+	all = append(all, r.IPv6...)
+	if r.Target != "" {
+		all = append([]string{r.Target}, all...)
+	}
+
+	for _, target := range all {
+		ip := net.ParseIP(target)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			ipv4 = appendUnique(ipv4, ip.String())
+		default:
+			ipv6 = appendUnique(ipv6, ip.String())
+		}
+	}
+	return ipv4, ipv6
+}
+
+// HostTarget returns the target hostname, resolved through upstream DNS, or
+// "" if the target is an IP address or unset
+func (r DNSRedirect) HostTarget() string {
+	if r.Target == "" || net.ParseIP(r.Target) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.Target), "."))
+}
+
+// appendUnique appends value unless it is already present
+func appendUnique(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// Summary returns a short human-readable description of what the redirect answers with
+func (r DNSRedirect) Summary() string {
+	if r.IsExclusion() {
+		return "excluded"
+	}
+	if r.CNAME != "" {
+		return "CNAME " + r.CNAME
+	}
+
+	var parts []string
+	if host := r.HostTarget(); host != "" {
+		parts = append(parts, host+" (resolved)")
+	}
+	ipv4, ipv6 := r.AddressTargets()
+	parts = append(parts, ipv4...)
+	parts = append(parts, ipv6...)
+	if len(r.TXT) > 0 {
+		parts = append(parts, fmt.Sprintf("%d TXT", len(r.TXT)))
+	}
+	if len(r.SRV) > 0 {
+		parts = append(parts, fmt.Sprintf("%d SRV", len(r.SRV)))
+	}
+
+	if len(parts) == 0 {
+		return r.Target
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validateRedirect checks a single redirect's records
+func validateRedirect(redirect DNSRedirect) error {
+	if redirect.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+	if err := validateSchedule(redirect); err != nil {
+		return err
+	}
+
+	// Exclusions ("!domain") only suppress other redirects and need no records
+	if redirect.IsExclusion() {
+		return nil
+	}
+
+	if host := redirect.HostTarget(); host != "" {
+		if !isHostName(host) {
+			return fmt.Errorf("target %q is neither an IP address nor a hostname", redirect.Target)
+		}
+		if len(redirect.IPv4) > 0 || len(redirect.IPv6) > 0 {
+			return fmt.Errorf("hostname target %s cannot be combined with ipv4 or ipv6 targets", host)
+		}
+	}
+	for _, ip := range redirect.IPv4 {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+			return fmt.Errorf("ipv4 target %q is not an IPv4 address", ip)
+		}
+	}
+	for _, ip := range redirect.IPv6 {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+			return fmt.Errorf("ipv6 target %q is not an IPv6 address", ip)
+		}
+	}
+	for _, srv := range redirect.SRV {
+		if srv.Target == "" {
+			return fmt.Errorf("srv record needs a target")
+		}
+	}
+
+	hasRecords := redirect.Target != "" || len(redirect.IPv4) > 0 || len(redirect.IPv6) > 0 ||
+		len(redirect.TXT) > 0 || len(redirect.SRV) > 0
+	if redirect.CNAME != "" && hasRecords {
+		return fmt.Errorf("a cname redirect cannot have other records")
+	}
+	if redirect.CNAME == "" && !hasRecords {
+		return fmt.Errorf("target is required")
+	}
+
+	return nil
+}
+
+// ParseSRVRecord parses "priority weight port target", e.g. "10 5 5222 xmpp.example.com"
+func ParseSRVRecord(value string) (SRVRecord, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return SRVRecord{}, fmt.Errorf("SRV record %q must be \"priority weight port target\"", value)
+	}
+
+	var numbers [3]uint16
+	for i, field := range fields[:3] {
+		n, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return SRVRecord{}, fmt.Errorf("SRV record %q: invalid number %q", value, field)
+		}
+		numbers[i] = uint16(n)
+	}
+
+	return SRVRecord{Priority: numbers[0], Weight: numbers[1], Port: numbers[2], Target: fields[3]}, nil
+}
+
+// String formats the record as accepted by ParseSRVRecord
+func (s SRVRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, s.Target)
+}
@@ -0,0 +1,481 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTransitionSteps bounds the search for a redirect's next state change
+	// through boundaries that don't change it, such as overlapping windows
+	maxTransitionSteps = 64
+	// cronSearchYears bounds how far ahead a schedule's next firing is searched
+	cronSearchYears = 5
+)
+
+// cronShortcuts are the "@" shortcuts accepted in schedules
+var cronShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronField describes the range and names of a cron field
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // names[i] stands for min+i
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// cronSchedule is a parsed "minute hour day-of-month month day-of-week"
+// expression, each field a bit set of the values it allows
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// cronCache holds parsed schedules by expression, nil for invalid ones
+var (
+	cronCacheMu sync.Mutex
+	cronCache   = map[string]*cronSchedule{}
+)
+
+// parseCron parses a five-field cron expression with *, lists, ranges, steps
+// and month/day names, or a shortcut such as @daily. Times are local.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(strings.ToLower(expr))
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday is both 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses one comma-separated field into a bit set
+func parseCronField(value string, field cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepPart, field.name)
+			}
+			step = n
+		}
+
+		var low, high int
+		switch {
+		case rangePart == "*":
+			low, high = field.min, field.max
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = cronValue(from, field); err != nil {
+				return 0, err
+			}
+			if high, err = cronValue(to, field); err != nil {
+				return 0, err
+			}
+			// Sunday ends a range as 7, so "mon-sun" is the whole week
+			if to == "sun" && low > 0 {
+				high = 7
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangePart, field.name)
+			}
+		default:
+			n, err := cronValue(rangePart, field)
+			if err != nil {
+				return 0, err
+			}
+			// "5/15" runs from 5 to the end of the range
+			low, high = n, n
+			if hasStep {
+				high = field.max
+			}
+		}
+
+		for n := low; n <= high; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+// cronValue parses a number or name of a field
+func cronValue(value string, field cronField) (int, error) {
+	for i, name := range field.names {
+		if value == name {
+			return field.min + i, nil
+		}
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < field.min || n > field.max {
+		return 0, fmt.Errorf("invalid %s %q", field.name, value)
+	}
+	return n, nil
+}
+
+// dayMatches reports whether the schedule allows t's day. As in cron, when
+// both day fields are restricted a day matching either one is allowed.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule fires, or the zero time
+// if it doesn't fire within the next years (such as on February 30th). Times
+// skipped when clocks go forward don't fire; times repeated when they go
+// back fire once.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Local().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		var next time.Time
+		switch {
+		case c.month&(1<<uint(month)) == 0:
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			next = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			next = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0, repeatedWallTime(t):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// A local time skipped when clocks go forward can come back as a
+		// time before the gap; step through the gap minute by minute
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// repeatedWallTime reports whether t is the second occurrence of its local
+// clock time, in the hour repeated when clocks go back
+func repeatedWallTime(t time.Time) bool {
+	earlier := t.Add(-time.Hour)
+	_, offset := t.Zone()
+	_, earlierOffset := earlier.Zone()
+	return offset != earlierOffset && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+// cachedCron returns the parsed schedule of expr, or nil if it is invalid.
+// Each expression is parsed once, as redirects are checked on every query.
+func cachedCron(expr string) *cronSchedule {
+	cronCacheMu.Lock()
+	defer cronCacheMu.Unlock()
+
+	schedule, ok := cronCache[expr]
+	if !ok {
+		schedule, _ = parseCron(expr)
+		cronCache[expr] = schedule
+	}
+	return schedule
+}
+
+// ParseTime parses an active_from or active_until time: RFC 3339, or local
+// time as "2006-01-02 15:04"
+func ParseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected e.g. 2006-01-02 15:04 or RFC 3339)", value)
+}
+
+// validateSchedule checks a redirect's activation window and schedule
+func validateSchedule(redirect DNSRedirect) error {
+	var from, until time.Time
+	var err error
+	if redirect.ActiveFrom != "" {
+		if from, err = ParseTime(redirect.ActiveFrom); err != nil {
+			return fmt.Errorf("active_from: %v", err)
+		}
+	}
+	if redirect.ActiveUntil != "" {
+		if until, err = ParseTime(redirect.ActiveUntil); err != nil {
+			return fmt.Errorf("active_until: %v", err)
+		}
+	}
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return fmt.Errorf("active_until must be after active_from")
+	}
+
+	if (redirect.Schedule == "") != (redirect.ScheduleDuration == "") {
+		return fmt.Errorf("schedule and schedule_duration must be set together")
+	}
+	if redirect.Schedule != "" {
+		if _, err := parseCron(redirect.Schedule); err != nil {
+			return err
+		}
+		d, err := ParseDuration(redirect.ScheduleDuration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid schedule_duration %q", redirect.ScheduleDuration)
+		}
+	}
+	return nil
+}
+
+// window returns the redirect's parsed activation window and schedule; unset
+// or invalid parts are zero or nil
+func (r DNSRedirect) window() (from, until time.Time, schedule *cronSchedule, length time.Duration) {
+	if r.ActiveFrom != "" {
+		from, _ = ParseTime(r.ActiveFrom)
+	}
+	if r.ActiveUntil != "" {
+		until, _ = ParseTime(r.ActiveUntil)
+	}
+	if r.Schedule != "" {
+		schedule = cachedCron(r.Schedule)
+		length, _ = ParseDuration(r.ScheduleDuration)
+	}
+	return from, until, schedule, length
+}
+
+// IsScheduled reports whether the redirect is limited in time
+func (r DNSRedirect) IsScheduled() bool {
+	return r.ActiveFrom != "" || r.ActiveUntil != "" || r.Schedule != ""
+}
+
+// ActiveAt reports whether the redirect answers queries at t: it is enabled,
+// t is within active_from and active_until, and with a schedule, t falls in
+// a window that starts whenever the schedule fires and lasts schedule_duration
+func (r DNSRedirect) ActiveAt(t time.Time) bool {
+	if !r.Enabled {
+		return false
+	}
+
+	from, until, schedule, length := r.window()
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !until.IsZero() && !t.Before(until) {
+		return false
+	}
+	if schedule != nil {
+		// A window containing t must have started after t-length
+		start := schedule.next(t.Add(-length))
+		return !start.IsZero() && !start.After(t)
+	}
+	return true
+}
+
+// nextBoundary returns the first time after t at which the redirect's state
+// could change
+func (r DNSRedirect) nextBoundary(t time.Time) (time.Time, bool) {
+	from, until, schedule, length := r.window()
+
+	var candidates []time.Time
+	candidates = append(candidates, from, until)
+	if schedule != nil {
+		// The next window start, and the end of the earliest window containing t
+		candidates = append(candidates, schedule.next(t))
+		if start := schedule.next(t.Add(-length)); !start.IsZero() && !start.After(t) {
+			candidates = append(candidates, start.Add(length))
+		}
+	}
+
+	var next time.Time
+	for _, candidate := range candidates {
+		if candidate.After(t) && (next.IsZero() || candidate.Before(next)) {
+			next = candidate
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// NextTransition returns the next time after t at which the redirect turns
+// on or off, and false if its state never changes again
+func (r DNSRedirect) NextTransition(t time.Time) (time.Time, bool) {
+	if !r.Enabled || !r.IsScheduled() {
+		return time.Time{}, false
+	}
+
+	active := r.ActiveAt(t)
+	for range maxTransitionSteps {
+		next, ok := r.nextBoundary(t)
+		if !ok {
+			return time.Time{}, false
+		}
+		if r.ActiveAt(next) != active {
+			return next, true
+		}
+		t = next
+	}
+	return time.Time{}, false
+}
+
+// ScheduleSummary describes when a scheduled redirect is active, relative to now
+func (r DNSRedirect) ScheduleSummary(now time.Time) string {
+	var parts []string
+	if r.Schedule != "" {
+		parts = append(parts, fmt.Sprintf("%s for %s", r.Schedule, r.ScheduleDuration))
+	}
+
+	from, until, _, _ := r.window()
+	switch {
+	case !until.IsZero() && !now.Before(until):
+		parts = append(parts, "expired "+formatTransitionTime(until, now))
+	case !from.IsZero() && now.Before(from):
+		parts = append(parts, "from "+formatTransitionTime(from, now))
+		if !until.IsZero() {
+			parts = append(parts, "until "+formatTransitionTime(until, now))
+		}
+	case !until.IsZero():
+		parts = append(parts, "until "+formatTransitionTime(until, now))
+	}
+
+	if next, ok := r.NextTransition(now); ok && r.Schedule != "" {
+		state := "on"
+		if r.ActiveAt(now) {
+			state = "off"
+		}
+		parts = append(parts, fmt.Sprintf("next %s %s", state, formatTransitionTime(next, now)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatTransitionTime formats t in local time, leaving out the date when it is today
+func formatTransitionTime(t, now time.Time) string {
+	t, now = t.Local(), now.Local()
+	if t.Format(time.DateOnly) == now.Format(time.DateOnly) {
+		return t.Format("15:04")
+	}
+	return t.Format("Mon Jan 2 15:04")
+}
+
+// RedirectTransition is an upcoming change of a redirect's state
+type RedirectTransition struct {
+	Time     time.Time
+	Redirect DNSRedirect
+	Group    string // client group of the redirect, empty for a global one
+	Active   bool   // whether the redirect turns on
+}
+
+// UpcomingTransitions returns the next state change of every scheduled
+// redirect, global and in client groups, soonest first
+func UpcomingTransitions(t time.Time) []RedirectTransition {
+	var transitions []RedirectTransition
+	add := func(group string, redirects []DNSRedirect) {
+		for _, redirect := range redirects {
+			if next, ok := redirect.NextTransition(t); ok {
+				transitions = append(transitions, RedirectTransition{
+					Time:     next,
+					Redirect: redirect,
+					Group:    group,
+					Active:   !redirect.ActiveAt(t),
+				})
+			}
+		}
+	}
+
+	add("", Config.DNS.Redirects)
+	for _, group := range Config.DNS.ClientGroups {
+		add(group.Name, group.Redirects)
+	}
+
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Time.Before(transitions[j].Time)
+	})
+	return transitions
+}
+
+// GetActiveRedirects returns the global redirects that are active at t
+func GetActiveRedirects(t time.Time) []DNSRedirect {
+	var active []DNSRedirect
+	for _, redirect := range Config.DNS.Redirects {
+		if redirect.ActiveAt(t) {
+			active = append(active, redirect)
+		}
+	}
+	return active
+}
+
+// EnableGroupRedirectFor enables a redirect of a client group, or a global
+// one when group is empty, from now until d from now
+func EnableGroupRedirectFor(group string, index int, d time.Duration) error {
+	redirects, err := redirectList(group)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(*redirects) {
+		return fmt.Errorf("invalid redirect index: %d", index)
+	}
+	if d <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+
+	redirect := &(*redirects)[index]
+	if redirect.Schedule != "" {
+		return fmt.Errorf("redirect %s follows the schedule %q; edit it instead", redirect.Domain, redirect.Schedule)
+	}
+
+	now := time.Now()
+	redirect.Enabled = true
+	redirect.ActiveFrom = ""
+	redirect.ActiveUntil = now.Add(d).Truncate(time.Second).Format(time.RFC3339)
+	return Save()
+}
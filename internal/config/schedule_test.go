@@ -0,0 +1,187 @@
+package config
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // DST tests don't depend on the system's zone database
+)
+
+// inZone runs the test with the local time zone set to name
+func inZone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	time.Local = location
+	t.Cleanup(func() { time.Local = local })
+	return location
+}
+
+func TestParseCron(t *testing.T) {
+	valid := []string{
+		"* * * * *", "0 18 * * fri", "*/15 9-17 * * mon-fri", "0 0 1,15 * *",
+		"5/10 * * jan-mar *", "0 12 * * 7", "0 12 * * MON-SUN", "@daily", " @Weekly ",
+	}
+	for _, expr := range valid {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("parseCron(%q): %v", expr, err)
+		}
+	}
+
+	invalid := []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * * fri-mon", "* * * foo *", "@reboot",
+	}
+	for _, expr := range invalid {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+}
+
+func TestCronDayOfWeek(t *testing.T) {
+	tests := []struct {
+		expr string
+		days []time.Weekday // days the schedule fires on
+	}{
+		{"0 0 * * mon-sun", []time.Weekday{0, 1, 2, 3, 4, 5, 6}},
+		{"0 0 * * fri-sun", []time.Weekday{0, 5, 6}},
+		{"0 0 * * sun-tue", []time.Weekday{0, 1, 2}},
+		{"0 0 * * sun", []time.Weekday{0}},
+		{"0 0 * * 7", []time.Weekday{0}},
+		{"0 0 * * 5-7", []time.Weekday{0, 5, 6}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		want := map[time.Weekday]bool{}
+		for _, day := range tt.days {
+			want[day] = true
+		}
+		for day := time.Weekday(0); day < 7; day++ {
+			if got := schedule.dow&(1<<uint(day)) != 0; got != want[day] {
+				t.Errorf("%q fires on %s: %v, want %v", tt.expr, day, got, want[day])
+			}
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := inZone(t, "UTC")
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, utc)
+	}
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		want     time.Time
+		describe string
+	}{
+		{"0 18 * * fri", at(2026, 10, 14, 12, 0), at(2026, 10, 16, 18, 0), "next Friday"},
+		{"0 18 * * fri", at(2026, 10, 16, 18, 0), at(2026, 10, 23, 18, 0), "strictly after from"},
+		{"*/15 * * * *", at(2026, 10, 16, 9, 7), at(2026, 10, 16, 9, 15), "steps"},
+		{"30 9 31 * *", at(2026, 4, 1, 0, 0), at(2026, 5, 31, 9, 30), "months without the day are skipped"},
+		{"0 0 13 * fri", at(2026, 10, 14, 0, 0), at(2026, 10, 16, 0, 0), "day of month or week"},
+		{"0 0 29 2 *", at(2026, 3, 1, 0, 0), at(2028, 2, 29, 0, 0), "leap day"},
+		{"0 0 30 2 *", at(2026, 1, 1, 0, 0), time.Time{}, "never"},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := schedule.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q after %s = %s, want %s", tt.describe, tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestActiveAt(t *testing.T) {
+	utc := inZone(t, "UTC")
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2026, 10, day, hour, min, 0, 0, utc)
+	}
+
+	// Fridays 18:00 to 20:00 in the second half of October
+	redirect := DNSRedirect{
+		Enabled:          true,
+		ActiveFrom:       "2026-10-15 00:00",
+		ActiveUntil:      "2026-11-01 00:00",
+		Schedule:         "0 18 * * fri",
+		ScheduleDuration: "2h",
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(9, 19, 0), false}, // before active_from
+		{at(16, 17, 59), false},
+		{at(16, 18, 0), true},
+		{at(16, 19, 59), true},
+		{at(16, 20, 0), false},
+		{at(17, 19, 0), false},
+		{at(23, 18, 30), true},
+		{at(30, 19, 0), true},
+	}
+	for _, tt := range tests {
+		if got := redirect.ActiveAt(tt.t); got != tt.want {
+			t.Errorf("ActiveAt(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	disabled := redirect
+	disabled.Enabled = false
+	if disabled.ActiveAt(at(16, 19, 0)) {
+		t.Error("disabled redirect is active")
+	}
+
+	next, ok := redirect.NextTransition(at(16, 12, 0))
+	if !ok || !next.Equal(at(16, 18, 0)) {
+		t.Errorf("NextTransition before the window = %s, %v; want %s", next, ok, at(16, 18, 0))
+	}
+	next, ok = redirect.NextTransition(at(16, 19, 0))
+	if !ok || !next.Equal(at(16, 20, 0)) {
+		t.Errorf("NextTransition inside the window = %s, %v; want %s", next, ok, at(16, 20, 0))
+	}
+	if next, ok := redirect.NextTransition(at(31, 12, 0)); ok {
+		t.Errorf("NextTransition after the last window = %s, want none", next)
+	}
+}
+
+func TestNextTransitionDST(t *testing.T) {
+	newYork := inZone(t, "America/New_York")
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, newYork)
+	}
+	daily := func(schedule, duration string) DNSRedirect {
+		return DNSRedirect{Enabled: true, Schedule: schedule, ScheduleDuration: duration}
+	}
+
+	tests := []struct {
+		name     string
+		redirect DNSRedirect
+		from     time.Time
+		want     time.Time
+	}{
+		// Clocks go from 2:00 EST to 3:00 EDT on March 8, 2026
+		{"window spanning spring forward lasts its real duration", daily("0 1 * * *", "2h"), at(3, 8, 1, 30), at(3, 8, 4, 0)},
+		{"start after spring forward keeps its wall time", daily("0 18 * * *", "1h"), at(3, 8, 12, 0), at(3, 8, 18, 0)},
+		{"start in the skipped hour waits a day", daily("30 2 * * *", "30m"), at(3, 8, 0, 0), at(3, 9, 2, 30)},
+		// Clocks go from 2:00 EDT back to 1:00 EST on November 1, 2026
+		{"window spanning fall back lasts its real duration", daily("0 0 * * *", "2h"), at(11, 1, 0, 30), at(11, 1, 0, 0).Add(2 * time.Hour)},
+		{"start in the repeated hour fires once", daily("30 1 * * *", "10m"), at(11, 1, 1, 40), at(11, 2, 1, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, ok := tt.redirect.NextTransition(tt.from)
+			if !ok || !next.Equal(tt.want) {
+				t.Errorf("NextTransition(%s) = %s, %v; want %s", tt.from, next, ok, tt.want)
+			}
+		})
+	}
+}
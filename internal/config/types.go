@@ -2,18 +2,157 @@ package config
 
 // DNSRedirect represents a single DNS redirect configuration
 type DNSRedirect struct {
-	Domain      string `json:"domain" mapstructure:"domain"`           // Domain pattern (e.g., "*.ol.epicgames.com")
-	Target      string `json:"target" mapstructure:"target"`           // Target IP (usually "127.0.0.1")
-	Description string `json:"description" mapstructure:"description"` // User-friendly description
-	Enabled     bool   `json:"enabled" mapstructure:"enabled"`         // Whether this redirect is active
+	Domain      string      `json:"domain" mapstructure:"domain"`           // Domain pattern (e.g., "*.ol.epicgames.com")
+	Target      string      `json:"target,omitempty" mapstructure:"target"` // Target IP (usually "127.0.0.1") or a hostname resolved through upstream DNS
+	IPv4        []string    `json:"ipv4,omitempty" mapstructure:"ipv4"`     // Additional A targets, answered round-robin
+	IPv6        []string    `json:"ipv6,omitempty" mapstructure:"ipv6"`     // AAAA targets, answered round-robin
+	CNAME       string      `json:"cname,omitempty" mapstructure:"cname"`   // Alias to another name instead of answering with addresses
+	TXT         []string    `json:"txt,omitempty" mapstructure:"txt"`       // Static TXT records
+	SRV         []SRVRecord `json:"srv,omitempty" mapstructure:"srv"`       // Static SRV records
+	TTL         uint32      `json:"ttl,omitempty" mapstructure:"ttl"`       // TTL of synthesized answers in seconds (default 300)
+	Description string      `json:"description" mapstructure:"description"` // User-friendly description
+	Enabled     bool        `json:"enabled" mapstructure:"enabled"`         // Whether this redirect is active
+	Source      string      `json:"source,omitempty" mapstructure:"source"` // File the redirect was imported from, empty if added by hand
+
+	// Optional time limits; an enabled redirect only answers while all apply
+	ActiveFrom       string `json:"active_from,omitempty" mapstructure:"active_from"`             // Start time, RFC 3339 or local "2006-01-02 15:04"
+	ActiveUntil      string `json:"active_until,omitempty" mapstructure:"active_until"`           // End time, same formats
+	Schedule         string `json:"schedule,omitempty" mapstructure:"schedule"`                   // Cron expression starting each active window, e.g. "0 18 * * fri"
+	ScheduleDuration string `json:"schedule_duration,omitempty" mapstructure:"schedule_duration"` // Length of each window, e.g. "2h"
+}
+
+// SRVRecord is a static SRV answer for a redirect
+type SRVRecord struct {
+	Priority uint16 `json:"priority" mapstructure:"priority"`
+	Weight   uint16 `json:"weight" mapstructure:"weight"`
+	Port     uint16 `json:"port" mapstructure:"port"`
+	Target   string `json:"target" mapstructure:"target"`
 }
 
 // DNSConfig holds DNS server configuration
 type DNSConfig struct {
-	Redirects        []DNSRedirect `json:"redirects" mapstructure:"redirects"`
-	UpstreamDNS      string        `json:"upstream_dns" mapstructure:"upstream_dns"`
-	Port             string        `json:"port" mapstructure:"port"`
-	AutoManageSystem bool          `json:"auto_manage_system" mapstructure:"auto_manage_system"`
+	Redirects           []DNSRedirect   `json:"redirects" mapstructure:"redirects"`
+	UpstreamDNS         []string        `json:"upstream_dns" mapstructure:"upstream_dns"`                   // Upstream resolvers, e.g. ["1.1.1.1:53", "8.8.8.8"]
+	UpstreamStrategy    string          `json:"upstream_strategy" mapstructure:"upstream_strategy"`         // "failover", "parallel" or "fastest"
+	HealthCheckInterval string          `json:"health_check_interval" mapstructure:"health_check_interval"` // How often to probe upstreams (e.g. "30s", "0" to disable)
+	Port                string          `json:"port" mapstructure:"port"`                                   // Default port of listen addresses
+	Listen              []string        `json:"listen" mapstructure:"listen"`                               // Listen addresses, e.g. ["127.0.0.1:53", "udp://[::1]:53"]; empty listens on every address
+	StrictListen        bool            `json:"strict_listen" mapstructure:"strict_listen"`                 // Fail to start when a listen address can't be bound instead of falling back to other ports
+	AutoManageSystem    bool            `json:"auto_manage_system" mapstructure:"auto_manage_system"`
+	AllowDoHCanary      bool            `json:"allow_doh_canary" mapstructure:"allow_doh_canary"` // Forward use-application-dns.net instead of answering NXDOMAIN
+	DoH                 DoHConfig       `json:"doh" mapstructure:"doh"`
+	DoT                 DoTConfig       `json:"dot" mapstructure:"dot"`
+	Cache               CacheConfig     `json:"cache" mapstructure:"cache"`
+	QueryLog            QueryLogConfig  `json:"query_log" mapstructure:"query_log"`
+	Blocklists          BlocklistConfig `json:"blocklists" mapstructure:"blocklists"`
+	ForwardZones        []ForwardZone   `json:"forward_zones" mapstructure:"forward_zones"` // Domains resolved by dedicated upstreams
+	RateLimit           RateLimitConfig `json:"rate_limit" mapstructure:"rate_limit"`
+	ACL                 ACLConfig       `json:"acl" mapstructure:"acl"`
+	AllowAny            bool            `json:"allow_any" mapstructure:"allow_any"`             // Answer ANY queries in full instead of minimally (RFC 8482)
+	PrivateReverse      bool            `json:"private_reverse" mapstructure:"private_reverse"` // Answer reverse lookups in private ranges ourselves instead of forwarding them
+	FlattenCNAMEs       bool            `json:"flatten_cnames" mapstructure:"flatten_cnames"`   // Answer upstream CNAME chains into redirected domains with the final records only
+	DNSSEC              DNSSECConfig    `json:"dnssec" mapstructure:"dnssec"`
+	ClientGroups        []ClientGroup   `json:"client_groups" mapstructure:"client_groups"` // Clients with their own redirects
+}
+
+// ClientGroup gives clients, picked by source address, their own redirects.
+// When groups overlap, the most specific network wins; a MAC address is as
+// specific as a single IP.
+type ClientGroup struct {
+	Name                  string        `json:"name" mapstructure:"name"`
+	Networks              []string      `json:"networks" mapstructure:"networks"` // CIDRs or single IPs
+	MACs                  []string      `json:"macs" mapstructure:"macs"`         // Hardware addresses, matched through the ARP/neighbor table
+	Redirects             []DNSRedirect `json:"redirects" mapstructure:"redirects"`
+	IgnoreGlobalRedirects bool          `json:"ignore_global_redirects" mapstructure:"ignore_global_redirects"` // Only answer the group's redirects instead of falling back to the global ones
+}
+
+// DNSSECConfig controls validation of forwarded answers
+type DNSSECConfig struct {
+	Enabled      bool     `json:"enabled" mapstructure:"enabled"`
+	TrustAnchors []string `json:"trust_anchors" mapstructure:"trust_anchors"` // Root DS records replacing the built-in anchors, e.g. ". IN DS 20326 8 2 E06D..."
+}
+
+// CacheConfig controls the cache for forwarded DNS responses
+type CacheConfig struct {
+	Enabled        bool   `json:"enabled" mapstructure:"enabled"`
+	MaxEntries     int    `json:"max_entries" mapstructure:"max_entries"`           // LRU size bound
+	MaxTTL         string `json:"max_ttl" mapstructure:"max_ttl"`                   // Upper bound for positive answers (e.g. "1h")
+	MaxNegativeTTL string `json:"max_negative_ttl" mapstructure:"max_negative_ttl"` // Upper bound for NXDOMAIN/NODATA answers (e.g. "5m")
+	Prefetch       bool   `json:"prefetch" mapstructure:"prefetch"`                 // Refresh popular entries shortly before they expire
+	ServeStale     bool   `json:"serve_stale" mapstructure:"serve_stale"`           // Answer from expired entries when every upstream is down
+	StaleTTL       string `json:"stale_ttl" mapstructure:"stale_ttl"`               // How long past expiry an entry may still be served
+}
+
+// ACLConfig decides how the DNS server treats clients by source address
+type ACLConfig struct {
+	Lists         []ACLList `json:"lists" mapstructure:"lists"`
+	DefaultAction string    `json:"default_action" mapstructure:"default_action"` // Action for clients no list matches (default "allow")
+}
+
+// ACLList applies one action to a set of networks. When lists overlap, the most specific network wins.
+type ACLList struct {
+	Name     string   `json:"name" mapstructure:"name"`
+	Networks []string `json:"networks" mapstructure:"networks"` // CIDRs or single IPs
+	Action   string   `json:"action" mapstructure:"action"`     // allow, refuse, drop or forward-only
+}
+
+// RateLimitConfig protects the listeners from abuse when Aegis is reachable from a network
+type RateLimitConfig struct {
+	Enabled            bool `json:"enabled" mapstructure:"enabled"`
+	ResponsesPerSecond int  `json:"responses_per_second" mapstructure:"responses_per_second"` // Identical UDP responses per client network per second (RRL)
+	Slip               int  `json:"slip" mapstructure:"slip"`                                 // Every Nth rate-limited response is sent truncated instead of dropped, 0 never
+	IPv4PrefixLength   int  `json:"ipv4_prefix_length" mapstructure:"ipv4_prefix_length"`     // Client network size for RRL (default 24)
+	IPv6PrefixLength   int  `json:"ipv6_prefix_length" mapstructure:"ipv6_prefix_length"`     // Client network size for RRL (default 56)
+	QueriesPerSecond   int  `json:"queries_per_second" mapstructure:"queries_per_second"`     // Query quota per client IP, 0 disables
+	Burst              int  `json:"burst" mapstructure:"burst"`                               // Queries a client may send at once above its quota
+}
+
+// ForwardZone sends queries for a domain pattern to its own upstream resolvers
+type ForwardZone struct {
+	Domain      string   `json:"domain" mapstructure:"domain"`       // Domain pattern, e.g. "**.corp.internal"
+	Upstreams   []string `json:"upstreams" mapstructure:"upstreams"` // Resolvers in the upstream_dns syntax
+	Strategy    string   `json:"strategy" mapstructure:"strategy"`   // failover (default), parallel or fastest
+	Description string   `json:"description" mapstructure:"description"`
+}
+
+// BlocklistConfig controls sinkholing of domains loaded from block list files
+type BlocklistConfig struct {
+	Sources        []BlockSource `json:"sources" mapstructure:"sources"`
+	Allowlist      []string      `json:"allowlist" mapstructure:"allowlist"`             // Domain patterns never blocked
+	ReloadInterval string        `json:"reload_interval" mapstructure:"reload_interval"` // How often changed files are reloaded (e.g. "5m", "0" to disable)
+}
+
+// BlockSource is a single block list file
+type BlockSource struct {
+	Name     string `json:"name" mapstructure:"name"`
+	Path     string `json:"path" mapstructure:"path"`
+	Format   string `json:"format" mapstructure:"format"`     // "hosts", "adblock" or "rpz"; empty detects from the file
+	Response string `json:"response" mapstructure:"response"` // "nxdomain" (default), "zero" (0.0.0.0 / ::) or "refused"
+	Enabled  bool   `json:"enabled" mapstructure:"enabled"`
+}
+
+// QueryLogConfig controls the JSONL log of every answered query
+type QueryLogConfig struct {
+	Enabled        bool   `json:"enabled" mapstructure:"enabled"`
+	Path           string `json:"path" mapstructure:"path"`                       // Log file (default "logs/queries.jsonl")
+	MaxSizeMB      int    `json:"max_size_mb" mapstructure:"max_size_mb"`         // Rotate once the file reaches this size, 0 disables
+	RotateInterval string `json:"rotate_interval" mapstructure:"rotate_interval"` // Rotate once the file is this old (e.g. "24h", "0" to disable)
+	MaxBackups     int    `json:"max_backups" mapstructure:"max_backups"`         // Rotated files to keep, 0 keeps all
+}
+
+// DoHConfig controls serving DNS-over-HTTPS from Aegis itself
+type DoHConfig struct {
+	Enabled     bool   `json:"enabled" mapstructure:"enabled"`
+	Path        string `json:"path" mapstructure:"path"`               // URL path (default "/dns-query")
+	Port        string `json:"port" mapstructure:"port"`               // Dedicated HTTPS port; empty shares the proxy listener
+	Certificate string `json:"certificate" mapstructure:"certificate"` // Certificate name for DoH clients (e.g. one issued for 127.0.0.1); empty uses the proxy certificate
+}
+
+// DoTConfig controls serving DNS-over-TLS from Aegis itself
+type DoTConfig struct {
+	Enabled     bool   `json:"enabled" mapstructure:"enabled"`
+	Port        string `json:"port" mapstructure:"port"`               // TLS port (default "853")
+	Certificate string `json:"certificate" mapstructure:"certificate"` // Certificate name; empty uses the proxy certificate
 }
 
 // ProxyConfig holds proxy server configuration
@@ -23,6 +162,12 @@ type ProxyConfig struct {
 	Headers     map[string]string `json:"headers" mapstructure:"headers"` // Custom headers to inject into requests
 }
 
+// LANConfig serves DNS and the proxy to other devices on the local network
+type LANConfig struct {
+	Enabled   bool   `json:"enabled" mapstructure:"enabled"`
+	Interface string `json:"interface" mapstructure:"interface"` // Network interface to serve on (e.g. "en0"); empty picks one
+}
+
 // SimpleModeConfig holds simple mode configuration
 type SimpleModeConfig struct {
 	Enabled bool   `json:"enabled" mapstructure:"enabled"`
@@ -35,6 +180,7 @@ type AppConfig struct {
 	DNS        DNSConfig        `json:"dns" mapstructure:"dns"`
 	Proxy      ProxyConfig      `json:"proxy" mapstructure:"proxy"`
 	SimpleMode SimpleModeConfig `json:"simple_mode" mapstructure:"simple_mode"`
+	LAN        LANConfig        `json:"lan" mapstructure:"lan"`
 }
 
 // GetDefaultConfig returns a configuration with sensible defaults
@@ -50,9 +196,50 @@ func GetDefaultConfig() *AppConfig {
 					Enabled:     true,
 				},
 			},
-			UpstreamDNS:      "1.1.1.1:53",
-			Port:             "53",
-			AutoManageSystem: true,
+			UpstreamDNS:         []string{"1.1.1.1:53", "8.8.8.8:53"},
+			UpstreamStrategy:    "failover",
+			HealthCheckInterval: "30s",
+			Port:                "53",
+			AutoManageSystem:    true,
+			DoH: DoHConfig{
+				Enabled: false,
+				Path:    "/dns-query",
+			},
+			DoT: DoTConfig{
+				Enabled: false,
+				Port:    "853",
+			},
+			Cache: CacheConfig{
+				Enabled:        true,
+				MaxEntries:     10000,
+				MaxTTL:         "1h",
+				MaxNegativeTTL: "5m",
+				Prefetch:       true,
+				ServeStale:     true,
+				StaleTTL:       "24h",
+			},
+			RateLimit: RateLimitConfig{
+				Enabled:            false,
+				ResponsesPerSecond: 20,
+				Slip:               2,
+				IPv4PrefixLength:   24,
+				IPv6PrefixLength:   56,
+				QueriesPerSecond:   100,
+				Burst:              200,
+			},
+			ACL: ACLConfig{
+				DefaultAction: "allow",
+			},
+			Blocklists: BlocklistConfig{
+				ReloadInterval: "5m",
+			},
+			QueryLog: QueryLogConfig{
+				Enabled:        true,
+				Path:           "logs/queries.jsonl",
+				MaxSizeMB:      10,
+				RotateInterval: "24h",
+				MaxBackups:     7,
+			},
 		},
 		Proxy: ProxyConfig{
 			UpstreamURL: "http://localhost:8787",
@@ -65,5 +252,8 @@ func GetDefaultConfig() *AppConfig {
 			Enabled: true,
 			Domain:  "*.ol.epicgames.com",
 		},
+		LAN: LANConfig{
+			Enabled: false,
+		},
 	}
 }
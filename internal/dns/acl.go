@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"net"
+	"sort"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// ACL actions
+const (
+	ACLAllow       = "allow"        // answer normally
+	ACLRefuse      = "refuse"       // answer REFUSED
+	ACLDrop        = "drop"         // don't answer at all
+	ACLForwardOnly = "forward-only" // answer from upstream, ignoring redirects and block lists
+)
+
+// aclEntry is a single network of an ACL list
+type aclEntry struct {
+	network *net.IPNet
+	list    string
+	action  string
+}
+
+// ACL maps client addresses to actions by longest prefix match
+type ACL struct {
+	entries       []aclEntry // most specific first
+	defaultAction string
+}
+
+// NewACL builds an ACL from configuration. Invalid networks are logged and skipped.
+func NewACL(cfg config.ACLConfig) *ACL {
+	acl := &ACL{defaultAction: cfg.DefaultAction}
+	if acl.defaultAction == "" {
+		acl.defaultAction = ACLAllow
+	}
+
+	for _, list := range cfg.Lists {
+		for _, value := range list.Networks {
+			network, err := config.ParseNetwork(value)
+			if err != nil {
+				log.Warnf("Skipping ACL entry in %s: %v", list.Name, err)
+				continue
+			}
+			acl.entries = append(acl.entries, aclEntry{network: network, list: list.Name, action: list.Action})
+		}
+	}
+
+	sort.SliceStable(acl.entries, func(i, j int) bool {
+		oi, _ := acl.entries[i].network.Mask.Size()
+		oj, _ := acl.entries[j].network.Mask.Size()
+		return oi > oj
+	})
+	return acl
+}
+
+// actionFor returns the action for a client IP
+func (a *ACL) actionFor(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return a.defaultAction
+	}
+
+	for _, entry := range a.entries {
+		if entry.network.Contains(ip) {
+			return entry.action
+		}
+	}
+	return a.defaultAction
+}
+
+// applyACL checks the client against the ACL. It reports whether the query
+// was handled here, returning the REFUSED answer to send, or nil to drop it.
+// Refused and dropped queries go to the query log.
+func (s *Server) applyACL(qc *queryContext, r *dns.Msg) (*dns.Msg, bool) {
+	switch action := s.acl.actionFor(qc.client); action {
+	case ACLForwardOnly:
+		qc.acl = action
+		return nil, false
+
+	case ACLRefuse:
+		qc.acl = action
+		refused := new(dns.Msg)
+		refused.SetRcode(r, dns.RcodeRefused)
+		log.Debugf("Refused query from %s (ACL)", qc.client)
+		s.logQuery(qc, r, refused)
+		return refused, true
+
+	case ACLDrop:
+		qc.acl = action
+		log.Debugf("Dropped query from %s (ACL)", qc.client)
+		s.logQuery(qc, r, nil)
+		return nil, true
+	}
+	return nil, false
+}
+
+// serveDoHDenied answers a DoH request the ACL did not allow
+func serveDoHDenied(c *fiber.Ctx, refused *dns.Msg) error {
+	if refused == nil {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+
+	out, err := refused.Pack()
+	if err != nil {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	c.Set(fiber.HeaderContentType, dohContentType)
+	return c.Send(out)
+}
@@ -0,0 +1,429 @@
+package dns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// Block responses
+const (
+	BlockNXDomain = "nxdomain" // the name does not exist
+	BlockZero     = "zero"     // A 0.0.0.0 / AAAA ::
+	BlockRefused  = "refused"  // REFUSED
+	blockNoData   = "nodata"   // NOERROR without records, only from RPZ "CNAME *."
+)
+
+// blockTTL is the TTL of synthesized block answers
+const blockTTL = 60
+
+// blockSource is a configured block list file together with its counters
+type blockSource struct {
+	name     string
+	path     string
+	format   string
+	response string
+
+	modTime time.Time
+	domains int
+	blocked atomic.Uint64
+	err     string
+}
+
+// blockRule is what a blocked pattern maps to
+type blockRule struct {
+	source *blockSource
+	action string
+}
+
+// Blocklist sinkholes domains loaded from hosts files, adblock lists and RPZ
+// zones. Allowlist patterns, adblock "@@" exceptions and RPZ passthru entries
+// always win over block entries.
+type Blocklist struct {
+	sources []*blockSource
+
+	mu        sync.RWMutex
+	block     *Matcher[*blockRule]
+	allow     *Matcher[struct{}]
+	allowlist []string
+
+	blocked  atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBlocklist creates a blocklist from configuration and loads its sources
+func NewBlocklist(cfg config.BlocklistConfig) *Blocklist {
+	b := &Blocklist{
+		allowlist: cfg.Allowlist,
+		stop:      make(chan struct{}),
+	}
+
+	for _, source := range cfg.Sources {
+		if !source.Enabled {
+			continue
+		}
+		name := source.Name
+		if name == "" {
+			name = filepath.Base(source.Path)
+		}
+		response := source.Response
+		if response == "" {
+			response = BlockNXDomain
+		}
+		b.sources = append(b.sources, &blockSource{
+			name:     name,
+			path:     source.Path,
+			format:   source.Format,
+			response: response,
+		})
+	}
+
+	b.Load()
+	return b
+}
+
+// Load (re)reads every source and replaces the active lists
+func (b *Blocklist) Load() {
+	block := NewMatcher[*blockRule]()
+	allow := NewMatcher[struct{}]()
+
+	for _, pattern := range b.allowlist {
+		if err := allow.Insert(pattern, struct{}{}); err != nil {
+			log.Warnf("Skipping allowlist entry %s: %v", pattern, err)
+		}
+	}
+
+	type loaded struct {
+		modTime time.Time
+		domains int
+		err     string
+	}
+	results := make([]loaded, len(b.sources))
+
+	for i, source := range b.sources {
+		before := block.Len()
+		modTime, err := source.load(block, allow)
+		if err != nil {
+			results[i].err = err.Error()
+			log.Warnf("Failed to load blocklist %s: %v", source.name, err)
+			continue
+		}
+		results[i] = loaded{modTime: modTime, domains: block.Len() - before}
+		log.Debugf("Loaded %d domains from blocklist %s", results[i].domains, source.name)
+	}
+
+	b.mu.Lock()
+	b.block = block
+	b.allow = allow
+	for i, source := range b.sources {
+		source.modTime = results[i].modTime
+		source.domains = results[i].domains
+		source.err = results[i].err
+	}
+	b.mu.Unlock()
+
+	if len(b.sources) > 0 {
+		log.Infof("Blocklists loaded: %d domains from %d sources", block.Len(), len(b.sources))
+	}
+}
+
+// load parses the source file into the matchers and returns the file's
+// modification time
+func (s *blockSource) load(block *Matcher[*blockRule], allow *Matcher[struct{}]) (time.Time, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	format := s.format
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(s.path)) {
+		case ".rpz", ".zone":
+			format = "rpz"
+		default:
+			// hosts and adblock lines are told apart line by line
+			format = "hosts"
+		}
+	}
+
+	if format == "rpz" {
+		err = s.loadRPZ(file, block, allow)
+	} else {
+		err = s.loadList(file, block, allow)
+	}
+	return info.ModTime(), err
+}
+
+// loadList parses hosts files ("0.0.0.0 ads.example.com"), adblock lists
+// ("||ads.example.com^", "@@||ok.example.com^") and plain domain lists
+func (s *blockSource) loadList(r io.Reader, block *Matcher[*blockRule], allow *Matcher[struct{}]) error {
+	rule := &blockRule{source: s, action: s.response}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			exception := strings.HasPrefix(line, "@@")
+			domain, ok := parseAdblockRule(strings.TrimPrefix(line, "@@"))
+			if !ok {
+				continue
+			}
+			// "||example.com^" covers the domain and everything below it
+			if exception {
+				allow.Insert("**."+domain, struct{}{})
+			} else {
+				block.Insert("**."+domain, rule)
+			}
+			continue
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) != 1 {
+			continue
+		}
+
+		for _, domain := range fields {
+			if isListableDomain(domain) {
+				block.Insert(domain, rule)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAdblockRule extracts the domain of a "||domain^" rule. Rules with paths
+// or modifiers only apply to some requests and are skipped.
+func parseAdblockRule(line string) (string, bool) {
+	line = strings.TrimPrefix(line, "||")
+	end := strings.IndexAny(line, "^/$|")
+	if end < 0 {
+		end = len(line)
+	} else if line[end] != '^' || (end+1 < len(line) && line[end+1:] != "|") {
+		return "", false
+	}
+
+	domain := line[:end]
+	return domain, isListableDomain(domain)
+}
+
+// isListableDomain reports whether a list entry is a domain we can block.
+// Host entries for the local machine are never blocked.
+func isListableDomain(domain string) bool {
+	switch strings.ToLower(domain) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return false
+	}
+	if net.ParseIP(domain) != nil {
+		return false
+	}
+	_, ok := dns.IsDomainName(domain)
+	return ok && strings.Contains(domain, ".")
+}
+
+// loadRPZ parses a response policy zone. Triggers are QNAME only; the
+// policy actions NXDOMAIN (CNAME .), NODATA (CNAME *.) and PASSTHRU are
+// honored, DROP is answered with REFUSED, and any local data gets the
+// source's configured response.
+func (s *blockSource) loadRPZ(r io.Reader, block *Matcher[*blockRule], allow *Matcher[struct{}]) error {
+	rules := map[string]*blockRule{}
+	ruleFor := func(action string) *blockRule {
+		if rules[action] == nil {
+			rules[action] = &blockRule{source: s, action: action}
+		}
+		return rules[action]
+	}
+
+	parser := dns.NewZoneParser(r, ".", s.path)
+	parser.SetIncludeAllowed(false)
+
+	var origin string
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(rr.Header().Name)
+
+		// Owner names are relative to the zone apex, e.g. "ads.example.com.rpz.local."
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if name != "." {
+				origin = name
+			}
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		if origin != "" {
+			if name == origin || !strings.HasSuffix(name, "."+origin) {
+				continue
+			}
+			name = strings.TrimSuffix(name, "."+origin)
+		}
+		name = strings.TrimSuffix(name, ".")
+
+		// Skip IP, NSDNAME, NSIP and client IP triggers
+		if strings.Contains(name, ".rpz-") {
+			continue
+		}
+
+		// "*.example.com" triggers keep their wildcard meaning
+		pattern := name
+		if !isListableDomain(strings.TrimPrefix(name, "*.")) {
+			continue
+		}
+
+		action := s.response
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				action = BlockNXDomain
+			case "*.":
+				action = blockNoData
+			case "rpz-passthru.":
+				allow.Insert(pattern, struct{}{})
+				continue
+			case "rpz-drop.":
+				action = BlockRefused
+			}
+		}
+		block.Insert(pattern, ruleFor(action))
+	}
+	return parser.Err()
+}
+
+// Check returns the block rule for name, if it is blocked and not allowed
+func (b *Blocklist) Check(name string) (*blockRule, string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	result, blocked := b.block.Match(name)
+	if !blocked {
+		return nil, "", false
+	}
+	if _, allowed := b.allow.Match(name); allowed {
+		return nil, "", false
+	}
+	return result.Value, result.Pattern, true
+}
+
+// answerBlocked fills m with the block response for q and counts the hit
+func (b *Blocklist) answerBlocked(m *dns.Msg, q dns.Question, rule *blockRule, pattern string) {
+	b.blocked.Add(1)
+	rule.source.blocked.Add(1)
+	log.Debugf("Blocked %s %s (%s)", q.Name, dns.TypeToString[q.Qtype], rule.source.name)
+
+	soa := synthesizedSOA(patternZone(pattern), blockTTL)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+
+	switch {
+	case rule.action == BlockRefused:
+		m.Rcode = dns.RcodeRefused
+	case rule.action == BlockZero && q.Qtype == dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case rule.action == BlockZero && q.Qtype == dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	case rule.action == BlockNXDomain:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soa)
+	default:
+		m.Ns = append(m.Ns, soa)
+	}
+}
+
+// StartReloading reloads the sources whenever one of their files changes,
+// checking every interval until Stop is called
+func (b *Blocklist) StartReloading(interval time.Duration) {
+	if interval <= 0 || len(b.sources) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				if b.changed() {
+					b.Load()
+				}
+			}
+		}
+	}()
+}
+
+// changed reports whether any source file was modified since it was loaded
+func (b *Blocklist) changed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, source := range b.sources {
+		info, err := os.Stat(source.path)
+		if err != nil {
+			if source.err == "" {
+				return true
+			}
+			continue
+		}
+		if !info.ModTime().Equal(source.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop ends background reloading
+func (b *Blocklist) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+}
+
+// Stats returns the blocked query counters and per-source details
+func (b *Blocklist) Stats() map[string]interface{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	sources := make([]map[string]interface{}, 0, len(b.sources))
+	for _, source := range b.sources {
+		sources = append(sources, map[string]interface{}{
+			"name":     source.name,
+			"path":     source.path,
+			"response": source.response,
+			"domains":  source.domains,
+			"blocked":  source.blocked.Load(),
+			"error":    source.err,
+		})
+	}
+
+	return map[string]interface{}{
+		"domains": b.block.Len(),
+		"blocked": b.blocked.Load(),
+		"sources": sources,
+	}
+}
@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// writeList writes a block list file into a test directory
+func writeList(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkBlocked asserts which names a blocklist blocks, and with what action
+func checkBlocked(t *testing.T, b *Blocklist, want map[string]string) {
+	t.Helper()
+	for name, action := range want {
+		rule, _, blocked := b.Check(name)
+		switch {
+		case action == "" && blocked:
+			t.Errorf("%s is blocked (%s), want allowed", name, rule.action)
+		case action != "" && !blocked:
+			t.Errorf("%s is allowed, want blocked with %s", name, action)
+		case action != "" && rule.action != action:
+			t.Errorf("%s is blocked with %s, want %s", name, rule.action, action)
+		}
+	}
+}
+
+func TestBlocklistFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		response string
+		domains  int
+		want     map[string]string
+	}{
+		{
+			name: "hosts",
+			file: "hosts",
+			content: `# comment
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+0.0.0.0 0.0.0.0
+192.0.2.1
+`,
+			domains: 2,
+			want: map[string]string{
+				"ads.example.com.":     BlockNXDomain,
+				"tracker.example.com.": BlockNXDomain,
+				"sub.ads.example.com.": "",
+				"localhost.":           "",
+				"example.com.":         "",
+			},
+		},
+		{
+			name: "adblock",
+			file: "filters.txt",
+			content: `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||cdn.example.com^$third-party
+||example.net/banner.js
+||metrics.example.org^|
+@@||ok.ads.example.com^
+`,
+			domains: 2,
+			want: map[string]string{
+				"ads.example.com.":         BlockNXDomain,
+				"deep.ads.example.com.":    BlockNXDomain,
+				"ok.ads.example.com.":      "",
+				"x.ok.ads.example.com.":    "",
+				"cdn.example.com.":         "",
+				"example.net.":             "",
+				"metrics.example.org.":     BlockNXDomain,
+				"a.b.metrics.example.org.": BlockNXDomain,
+			},
+		},
+		{
+			name: "domain list",
+			file: "domains.txt",
+			content: `ads.example.com
+# comment
+not a domain
+nodots
+tracker.example.com
+`,
+			domains: 2,
+			want: map[string]string{
+				"ads.example.com.":     BlockNXDomain,
+				"tracker.example.com.": BlockNXDomain,
+				"nodots.":              "",
+				"sub.ads.example.com.": "",
+			},
+		},
+		{
+			name: "rpz",
+			file: "policy.rpz",
+			content: `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+@ NS localhost.
+nx.example.com CNAME .
+*.nodata.example.com CNAME *.
+drop.example.com CNAME rpz-drop.
+ok.nx.example.com CNAME rpz-passthru.
+local.example.com A 192.0.2.1
+32.1.2.0.192.rpz-ip CNAME .
+`,
+			response: BlockZero,
+			domains:  4,
+			want: map[string]string{
+				"nx.example.com.":       BlockNXDomain,
+				"ok.nx.example.com.":    "",
+				"a.nodata.example.com.": blockNoData,
+				"nodata.example.com.":   "",
+				"drop.example.com.":     BlockRefused,
+				"local.example.com.":    BlockZero,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlocklist(config.BlocklistConfig{Sources: []config.BlockSource{{
+				Path:     writeList(t, tt.file, tt.content),
+				Response: tt.response,
+				Enabled:  true,
+			}}})
+
+			source := b.Stats()["sources"].([]map[string]interface{})[0]
+			if source["error"] != "" {
+				t.Fatalf("load error: %v", source["error"])
+			}
+			if source["domains"] != tt.domains {
+				t.Errorf("loaded %v domains, want %d", source["domains"], tt.domains)
+			}
+			checkBlocked(t, b, tt.want)
+		})
+	}
+}
+
+func TestBlocklistAllowlist(t *testing.T) {
+	b := NewBlocklist(config.BlocklistConfig{
+		Sources: []config.BlockSource{
+			{Path: writeList(t, "hosts", "0.0.0.0 ads.example.com cdn.example.com\n"), Response: BlockZero, Enabled: true},
+			{Path: writeList(t, "filters.txt", "||example.net^\n"), Enabled: true},
+			{Path: writeList(t, "disabled.txt", "disabled.example.org\n")},
+		},
+		Allowlist: []string{"cdn.example.com", "*.example.net"},
+	})
+
+	checkBlocked(t, b, map[string]string{
+		"ads.example.com.":      BlockZero,
+		"cdn.example.com.":      "",
+		"example.net.":          BlockNXDomain,
+		"www.example.net.":      "",
+		"disabled.example.org.": "",
+	})
+}
+
+func TestBlocklistMissingFile(t *testing.T) {
+	b := NewBlocklist(config.BlocklistConfig{Sources: []config.BlockSource{
+		{Name: "gone", Path: filepath.Join(t.TempDir(), "missing.txt"), Enabled: true},
+	}})
+
+	source := b.Stats()["sources"].([]map[string]interface{})[0]
+	if source["name"] != "gone" || source["error"] == "" {
+		t.Errorf("missing file reported as %v", source)
+	}
+	if _, _, blocked := b.Check("example.com."); blocked {
+		t.Error("empty blocklist blocked a name")
+	}
+}
@@ -0,0 +1,312 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+const (
+	// staleAnswerTTL is the TTL given to expired answers served while upstreams are down (RFC 8767)
+	staleAnswerTTL = 30
+	// prefetchMinHits is how often an entry must be used before it is refreshed ahead of expiry
+	prefetchMinHits = 2
+	// prefetchThreshold refreshes an entry once less than this fraction of its TTL remains
+	prefetchThreshold = 0.1
+)
+
+// cacheKey identifies a cached response
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool // DNSSEC OK responses carry signatures and are cached separately
+	cd     bool // checking disabled responses skipped validation
+}
+
+// cacheEntry is a cached upstream response
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	ttl         time.Duration
+	hits        uint64
+	prefetching bool
+}
+
+// Cache is a TTL-aware LRU cache for forwarded responses, including negative
+// answers as described in RFC 2308
+type Cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	maxEntries  int
+	maxTTL      time.Duration
+	maxNegative time.Duration
+	prefetch    bool
+	serveStale  bool
+	staleWindow time.Duration
+
+	hits, misses, evictions, prefetches, staleServed uint64
+}
+
+// NewCache creates a cache from configuration
+func NewCache(cfg config.CacheConfig) *Cache {
+	maxTTL, _ := config.ParseDuration(cfg.MaxTTL)
+	maxNegative, _ := config.ParseDuration(cfg.MaxNegativeTTL)
+	staleWindow, _ := config.ParseDuration(cfg.StaleTTL)
+
+	return &Cache{
+		entries:     make(map[cacheKey]*list.Element),
+		lru:         list.New(),
+		maxEntries:  cfg.MaxEntries,
+		maxTTL:      maxTTL,
+		maxNegative: maxNegative,
+		prefetch:    cfg.Prefetch,
+		serveStale:  cfg.ServeStale,
+		staleWindow: staleWindow,
+	}
+}
+
+// keyFor builds the cache key for a query, reporting false for queries we don't cache
+func keyFor(r *dns.Msg) (cacheKey, bool) {
+	if len(r.Question) != 1 {
+		return cacheKey{}, false
+	}
+
+	q := r.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if opt := r.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	key.cd = r.CheckingDisabled
+	return key, true
+}
+
+// Get returns a fresh cached response for r with TTLs counted down. prefetch
+// reports whether the caller should refresh the entry in the background.
+func (c *Cache) Get(r *dns.Msg) (resp *dns.Msg, prefetch bool, ok bool) {
+	key, cacheable := keyFor(r)
+	if !cacheable {
+		return nil, false, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		c.misses++
+		return nil, false, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires) {
+		if !c.serveStale || now.After(entry.expires.Add(c.staleWindow)) {
+			c.remove(elem)
+		}
+		c.misses++
+		return nil, false, false
+	}
+
+	c.hits++
+	entry.hits++
+	c.lru.MoveToFront(elem)
+
+	remaining := entry.expires.Sub(now)
+	if c.prefetch && !entry.prefetching && entry.hits >= prefetchMinHits &&
+		float64(remaining) < float64(entry.ttl)*prefetchThreshold {
+		entry.prefetching = true
+		prefetch = true
+		c.prefetches++
+	}
+
+	return entry.answer(r, uint32(remaining/time.Second)), prefetch, true
+}
+
+// GetStale returns an expired response that is still within the stale window.
+// It is only used when every upstream has failed.
+func (c *Cache) GetStale(r *dns.Msg) (*dns.Msg, bool) {
+	if !c.serveStale {
+		return nil, false
+	}
+
+	key, cacheable := keyFor(r)
+	if !cacheable {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(c.staleWindow)) {
+		c.remove(elem)
+		return nil, false
+	}
+
+	c.staleServed++
+	return entry.answer(r, staleAnswerTTL), true
+}
+
+// Set stores a response for r if it is cacheable
+func (c *Cache) Set(r *dns.Msg, resp *dns.Msg) {
+	key, cacheable := keyFor(r)
+	if !cacheable || resp == nil || resp.Truncated {
+		return
+	}
+
+	ttl, ok := c.responseTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+		ttl:     ttl,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// responseTTL determines how long a response may be cached
+func (c *Cache) responseTTL(resp *dns.Msg) (time.Duration, bool) {
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl := time.Duration(minRRTTL(resp.Answer, resp.Ns)) * time.Second
+		if c.maxTTL > 0 && ttl > c.maxTTL {
+			ttl = c.maxTTL
+		}
+		return ttl, true
+
+	case resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess:
+		// Negative answers are cached for the SOA's negative TTL (RFC 2308 section 5),
+		// and not at all without an SOA
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				negative := time.Duration(ttl) * time.Second
+				if c.maxNegative > 0 && negative > c.maxNegative {
+					negative = c.maxNegative
+				}
+				return negative, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// minRRTTL returns the smallest TTL among the given records, ignoring OPT
+func minRRTTL(sections ...[]dns.RR) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range sections {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// answer copies the cached response for a new query, capping every TTL at ttl
+func (e *cacheEntry) answer(r *dns.Msg, ttl uint32) *dns.Msg {
+	resp := e.msg.Copy()
+	resp.Id = r.Id
+	resp.Question = r.Question
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+	return resp
+}
+
+// remove deletes an element from the cache; the caller holds c.mu
+func (c *Cache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.lru.Remove(elem)
+}
+
+// prefetchDone clears the in-flight flag after a background refresh
+func (c *Cache) prefetchDone(r *dns.Msg) {
+	key, cacheable := keyFor(r)
+	if !cacheable {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// Stats returns cache counters
+func (c *Cache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hitRate := 0.0
+	if total := c.hits + c.misses; total > 0 {
+		hitRate = float64(c.hits) / float64(total) * 100
+	}
+
+	return map[string]interface{}{
+		"entries":      c.lru.Len(),
+		"max_entries":  c.maxEntries,
+		"hits":         c.hits,
+		"misses":       c.misses,
+		"hit_rate":     hitRate,
+		"evictions":    c.evictions,
+		"prefetches":   c.prefetches,
+		"stale_served": c.staleServed,
+	}
+}
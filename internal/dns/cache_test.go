@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// cacheQuery builds a query for name, optionally with the DO and CD bits
+func cacheQuery(name string, do, cd bool) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	if do {
+		r.SetEdns0(1232, true)
+	}
+	r.CheckingDisabled = cd
+	return r
+}
+
+// positiveAnswer answers r with an A record of the given TTL
+func positiveAnswer(r *dns.Msg, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	return m
+}
+
+// negativeAnswer answers r with rcode and an SOA of the given TTL and minimum
+func negativeAnswer(r *dns.Msg, rcode int, ttl, minttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: minttl,
+	})
+	return m
+}
+
+// age moves the cache entry for r d into the past
+func age(c *Cache, r *dns.Msg, d time.Duration) {
+	key, _ := keyFor(r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-d)
+	entry.expires = entry.expires.Add(-d)
+}
+
+func TestCacheTTLDecay(t *testing.T) {
+	c := NewCache(config.CacheConfig{MaxTTL: "1h"})
+	r := cacheQuery("decay.example.", false, false)
+	c.Set(r, positiveAnswer(r, 300))
+
+	age(c, r, 100*time.Second)
+	resp, _, ok := c.Get(r)
+	if !ok {
+		t.Fatal("entry not cached")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl < 199 || ttl > 200 {
+		t.Errorf("TTL after 100s = %d, want 200", ttl)
+	}
+
+	age(c, r, 201*time.Second)
+	if _, _, ok := c.Get(r); ok {
+		t.Error("expired entry was served")
+	}
+}
+
+func TestCacheMaxTTL(t *testing.T) {
+	c := NewCache(config.CacheConfig{MaxTTL: "1m"})
+	r := cacheQuery("long.example.", false, false)
+	c.Set(r, positiveAnswer(r, 86400))
+
+	resp, _, ok := c.Get(r)
+	if !ok {
+		t.Fatal("entry not cached")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl > 60 {
+		t.Errorf("TTL = %d, want at most 60", ttl)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       int
+		ttl, minttl uint32
+		maxNegative string
+		want        time.Duration
+		cached      bool
+	}{
+		{"NXDOMAIN uses SOA minimum", dns.RcodeNameError, 3600, 900, "", 900 * time.Second, true},
+		{"NODATA uses SOA TTL when lower", dns.RcodeSuccess, 60, 900, "", 60 * time.Second, true},
+		{"capped at max_negative_ttl", dns.RcodeNameError, 3600, 3600, "5m", 5 * time.Minute, true},
+		{"SERVFAIL is not cached", dns.RcodeServerFailure, 3600, 900, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(config.CacheConfig{MaxNegativeTTL: tt.maxNegative})
+			r := cacheQuery("missing.example.", false, false)
+			ttl, ok := c.responseTTL(negativeAnswer(r, tt.rcode, tt.ttl, tt.minttl))
+			if ok != tt.cached || ttl != tt.want {
+				t.Errorf("responseTTL = %v, %v; want %v, %v", ttl, ok, tt.want, tt.cached)
+			}
+		})
+	}
+
+	// Negative answers without an SOA can't be cached (RFC 2308 section 5)
+	c := NewCache(config.CacheConfig{})
+	r := cacheQuery("nosoa.example.", false, false)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	c.Set(r, m)
+	if _, _, ok := c.Get(r); ok {
+		t.Error("NXDOMAIN without SOA was cached")
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	c := NewCache(config.CacheConfig{MaxEntries: 2})
+	a := cacheQuery("a.example.", false, false)
+	b := cacheQuery("b.example.", false, false)
+	d := cacheQuery("d.example.", false, false)
+
+	c.Set(a, positiveAnswer(a, 300))
+	c.Set(b, positiveAnswer(b, 300))
+	c.Get(a) // a is now the most recently used
+	c.Set(d, positiveAnswer(d, 300))
+
+	if _, _, ok := c.Get(b); ok {
+		t.Error("least recently used entry b was not evicted")
+	}
+	for _, r := range []*dns.Msg{a, d} {
+		if _, _, ok := c.Get(r); !ok {
+			t.Errorf("%s was evicted", r.Question[0].Name)
+		}
+	}
+	if evictions := c.Stats()["evictions"].(uint64); evictions != 1 {
+		t.Errorf("evictions = %d, want 1", evictions)
+	}
+}
+
+func TestCacheKeyBits(t *testing.T) {
+	c := NewCache(config.CacheConfig{})
+	plain := cacheQuery("bits.example.", false, false)
+	c.Set(plain, positiveAnswer(plain, 300))
+
+	for _, r := range []*dns.Msg{
+		cacheQuery("bits.example.", true, false),
+		cacheQuery("bits.example.", false, true),
+	} {
+		if _, _, ok := c.Get(r); ok {
+			t.Errorf("DO=%v CD=%v query was answered from the plain entry", r.IsEdns0() != nil, r.CheckingDisabled)
+		}
+	}
+
+	// Names are matched case-insensitively, and the answer echoes the query
+	upper := cacheQuery("BITS.Example.", false, false)
+	resp, _, ok := c.Get(upper)
+	if !ok {
+		t.Fatal("mixed-case query missed the cache")
+	}
+	if resp.Id != upper.Id || resp.Question[0].Name != "BITS.Example." {
+		t.Errorf("answer has ID %d and question %s, want the query's", resp.Id, resp.Question[0].Name)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := NewCache(config.CacheConfig{Prefetch: true})
+	r := cacheQuery("popular.example.", false, false)
+	c.Set(r, positiveAnswer(r, 100))
+
+	if _, prefetch, _ := c.Get(r); prefetch {
+		t.Error("prefetch requested with most of the TTL left")
+	}
+
+	age(c, r, 95*time.Second)
+	if _, prefetch, _ := c.Get(r); !prefetch {
+		t.Error("no prefetch for a popular entry near expiry")
+	}
+	if _, prefetch, _ := c.Get(r); prefetch {
+		t.Error("second prefetch while the first is in flight")
+	}
+
+	c.prefetchDone(r)
+	if _, prefetch, _ := c.Get(r); !prefetch {
+		t.Error("no prefetch after the previous one finished")
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	r := cacheQuery("stale.example.", false, false)
+
+	c := NewCache(config.CacheConfig{ServeStale: true, StaleTTL: "1h"})
+	c.Set(r, positiveAnswer(r, 60))
+	age(c, r, 10*time.Minute)
+
+	if _, _, ok := c.Get(r); ok {
+		t.Error("Get served an expired entry")
+	}
+	resp, ok := c.GetStale(r)
+	if !ok {
+		t.Fatal("expired entry inside the stale window was not served")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("stale TTL = %d, want %d", ttl, staleAnswerTTL)
+	}
+
+	age(c, r, 2*time.Hour)
+	if _, ok := c.GetStale(r); ok {
+		t.Error("entry past the stale window was served")
+	}
+
+	disabled := NewCache(config.CacheConfig{})
+	disabled.Set(r, positiveAnswer(r, 60))
+	age(disabled, r, time.Minute)
+	if _, ok := disabled.GetStale(r); ok {
+		t.Error("stale entry served with serve_stale off")
+	}
+}
@@ -0,0 +1,898 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+const (
+	// dnssecMaxCacheTTL bounds how long validated DS and DNSKEY sets are cached
+	dnssecMaxCacheTTL = time.Hour
+	// dnssecFailureTTL is how long a failed chain lookup is remembered
+	dnssecFailureTTL = 30 * time.Second
+	// dnssecMaxCacheEntries triggers a sweep of expired chain entries
+	dnssecMaxCacheEntries = 10000
+)
+
+// rootAnchors are the DS records of the root zone's key signing keys
+// KSK-2017 and KSK-2024, as published by IANA
+var rootAnchors = []string{
+	". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 86400 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// securityStatus is the DNSSEC outcome for a response or RRset (RFC 4035 section 4.3)
+type securityStatus int
+
+const (
+	statusSecure securityStatus = iota
+	statusInsecure
+	statusBogus
+)
+
+// String returns the status as written to the query log
+func (st securityStatus) String() string {
+	switch st {
+	case statusSecure:
+		return "secure"
+	case statusInsecure:
+		return "insecure"
+	default:
+		return "bogus"
+	}
+}
+
+// delegation is what a DS lookup proved about a name
+type delegation struct {
+	status  securityStatus
+	ds      []*dns.DS // secure zone cut when not empty
+	err     error     // why the name is bogus
+	expires time.Time
+}
+
+// zoneKeys are the validated DNSKEYs of a zone
+type zoneKeys struct {
+	status  securityStatus
+	keys    []*dns.DNSKEY
+	err     error
+	expires time.Time
+}
+
+// Validator checks forwarded answers against the DNSSEC chain of trust from
+// the root. It acts as a validating stub: DS and DNSKEY records are fetched
+// through the same upstreams as the answers and cached.
+type Validator struct {
+	poolFor func(name string) *UpstreamPool
+	anchors []*dns.DS
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+	keys        map[string]*zoneKeys
+
+	secure, insecure, bogus atomic.Uint64
+}
+
+// NewValidator creates a validator from configuration. Configured trust
+// anchors replace the built-in root anchors.
+func NewValidator(cfg config.DNSSECConfig, poolFor func(name string) *UpstreamPool) (*Validator, error) {
+	anchors := cfg.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootAnchors
+	}
+
+	v := &Validator{
+		poolFor:     poolFor,
+		delegations: make(map[string]*delegation),
+		keys:        make(map[string]*zoneKeys),
+	}
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %v", anchor, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.Hdr.Name != "." {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record for the root", anchor)
+		}
+		v.anchors = append(v.anchors, ds)
+	}
+	return v, nil
+}
+
+// validatingQuery returns the query sent upstream for a validated lookup:
+// the client's query with the DO bit set, so signatures come back
+func validatingQuery(r *dns.Msg) *dns.Msg {
+	query := r.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(ednsUDPSize, true)
+	}
+	return query
+}
+
+// Validate checks resp to query. Secure answers get the AD bit; bogus ones
+// are replaced by SERVFAIL. Only NOERROR and NXDOMAIN answers are checked.
+func (v *Validator) Validate(query, resp *dns.Msg) (*dns.Msg, securityStatus) {
+	if len(query.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return resp, statusInsecure
+	}
+
+	q := query.Question[0]
+	status, err := v.verifyResponse(q, resp)
+	switch status {
+	case statusSecure:
+		v.secure.Add(1)
+		resp.AuthenticatedData = true
+	case statusInsecure:
+		v.insecure.Add(1)
+		resp.AuthenticatedData = false
+	default:
+		v.bogus.Add(1)
+		log.Warnf("DNSSEC validation failed for %s %s: %v", q.Name, dns.TypeToString[q.Qtype], err)
+		failed := new(dns.Msg)
+		failed.SetRcode(query, dns.RcodeServerFailure)
+		return failed, status
+	}
+	return resp, status
+}
+
+// verifyResponse validates every RRset of the answer section and, for
+// negative answers, the denial of existence in the authority section
+func (v *Validator) verifyResponse(q dns.Question, resp *dns.Msg) (securityStatus, error) {
+	status := statusSecure
+	merge := func(st securityStatus) {
+		if st > status {
+			status = st
+		}
+	}
+
+	answers, answerSigs := groupRRsets(resp.Answer)
+	name := q.Name
+	answered := false
+	for _, rrset := range answers {
+		hdr := rrset[0].Header()
+
+		// CNAMEs synthesized from a DNAME are never signed
+		if hdr.Rrtype == dns.TypeCNAME && len(answerSigs[rrsetKey(hdr)]) == 0 && coveredByDNAME(hdr.Name, answers) {
+			continue
+		}
+
+		st, err := v.verifyRRset(rrset, answerSigs[rrsetKey(hdr)])
+		if st == statusBogus {
+			return st, err
+		}
+		merge(st)
+
+		switch {
+		case hdr.Rrtype == dns.TypeCNAME && strings.EqualFold(hdr.Name, name) && q.Qtype != dns.TypeCNAME:
+			name = rrset[0].(*dns.CNAME).Target
+		case strings.EqualFold(hdr.Name, name) && (hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY):
+			answered = true
+		}
+	}
+
+	// Answers expanded from a wildcard must come with proof that the name itself doesn't exist
+	if answered {
+		if st, err := v.verifyWildcard(answerSigs, resp.Ns); st != statusSecure {
+			merge(st)
+			if st == statusBogus {
+				return st, err
+			}
+		}
+		return status, nil
+	}
+
+	st, err := v.verifyDenial(name, q.Qtype, resp.Rcode, resp.Ns)
+	merge(st)
+	return status, err
+}
+
+// verifyRRset validates a single RRset against its signatures. Unsigned
+// RRsets are only acceptable when the owner is provably in an insecure zone.
+func (v *Validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) (securityStatus, error) {
+	owner := rrset[0].Header().Name
+
+	if len(sigs) == 0 {
+		if v.lookupDelegation(owner).status == statusInsecure {
+			return statusInsecure, nil
+		}
+		return statusBogus, fmt.Errorf("%s %s is not signed", owner, dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+
+	err := fmt.Errorf("no valid signature for %s %s", owner, dns.TypeToString[rrset[0].Header().Rrtype])
+	for _, sig := range sigs {
+		signer := dns.Fqdn(strings.ToLower(sig.SignerName))
+		if !dns.IsSubDomain(signer, strings.ToLower(owner)) {
+			continue
+		}
+		// A DS set is signed by the parent, never by the zone it points to
+		if rrset[0].Header().Rrtype == dns.TypeDS && strings.EqualFold(signer, owner) {
+			continue
+		}
+
+		keys := v.lookupKeys(signer)
+		switch keys.status {
+		case statusInsecure:
+			return statusInsecure, nil
+		case statusBogus:
+			err = keys.err
+			continue
+		}
+		if verifyErr := verifySignature(sig, keys.keys, rrset); verifyErr != nil {
+			err = verifyErr
+			continue
+		}
+		return statusSecure, nil
+	}
+	return statusBogus, err
+}
+
+// verifySignature checks sig over rrset with the matching key of keys
+func verifySignature(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("signature of %s by %s has expired or is not yet valid", sig.Hdr.Name, sig.SignerName)
+	}
+
+	err := fmt.Errorf("no DNSKEY %d of %s matches the signature of %s", sig.KeyTag, sig.SignerName, sig.Hdr.Name)
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+			continue
+		}
+		if err = sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyWildcard checks that answers synthesized from a wildcard come with a
+// signed NSEC or NSEC3 record showing the query name doesn't exist itself
+// (RFC 4035 section 5.3.4, RFC 5155 section 8.8)
+func (v *Validator) verifyWildcard(answerSigs map[string][]*dns.RRSIG, ns []dns.RR) (securityStatus, error) {
+	var expanded, nextCloser string
+	for _, sigs := range answerSigs {
+		for _, sig := range sigs {
+			labels := dns.SplitDomainName(sig.Hdr.Name)
+			if int(sig.Labels) >= len(labels) || labels[0] == "*" {
+				continue
+			}
+			expanded = sig.Hdr.Name
+			nextCloser = dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+		}
+	}
+	if expanded == "" {
+		return statusSecure, nil
+	}
+
+	status, nsec, nsec3, err := v.verifyAuthority(ns)
+	if status != statusSecure {
+		return status, err
+	}
+	if nsecCovers(nsec, expanded) || nsec3HashCovered(nsec3, nextCloser) {
+		return statusSecure, nil
+	}
+	return statusBogus, fmt.Errorf("wildcard answer for %s comes without proof that the name doesn't exist", expanded)
+}
+
+// verifyDenial validates a NODATA or NXDOMAIN answer for name
+func (v *Validator) verifyDenial(name string, qtype uint16, rcode int, ns []dns.RR) (securityStatus, error) {
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok && !dns.IsSubDomain(strings.ToLower(soa.Hdr.Name), strings.ToLower(name)) {
+			return statusBogus, fmt.Errorf("SOA %s in the answer for %s is not an ancestor", soa.Hdr.Name, name)
+		}
+	}
+
+	status, nsec, nsec3, err := v.verifyAuthority(ns)
+	if status != statusSecure {
+		return status, err
+	}
+
+	// An unsigned negative answer is fine from an insecure zone
+	if len(nsec) == 0 && len(nsec3) == 0 {
+		if v.lookupDelegation(name).status == statusInsecure {
+			return statusInsecure, nil
+		}
+		return statusBogus, fmt.Errorf("negative answer for %s has no NSEC or NSEC3 proof", name)
+	}
+
+	if rcode == dns.RcodeNameError {
+		// Both name and the wildcard at its closest encloser must be proven
+		// not to exist (RFC 4035 section 5.4, RFC 5155 section 8.4)
+		if encloser, ok := nsecClosestEncloser(nsec, name); ok && nsecCovers(nsec, wildcardAt(encloser)) {
+			return statusSecure, nil
+		}
+		if encloser, _, ok := nsec3ClosestEncloser(nsec3, name); ok && nsec3HashCovered(nsec3, wildcardAt(encloser)) {
+			return statusSecure, nil
+		}
+		return statusBogus, fmt.Errorf("NXDOMAIN for %s is not proven", name)
+	}
+
+	// NODATA: the record at name must exist and not list the type
+	if types, found := typesAt(nsec, nsec3, name); found {
+		if hasType(types, qtype) || hasType(types, dns.TypeCNAME) {
+			return statusBogus, fmt.Errorf("NODATA for %s %s contradicts its NSEC record", name, dns.TypeToString[qtype])
+		}
+		return statusSecure, nil
+	}
+	if nsecEmptyNonTerminal(nsec, name) {
+		return statusSecure, nil
+	}
+	// Opt-out NSEC3 spans skip unsigned delegations, which have no DS (RFC 5155 section 8.6)
+	if qtype == dns.TypeDS && nsec3OptOut(nsec3, name) {
+		return statusInsecure, nil
+	}
+
+	// Wildcard NODATA: name doesn't exist and the wildcard at its closest
+	// encloser has no record of the type (RFC 4035 section 3.1.3.4, RFC 5155 section 7.2.5)
+	wildcard := ""
+	if encloser, ok := nsecClosestEncloser(nsec, name); ok {
+		wildcard = wildcardAt(encloser)
+	} else if encloser, _, ok := nsec3ClosestEncloser(nsec3, name); ok {
+		wildcard = wildcardAt(encloser)
+	}
+	if types, found := typesAt(nsec, nsec3, wildcard); wildcard != "" && found && !hasType(types, qtype) && !hasType(types, dns.TypeCNAME) {
+		return statusSecure, nil
+	}
+	return statusBogus, fmt.Errorf("NODATA for %s %s is not proven", name, dns.TypeToString[qtype])
+}
+
+// verifyAuthority validates the RRsets of an authority section and returns
+// the NSEC and NSEC3 records found in it
+func (v *Validator) verifyAuthority(ns []dns.RR) (securityStatus, []*dns.NSEC, []*dns.NSEC3, error) {
+	status := statusSecure
+	rrsets, sigs := groupRRsets(ns)
+
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		if hdr.Rrtype == dns.TypeNS {
+			continue // referrals and authority NS sets are not signed
+		}
+
+		st, err := v.verifyRRset(rrset, sigs[rrsetKey(hdr)])
+		if st == statusBogus {
+			return st, nil, nil, err
+		}
+		if st == statusInsecure {
+			status = statusInsecure
+			continue
+		}
+
+		for _, rr := range rrset {
+			switch denial := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, denial)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, denial)
+			}
+		}
+	}
+	return status, nsec, nsec3, nil
+}
+
+// lookupDelegation finds out whether name is a secure zone cut, a name
+// inside a signed zone, or provably insecure, by asking for its DS records.
+// The root is a secure cut with the trust anchors as its DS set.
+func (v *Validator) lookupDelegation(name string) *delegation {
+	name = dns.Fqdn(strings.ToLower(name))
+	if name == "." {
+		return &delegation{status: statusSecure, ds: v.anchors}
+	}
+
+	v.mu.Lock()
+	cached, ok := v.delegations[name]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached
+	}
+
+	result, ttl := v.fetchDelegation(name)
+	if result.status == statusBogus || ttl <= 0 {
+		ttl = dnssecFailureTTL
+	}
+	result.expires = time.Now().Add(ttl)
+
+	v.mu.Lock()
+	v.sweep()
+	v.delegations[name] = result
+	v.mu.Unlock()
+	return result
+}
+
+// fetchDelegation queries the DS records of name and validates the answer
+func (v *Validator) fetchDelegation(name string) (*delegation, time.Duration) {
+	resp, err := v.lookup(name, dns.TypeDS)
+	if err != nil {
+		return &delegation{status: statusBogus, err: err}, 0
+	}
+
+	rrsets, sigs := groupRRsets(resp.Answer)
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		if hdr.Rrtype != dns.TypeDS || !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+
+		rrsetSigs := sigs[rrsetKey(hdr)]
+		if len(rrsetSigs) == 0 {
+			// An unsigned DS set only comes from an insecure parent
+			return v.unsignedBelow(name), 0
+		}
+		st, err := v.verifyRRset(rrset, rrsetSigs)
+		if st != statusSecure {
+			return &delegation{status: st, err: err}, 0
+		}
+
+		var ds []*dns.DS
+		for _, rr := range rrset {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		if !supportedDS(ds) {
+			// RFC 4035 section 5.2: a zone signed only with algorithms we don't implement is insecure
+			return &delegation{status: statusInsecure}, rrsetTTL(rrset)
+		}
+		return &delegation{status: statusSecure, ds: ds}, rrsetTTL(rrset)
+	}
+
+	// No DS: the authority section must prove whether name is an insecure
+	// delegation or just a name inside a signed zone
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return &delegation{status: statusBogus, err: fmt.Errorf("DS lookup for %s failed: %s", name, dns.RcodeToString[resp.Rcode])}, 0
+	}
+
+	// Only signatures by an ancestor count, so proving a delegation never
+	// depends on the keys of the zone being delegated
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	signed := false
+	authority, authoritySigs := groupRRsets(resp.Ns)
+	for _, rrset := range authority {
+		hdr := rrset[0].Header()
+		var parentSigs []*dns.RRSIG
+		for _, sig := range authoritySigs[rrsetKey(hdr)] {
+			if signer := dns.Fqdn(strings.ToLower(sig.SignerName)); signer != name && dns.IsSubDomain(signer, name) {
+				parentSigs = append(parentSigs, sig)
+			}
+		}
+		if len(parentSigs) == 0 {
+			continue
+		}
+
+		st, err := v.verifyRRset(rrset, parentSigs)
+		if st != statusSecure {
+			return &delegation{status: st, err: err}, 0
+		}
+		signed = true
+		for _, rr := range rrset {
+			switch denial := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, denial)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, denial)
+			}
+		}
+	}
+	if !signed {
+		return v.unsignedBelow(name), 0
+	}
+	ttl := rrsetTTL(resp.Ns)
+
+	if types, found := typesAt(nsec, nsec3, name); found {
+		if hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) && !hasType(types, dns.TypeDS) {
+			return &delegation{status: statusInsecure}, ttl
+		}
+		return &delegation{status: statusSecure}, ttl
+	}
+	if nsec3OptOut(nsec3, name) {
+		return &delegation{status: statusInsecure}, ttl
+	}
+	if resp.Rcode == dns.RcodeNameError || nsecCovers(nsec, name) || nsec3Covers(nsec3, name) {
+		// name doesn't exist in a signed zone, so nothing below it can be insecure
+		return &delegation{status: statusSecure}, ttl
+	}
+	return &delegation{status: statusBogus, err: fmt.Errorf("no proof that %s has no DS records", name)}, 0
+}
+
+// unsignedBelow handles an unsigned answer about name: that's only
+// legitimate when name's parent is provably insecure too
+func (v *Validator) unsignedBelow(name string) *delegation {
+	parent := "."
+	if i, end := dns.NextLabel(name, 0); !end {
+		parent = name[i:]
+	}
+
+	if v.lookupDelegation(parent).status == statusInsecure {
+		return &delegation{status: statusInsecure}
+	}
+	return &delegation{status: statusBogus, err: fmt.Errorf("answer about %s is not signed", name)}
+}
+
+// lookupKeys returns the validated DNSKEYs of zone
+func (v *Validator) lookupKeys(zone string) *zoneKeys {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached
+	}
+
+	result, ttl := v.fetchKeys(zone)
+	if result.status == statusBogus || ttl <= 0 {
+		ttl = dnssecFailureTTL
+	}
+	result.expires = time.Now().Add(ttl)
+
+	v.mu.Lock()
+	v.sweep()
+	v.keys[zone] = result
+	v.mu.Unlock()
+	return result
+}
+
+// fetchKeys queries the DNSKEY set of zone and validates it against the
+// zone's DS records
+func (v *Validator) fetchKeys(zone string) (*zoneKeys, time.Duration) {
+	parent := v.lookupDelegation(zone)
+	switch {
+	case parent.status != statusSecure:
+		return &zoneKeys{status: parent.status, err: parent.err}, 0
+	case len(parent.ds) == 0:
+		return &zoneKeys{status: statusBogus, err: fmt.Errorf("%s signs records but is not a secure zone", zone)}, 0
+	}
+
+	resp, err := v.lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return &zoneKeys{status: statusBogus, err: err}, 0
+	}
+
+	var keySet []dns.RR
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keySet = append(keySet, rr)
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return &zoneKeys{status: statusBogus, err: fmt.Errorf("%s has no DNSKEY records", zone)}, 0
+	}
+
+	// The key set must be signed by a key one of the DS records points to
+	for _, ds := range parent.ds {
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			digest := key.ToDS(ds.DigestType)
+			if digest == nil || !strings.EqualFold(digest.Digest, ds.Digest) {
+				continue
+			}
+			for _, sig := range sigs {
+				if sig.KeyTag == key.KeyTag() && verifySignature(sig, []*dns.DNSKEY{key}, keySet) == nil {
+					return &zoneKeys{status: statusSecure, keys: keys}, rrsetTTL(keySet)
+				}
+			}
+		}
+	}
+	return &zoneKeys{status: statusBogus, err: fmt.Errorf("no DNSKEY of %s matches its DS records", zone)}, 0
+}
+
+// lookup sends a DNSSEC query for the chain of trust. CD is set so a
+// validating upstream hands over bogus data for us to judge.
+func (v *Validator) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(ednsUDPSize, true)
+	m.CheckingDisabled = true
+
+	resp, _, err := v.poolFor(name).Exchange(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s lookup failed: %v", name, dns.TypeToString[qtype], err)
+	}
+	return resp, nil
+}
+
+// sweep drops expired chain entries once the caches grow large; the caller holds v.mu
+func (v *Validator) sweep() {
+	if len(v.delegations)+len(v.keys) < dnssecMaxCacheEntries {
+		return
+	}
+
+	now := time.Now()
+	for name, entry := range v.delegations {
+		if now.After(entry.expires) {
+			delete(v.delegations, name)
+		}
+	}
+	for zone, entry := range v.keys {
+		if now.After(entry.expires) {
+			delete(v.keys, zone)
+		}
+	}
+}
+
+// Stats returns the validation counters
+func (v *Validator) Stats() map[string]interface{} {
+	v.mu.Lock()
+	cached := len(v.delegations) + len(v.keys)
+	v.mu.Unlock()
+
+	return map[string]interface{}{
+		"secure":   v.secure.Load(),
+		"insecure": v.insecure.Load(),
+		"bogus":    v.bogus.Load(),
+		"cached":   cached,
+	}
+}
+
+// groupRRsets splits records into RRsets and the signatures covering them,
+// both keyed by rrsetKey
+func groupRRsets(rrs []dns.RR) ([][]dns.RR, map[string][]*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	index := map[string]int{}
+	sigs := map[string][]*dns.RRSIG{}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := strings.ToLower(hdr.Name) + "|" + dns.TypeToString[sig.TypeCovered]
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := rrsetKey(hdr)
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+	return rrsets, sigs
+}
+
+// rrsetKey identifies the RRset a record belongs to
+func rrsetKey(hdr *dns.RR_Header) string {
+	return strings.ToLower(hdr.Name) + "|" + dns.TypeToString[hdr.Rrtype]
+}
+
+// rrsetTTL returns the smallest TTL of an RRset, capped for the chain caches
+func rrsetTTL(rrset []dns.RR) time.Duration {
+	ttl := time.Duration(minRRTTL(rrset)) * time.Second
+	if ttl > dnssecMaxCacheTTL {
+		ttl = dnssecMaxCacheTTL
+	}
+	return ttl
+}
+
+// coveredByDNAME reports whether a CNAME owned by name can be synthesized
+// from one of the DNAME records in rrsets
+func coveredByDNAME(name string, rrsets [][]dns.RR) bool {
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		if hdr.Rrtype == dns.TypeDNAME && dns.IsSubDomain(strings.ToLower(hdr.Name), strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedDS reports whether any DS record uses an algorithm and digest we can verify
+func supportedDS(ds []*dns.DS) bool {
+	for _, record := range ds {
+		switch record.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		default:
+			continue
+		}
+		switch record.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
+
+// hasType reports whether types contains t
+func hasType(types []uint16, t uint16) bool {
+	for _, candidate := range types {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+// typesAt returns the type bitmap of the NSEC or NSEC3 record owned by name
+func typesAt(nsec []*dns.NSEC, nsec3 []*dns.NSEC3, name string) ([]uint16, bool) {
+	for _, record := range nsec {
+		if strings.EqualFold(record.Hdr.Name, name) {
+			return record.TypeBitMap, true
+		}
+	}
+	for _, record := range nsec3 {
+		if record.Match(name) {
+			return record.TypeBitMap, true
+		}
+	}
+	return nil, false
+}
+
+// nsecCovers reports whether an NSEC record proves name doesn't exist
+func nsecCovers(nsec []*dns.NSEC, name string) bool {
+	return nsecCovering(nsec, name) != nil
+}
+
+// nsecCovering returns the NSEC record whose span contains name
+func nsecCovering(nsec []*dns.NSEC, name string) *dns.NSEC {
+	for _, record := range nsec {
+		owner, next := record.Hdr.Name, record.NextDomain
+		if canonicalCompare(owner, name) >= 0 {
+			continue
+		}
+		// The last NSEC of a zone points back to the apex
+		if canonicalCompare(name, next) < 0 || canonicalCompare(next, owner) <= 0 {
+			return record
+		}
+	}
+	return nil
+}
+
+// nsecClosestEncloser returns the closest existing ancestor of a name an
+// NSEC record proves doesn't exist: the longest ancestor shared with the
+// owner or next name of the covering record
+func nsecClosestEncloser(nsec []*dns.NSEC, name string) (string, bool) {
+	cover := nsecCovering(nsec, name)
+	if cover == nil {
+		return "", false
+	}
+	owner, next := strings.ToLower(cover.Hdr.Name), strings.ToLower(cover.NextDomain)
+	name = strings.ToLower(name)
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if ancestor := name[i:]; dns.IsSubDomain(ancestor, owner) || dns.IsSubDomain(ancestor, next) {
+			return ancestor, true
+		}
+	}
+	return ".", true
+}
+
+// nsecEmptyNonTerminal reports whether an NSEC record proves name exists
+// without records of its own: the name after it in the zone is below it
+func nsecEmptyNonTerminal(nsec []*dns.NSEC, name string) bool {
+	for _, record := range nsec {
+		if canonicalCompare(record.Hdr.Name, name) < 0 && canonicalCompare(name, record.NextDomain) < 0 &&
+			dns.IsSubDomain(strings.ToLower(name), strings.ToLower(record.NextDomain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardAt returns the wildcard name directly below encloser
+func wildcardAt(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// nsec3Covers reports whether NSEC3 records prove name doesn't exist: its
+// closest encloser exists and the next closer name is covered (RFC 5155 section 8.3)
+func nsec3Covers(nsec3 []*dns.NSEC3, name string) bool {
+	_, _, ok := nsec3ClosestEncloser(nsec3, name)
+	return ok
+}
+
+// nsec3HashCovered reports whether an NSEC3 record covers the hash of name
+func nsec3HashCovered(nsec3 []*dns.NSEC3, name string) bool {
+	for _, record := range nsec3 {
+		if record.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3OptOut reports whether name is covered by an opt-out NSEC3 record,
+// which makes it an insecure delegation (RFC 5155 section 6)
+func nsec3OptOut(nsec3 []*dns.NSEC3, name string) bool {
+	_, cover, ok := nsec3ClosestEncloser(nsec3, name)
+	return ok && cover.Flags&1 == 1
+}
+
+// nsec3ClosestEncloser finds the closest existing ancestor of name and
+// returns it with the NSEC3 record covering the next closer name
+func nsec3ClosestEncloser(nsec3 []*dns.NSEC3, name string) (string, *dns.NSEC3, bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		matched := false
+		for _, record := range nsec3 {
+			if record.Match(encloser) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		for _, record := range nsec3 {
+			if record.Cover(nextCloser) {
+				return encloser, record, true
+			}
+		}
+		return "", nil, false
+	}
+	return "", nil, false
+}
+
+// canonicalCompare orders two names in DNSSEC canonical order (RFC 4034
+// section 6.1): label by label from the root, compared as lowercase bytes
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// stripDNSSEC removes signatures and denial records from a response for a
+// client that didn't ask for them with the DO bit
+func stripDNSSEC(r, resp *dns.Msg) *dns.Msg {
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		return resp
+	}
+
+	var qtype uint16
+	if len(r.Question) > 0 {
+		qtype = r.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	stripped := resp.Copy()
+	stripped.Answer = strip(stripped.Answer)
+	stripped.Ns = strip(stripped.Ns)
+	return stripped
+}
@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// signedZones is a fixture chain of trust: a signed root, a signed
+// "example." below it and an unsigned "insecure." delegation, served from a
+// local UDP server
+type signedZones struct {
+	t         *testing.T
+	keys      map[string]*dns.DNSKEY
+	signers   map[string]crypto.Signer
+	responses map[string]*dns.Msg
+}
+
+// newSignedZones generates keys for the root and "example." and publishes
+// their DNSKEY sets, the DS of "example." and the proof that "insecure." has none
+func newSignedZones(t *testing.T) *signedZones {
+	t.Helper()
+	z := &signedZones{
+		t:         t,
+		keys:      map[string]*dns.DNSKEY{},
+		signers:   map[string]crypto.Signer{},
+		responses: map[string]*dns.Msg{},
+	}
+
+	for _, zone := range []string{".", "example."} {
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		private, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.keys[zone] = key
+		z.signers[zone] = private.(crypto.Signer)
+		z.respond(zone, dns.TypeDNSKEY, dns.RcodeSuccess, z.sign(zone, key), nil)
+	}
+
+	ds := z.keys["example."].ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	z.respond("example.", dns.TypeDS, dns.RcodeSuccess, z.sign(".", ds), nil)
+
+	z.respond("insecure.", dns.TypeDS, dns.RcodeSuccess, nil, z.sign(".", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "zzz.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}))
+	return z
+}
+
+// anchor returns the root trust anchor of the fixture
+func (z *signedZones) anchor() string {
+	return z.keys["."].ToDS(dns.SHA256).String()
+}
+
+// sign returns rrset followed by a signature of zone valid for an hour
+func (z *signedZones) sign(zone string, rrset ...dns.RR) []dns.RR {
+	now := time.Now()
+	return z.signAt(zone, now.Add(-time.Hour), now.Add(time.Hour), rrset...)
+}
+
+// signAt returns rrset followed by a signature of zone with the given validity
+func (z *signedZones) signAt(zone string, inception, expiration time.Time, rrset ...dns.RR) []dns.RR {
+	z.t.Helper()
+	key := z.keys[zone]
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.signers[zone], rrset); err != nil {
+		z.t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+// respond sets what the fixture server answers for name and qtype
+func (z *signedZones) respond(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	m := new(dns.Msg)
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	z.responses[strings.ToLower(name)+"|"+dns.TypeToString[qtype]] = m
+}
+
+// reply answers r from the fixture; unknown names get an empty, unsigned answer
+func (z *signedZones) reply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	if canned, ok := z.responses[strings.ToLower(r.Question[0].Name)+"|"+dns.TypeToString[r.Question[0].Qtype]]; ok {
+		m = canned.Copy()
+	}
+	rcode := m.Rcode
+	m.SetReply(r)
+	m.Rcode = rcode
+	return m
+}
+
+// validator starts the fixture server and returns a validator that
+// trusts the fixture root and looks up the chain through it
+func (z *signedZones) validator() *Validator {
+	z.t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(z.reply(r))
+		}),
+	}
+	go server.ActivateAndServe()
+	z.t.Cleanup(func() { server.Shutdown() })
+
+	pool := NewUpstreamPool([]string{conn.LocalAddr().String()}, "", nil)
+	z.t.Cleanup(pool.Stop)
+
+	v, err := NewValidator(config.DNSSECConfig{Enabled: true, TrustAnchors: []string{z.anchor()}},
+		func(string) *UpstreamPool { return pool })
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	return v
+}
+
+// a returns an A record for name
+func a(name string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	}
+}
+
+// expand turns a signed wildcard RRset into the answer for name
+func expand(rrs []dns.RR, name string) []dns.RR {
+	expanded := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		expanded[i] = dns.Copy(rr)
+		expanded[i].Header().Name = name
+	}
+	return expanded
+}
+
+func TestValidate(t *testing.T) {
+	z := newSignedZones(t)
+	now := time.Now()
+
+	soa := z.sign("example.", &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 300,
+	})
+	// example. < foo.example. < missing.example. < www.example.
+	nsec := z.sign("example.", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "www.example.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY},
+	})
+	wildcard := expand(z.sign("example.", a("*.example.")), "foo.example.")
+	// foo.example. < missing.example., leaving *.example. uncovered
+	narrow := z.sign("example.", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "foo.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "www.example.",
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	atWWW := z.sign("example.", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "example.",
+		TypeBitMap: []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	atWildcard := z.sign("example.", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "*.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "www.example.",
+		TypeBitMap: []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	withSOA := func(rrs ...[]dns.RR) []dns.RR {
+		ns := append([]dns.RR{}, soa...)
+		for _, rr := range rrs {
+			ns = append(ns, rr...)
+		}
+		return ns
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   securityStatus
+	}{
+		{"signed answer", "www.example.", dns.RcodeSuccess, z.sign("example.", a("www.example.")), nil, statusSecure},
+		{"unsigned answer below an insecure delegation", "www.insecure.", dns.RcodeSuccess, []dns.RR{a("www.insecure.")}, nil, statusInsecure},
+		{"unsigned answer in a signed zone", "www.example.", dns.RcodeSuccess, []dns.RR{a("www.example.")}, nil, statusBogus},
+		{"expired signature", "www.example.", dns.RcodeSuccess, z.signAt("example.", now.Add(-2*time.Hour), now.Add(-time.Hour), a("www.example.")), nil, statusBogus},
+		{"proven NXDOMAIN", "missing.example.", dns.RcodeNameError, nil, withSOA(nsec), statusSecure},
+		{"NXDOMAIN without denial proof", "missing.example.", dns.RcodeNameError, nil, soa, statusBogus},
+		{"NXDOMAIN without wildcard denial", "missing.example.", dns.RcodeNameError, nil, withSOA(narrow), statusBogus},
+		{"proven NODATA", "www.example.", dns.RcodeSuccess, nil, withSOA(atWWW), statusSecure},
+		{"NODATA from a replayed NSEC", "www.example.", dns.RcodeSuccess, nil, withSOA(nsec), statusBogus},
+		{"wildcard NODATA", "missing.example.", dns.RcodeSuccess, nil, withSOA(atWildcard), statusSecure},
+		{"wildcard answer with NSEC", "foo.example.", dns.RcodeSuccess, wildcard, nsec, statusSecure},
+		{"wildcard answer without NSEC", "foo.example.", dns.RcodeSuccess, wildcard, nil, statusBogus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := z.validator()
+
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, dns.TypeA)
+			query := validatingQuery(r)
+			resp := new(dns.Msg)
+			resp.SetRcode(query, tt.rcode)
+			resp.Answer = tt.answer
+			resp.Ns = tt.ns
+
+			validated, status := v.Validate(query, resp)
+			if status != tt.want {
+				t.Fatalf("status = %s, want %s", status, tt.want)
+			}
+			switch {
+			case status == statusBogus && validated.Rcode != dns.RcodeServerFailure:
+				t.Errorf("bogus answer passed on with rcode %s", dns.RcodeToString[validated.Rcode])
+			case validated.AuthenticatedData != (status == statusSecure):
+				t.Errorf("AD = %v for a %s answer", validated.AuthenticatedData, status)
+			}
+		})
+	}
+}
+
+func TestValidateSkipsForwardZones(t *testing.T) {
+	z := newSignedZones(t)
+	// The signed root proves "internal." doesn't exist
+	z.respond("internal.", dns.TypeDS, dns.RcodeNameError, nil, z.sign(".", &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "zzz.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}))
+
+	var answer atomic.Value
+	answer.Store("192.0.2.20")
+	corp, _ := startTargetUpstream(t, &answer)
+
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	config.Config.DNS.ForwardZones = []config.ForwardZone{{Domain: "*.corp.internal", Upstreams: corp.Addresses()}}
+
+	server := newServer(nil, nil, true)
+	defer server.Stop()
+	server.validator = z.validator()
+
+	r, _ := NewQuery("app.corp.internal", "A")
+	trace := server.Trace(r, "192.0.2.100")
+	if resp := trace.Response; resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.AuthenticatedData {
+		t.Fatalf("forward zone answer = %v, want the unsigned answer of its resolver", resp)
+	}
+	if output := strings.Join(trace.Lines(), "\n"); !strings.Contains(output, "DNSSEC validation skipped") {
+		t.Errorf("trace doesn't mention the skipped validation:\n%s", output)
+	}
+}
+
+func TestValidatorTrustAnchors(t *testing.T) {
+	for _, anchor := range []string{
+		"not a record",
+		"example. 3600 IN DS 1 13 2 0000",
+		". 3600 IN A 192.0.2.1",
+	} {
+		if _, err := NewValidator(config.DNSSECConfig{TrustAnchors: []string{anchor}}, nil); err == nil {
+			t.Errorf("trust anchor %q accepted", anchor)
+		}
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// The example order of RFC 4034 section 6.1, without the escaped labels
+	ordered := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "*.z.example.",
+	}
+	for i := 1; i < len(ordered); i++ {
+		if canonicalCompare(ordered[i-1], ordered[i]) >= 0 {
+			t.Errorf("%s does not sort before %s", ordered[i-1], ordered[i])
+		}
+	}
+}
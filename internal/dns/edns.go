@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ednsUDPSize is the buffer size we advertise to clients and upstreams. 1232
+	// bytes avoids IP fragmentation on virtually every path (DNS flag day 2020).
+	ednsUDPSize = 1232
+	// clientCookieLen is the length of an EDNS client cookie in hex characters
+	clientCookieLen = 16
+)
+
+// cookieSecret keys the server cookies we hand out to clients
+var cookieSecret = func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}()
+
+// upstreamQuery returns the copy of a client query that is sent upstream.
+// EDNS options are hop-by-hop, so the client's OPT record is replaced with our
+// own: our buffer size, the client's DO bit and no client subnet or cookie.
+func upstreamQuery(r *dns.Msg) *dns.Msg {
+	query := r.Copy()
+
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	stripOPT(query)
+	query.SetEdns0(ednsUDPSize, do)
+	return query
+}
+
+// stripOPT removes every OPT record from the additional section
+func stripOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// badEDNSVersion answers a query using an EDNS version we don't speak with
+// BADVERS (RFC 6891 section 6.1.3), or returns nil if the version is fine
+func badEDNSVersion(r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(ednsUDPSize, false)
+	m.Rcode = dns.RcodeBadVers
+	return m
+}
+
+// finishEDNS replaces whatever OPT record the response carries with ours.
+// Clients that sent no OPT get none back; clients that sent a cookie get it
+// back together with our server cookie (RFC 7873).
+func finishEDNS(r, resp *dns.Msg, client string) {
+	stripOPT(resp)
+
+	clientOpt := r.IsEdns0()
+	if clientOpt == nil {
+		return
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(ednsUDPSize)
+	opt.SetDo(clientOpt.Do())
+
+	for _, option := range clientOpt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok && len(cookie.Cookie) >= clientCookieLen {
+			clientCookie := cookie.Cookie[:clientCookieLen]
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: clientCookie + serverCookie(clientCookie, client),
+			})
+		}
+	}
+
+	resp.Extra = append(resp.Extra, opt)
+}
+
+// serverCookie derives the server cookie for a client cookie and client IP
+func serverCookie(clientCookie, client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(strings.ToLower(clientCookie)))
+	mac.Write([]byte(client))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// hasValidCookie reports whether r carries a server cookie we issued to client
+func hasValidCookie(r *dns.Msg, client string) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok || len(cookie.Cookie) <= clientCookieLen {
+			continue
+		}
+		expected := serverCookie(cookie.Cookie[:clientCookieLen], client)
+		return hmac.Equal([]byte(strings.ToLower(cookie.Cookie[clientCookieLen:])), []byte(expected))
+	}
+	return false
+}
+
+// udpResponseSize returns how large a UDP response to r may be
+func udpResponseSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > ednsUDPSize {
+		size = ednsUDPSize
+	}
+	return size
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// forwardZone is a domain pattern with its own upstream pool
+type forwardZone struct {
+	pattern string
+	pool    *UpstreamPool
+}
+
+// newForwardZones builds the conditional forwarding table from configuration,
+// expanding "system" upstreams into system; encrypted upstreams are looked up
+// through resolvers. The zones are also returned as a list for health checks
+// and status.
+func newForwardZones(configured []config.ForwardZone, system []string, lan *LANInterface, resolvers []string) (*Matcher[*forwardZone], []*forwardZone) {
+	matcher := NewMatcher[*forwardZone]()
+	var zones []*forwardZone
+
+	for _, zc := range configured {
+		pool := NewUpstreamPool(upstreamAddresses(zc.Upstreams, system, lan), zc.Strategy, resolvers)
+		if len(pool.upstreams) == 0 {
+			log.Warnf("Skipping forward zone %s: no usable upstreams", zc.Domain)
+			continue
+		}
+
+		pool.probeZone(zoneApex(zc.Domain))
+
+		zone := &forwardZone{pattern: zc.Domain, pool: pool}
+		if err := matcher.Insert(zc.Domain, zone); err != nil {
+			pool.Stop()
+			log.Warnf("Skipping forward zone %s: %v", zc.Domain, err)
+			continue
+		}
+		zones = append(zones, zone)
+		log.Debugf("Added forward zone: %s -> %v", zc.Domain, pool.Addresses())
+	}
+	return matcher, zones
+}
+
+// zoneApex returns the domain a forward zone pattern sits below, without
+// its leading wildcard and glob labels
+func zoneApex(pattern string) string {
+	labels := dns.SplitDomainName(strings.ToLower(pattern))
+	for len(labels) > 0 && strings.ContainsAny(labels[0], "*?[") {
+		labels = labels[1:]
+	}
+	return dns.Fqdn(strings.Join(labels, "."))
+}
+
+// poolFor returns the upstream pool responsible for name, together with the
+// forward zone pattern that selected it ("" for the default upstreams)
+func (s *Server) poolFor(name string) (*UpstreamPool, string) {
+	if result, ok := s.forwardZones.Match(name); ok {
+		return result.Value.pool, result.Pattern
+	}
+	return s.upstreams, ""
+}
+
+// forwardZoneStats returns the upstream statistics of every forward zone
+func (s *Server) forwardZoneStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(s.zones))
+	for _, zone := range s.zones {
+		stats = append(stats, map[string]interface{}{
+			"domain":    zone.pattern,
+			"strategy":  zone.pool.Strategy(),
+			"upstreams": zone.pool.Stats(),
+		})
+	}
+	return stats
+}
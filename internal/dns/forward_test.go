@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+func TestForwardZones(t *testing.T) {
+	matcher, zones := newForwardZones([]config.ForwardZone{
+		{Domain: "**.corp.internal", Upstreams: []string{"198.51.100.1"}},
+		{Domain: "*.dev.corp.internal", Upstreams: []string{"198.51.100.2"}, Strategy: StrategyParallel},
+		{Domain: "corp.example", Upstreams: []string{"198.51.100.3"}},
+		{Domain: "api-*.lab.example", Upstreams: []string{"198.51.100.4"}},
+		{Domain: "**.skipped.example", Upstreams: []string{"system"}},
+	}, nil, nil, nil)
+	defaults := NewUpstreamPool([]string{"198.51.100.53"}, "", nil)
+	s := &Server{forwardZones: matcher, zones: zones, upstreams: defaults}
+	t.Cleanup(func() {
+		defaults.Stop()
+		for _, zone := range zones {
+			zone.pool.Stop()
+		}
+	})
+
+	if len(zones) != 4 {
+		t.Fatalf("got %d zones, want 4 without the one lacking upstreams", len(zones))
+	}
+
+	tests := []struct {
+		name     string
+		zone     string
+		upstream string
+	}{
+		{"corp.internal.", "**.corp.internal", "198.51.100.1:53"},
+		{"App.Corp.Internal.", "**.corp.internal", "198.51.100.1:53"},
+		{"dev.corp.internal.", "**.corp.internal", "198.51.100.1:53"},
+		{"web.dev.corp.internal.", "*.dev.corp.internal", "198.51.100.2:53"},
+		{"corp.example.", "corp.example", "198.51.100.3:53"},
+		{"www.corp.example.", "", "198.51.100.53:53"},
+		{"api-v2.lab.example.", "api-*.lab.example", "198.51.100.4:53"},
+		{"a.skipped.example.", "", "198.51.100.53:53"},
+		{"example.com.", "", "198.51.100.53:53"},
+	}
+	for _, tt := range tests {
+		pool, zone := s.poolFor(tt.name)
+		if zone != tt.zone || strings.Join(pool.Addresses(), ",") != tt.upstream {
+			t.Errorf("poolFor(%q) = %v via %q, want %s via %q", tt.name, pool.Addresses(), zone, tt.upstream, tt.zone)
+		}
+	}
+
+	// Health checks ask each zone for its own SOA
+	probes := map[string]string{
+		"**.corp.internal":    "corp.internal.",
+		"*.dev.corp.internal": "dev.corp.internal.",
+		"corp.example":        "corp.example.",
+		"api-*.lab.example":   "lab.example.",
+	}
+	for _, zone := range zones {
+		if probe := zone.pool.probe; probe.Name != probes[zone.pattern] || probe.Qtype != dns.TypeSOA {
+			t.Errorf("zone %s is probed with %s %s, want %s SOA", zone.pattern,
+				probe.Name, dns.TypeToString[probe.Qtype], probes[zone.pattern])
+		}
+	}
+	if probe := defaults.probe; probe.Name != "." || probe.Qtype != dns.TypeNS {
+		t.Errorf("default upstreams are probed with %s %s, want . NS", probe.Name, dns.TypeToString[probe.Qtype])
+	}
+}
+
+func TestForwardZoneHealthCheck(t *testing.T) {
+	// An authoritative-only server: it refuses anything outside corp.internal
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if !dns.IsSubDomain("corp.internal.", strings.ToLower(r.Question[0].Name)) {
+				m.Rcode = dns.RcodeRefused
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	_, zones := newForwardZones([]config.ForwardZone{
+		{Domain: "**.corp.internal", Upstreams: []string{conn.LocalAddr().String()}},
+	}, nil, nil, nil)
+	pool := zones[0].pool
+	t.Cleanup(pool.Stop)
+
+	upstream := pool.upstreams[0]
+	upstream.checkHealth(pool.probe)
+	if !upstream.IsHealthy() {
+		t.Error("authoritative-only resolver failed the health check of its zone")
+	}
+	upstream.checkHealth(dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET})
+	if upstream.IsHealthy() {
+		t.Error("REFUSED root probe passed the health check")
+	}
+}
+
+func TestForwardZoneQueryLog(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("192.0.2.20")
+	corp, _ := startTargetUpstream(t, &answer)
+
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	config.Config.DNS.ForwardZones = []config.ForwardZone{{Domain: "**.corp.internal", Upstreams: corp.Addresses()}}
+
+	s := newServer(nil, nil, true)
+	defer s.Stop()
+
+	r := new(dns.Msg)
+	r.SetQuestion("app.corp.internal.", dns.TypeA)
+	qc := newQueryContext("192.0.2.100:5353", "udp")
+	resp := s.resolve(qc, r)
+
+	entry := qc.entries(r, resp)[0]
+	if entry.Zone != "**.corp.internal" || entry.Upstream != corp.Addresses()[0] || entry.Rcode != "NOERROR" {
+		t.Errorf("log entry = %+v, want NOERROR from %s via **.corp.internal", entry, corp.Addresses()[0])
+	}
+	if line := entry.String(); !strings.Contains(line, "via **.corp.internal") {
+		t.Errorf("log line %q doesn't name the forward zone", line)
+	}
+}
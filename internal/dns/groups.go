@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// clientGroup is a client group compiled from configuration
+type clientGroup struct {
+	name      string
+	networks  []*net.IPNet
+	macs      map[string]bool         // normalized hardware addresses
+	redirects *Matcher[*redirectRule] // the group's redirects and the global ones they don't override
+	reverse   reverseTable            // PTR names of the redirect targets above
+	count     int                     // active redirects of the group itself
+}
+
+// newClientGroups compiles the configured client groups. Each group matches
+// its own redirects active at now and, unless it ignores them, the global rules
+// whose patterns it doesn't redefine; the most specific pattern still wins.
+func newClientGroups(groups []config.ClientGroup, global []*redirectRule, lan *LANInterface, now time.Time) []*clientGroup {
+	compiled := make([]*clientGroup, 0, len(groups))
+	for _, group := range groups {
+		cg := &clientGroup{
+			name:      group.Name,
+			macs:      map[string]bool{},
+			redirects: NewMatcher[*redirectRule](),
+		}
+
+		for _, value := range group.Networks {
+			network, err := config.ParseNetwork(value)
+			if err != nil {
+				log.Warnf("Skipping network of client group %s: %v", group.Name, err)
+				continue
+			}
+			cg.networks = append(cg.networks, network)
+		}
+		for _, value := range group.MACs {
+			mac, err := config.ParseMAC(value)
+			if err != nil {
+				log.Warnf("Skipping MAC address of client group %s: %v", group.Name, err)
+				continue
+			}
+			cg.macs[mac.String()] = true
+		}
+
+		var rules []*redirectRule
+		defined := map[string]bool{}
+		for _, redirect := range exclusionsFirst(group.Redirects) {
+			if !redirect.ActiveAt(now) {
+				continue
+			}
+			rule := newRedirectRule(redirect, lan)
+			if err := cg.redirects.Insert(redirect.Domain, rule); err != nil {
+				log.Warnf("Skipping redirect %s of client group %s: %v", redirect.Domain, group.Name, err)
+				continue
+			}
+			defined[basePattern(redirect.Domain)] = true
+			rules = append(rules, rule)
+			cg.count++
+		}
+
+		// A pattern the group defines replaces the global one, exclusion or not
+		if !group.IgnoreGlobalRedirects {
+			for _, rule := range global {
+				if defined[basePattern(rule.pattern)] {
+					continue
+				}
+				if err := cg.redirects.Insert(rule.pattern, rule); err == nil {
+					rules = append(rules, rule)
+				}
+			}
+		}
+		cg.reverse = newReverseTable(rules)
+
+		log.Debugf("Client group %s: %d networks, %d MAC addresses, %d redirects", cg.name, len(cg.networks), len(cg.macs), cg.count)
+		compiled = append(compiled, cg)
+	}
+	return compiled
+}
+
+// basePattern returns a pattern without its exclusion mark, for comparison
+func basePattern(pattern string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pattern), "!"))
+}
+
+// clientGroupFor returns the group of a client IP, or nil if it is in none.
+// The most specific matching network wins; a MAC address counts as a single IP.
+func (s *Server) clientGroupFor(client string) *clientGroup {
+	s.mu.RLock()
+	groups := s.groups
+	s.mu.RUnlock()
+	if len(groups) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	var best *clientGroup
+	bestOnes := -1
+	mac, macLooked := "", false
+	for _, group := range groups {
+		for _, network := range group.networks {
+			if ones, _ := network.Mask.Size(); ones > bestOnes && network.Contains(ip) {
+				best, bestOnes = group, ones
+			}
+		}
+
+		if len(group.macs) == 0 || bestOnes >= len(ip)*8 {
+			continue
+		}
+		if !macLooked {
+			mac, macLooked = s.neighbors.lookup(ip), true
+		}
+		if mac != "" && group.macs[mac] {
+			best, bestOnes = group, len(ip)*8
+		}
+	}
+	return best
+}
+
+// clientGroupStats describes the client groups for the status output
+func (s *Server) clientGroupStats() []map[string]interface{} {
+	s.mu.RLock()
+	groups := s.groups
+	s.mu.RUnlock()
+
+	stats := make([]map[string]interface{}, 0, len(groups))
+	for _, group := range groups {
+		networks := make([]string, 0, len(group.networks))
+		for _, network := range group.networks {
+			networks = append(networks, network.String())
+		}
+		macs := make([]string, 0, len(group.macs))
+		for mac := range group.macs {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+
+		stats = append(stats, map[string]interface{}{
+			"name":      group.name,
+			"networks":  networks,
+			"macs":      macs,
+			"redirects": group.count,
+		})
+	}
+	return stats
+}
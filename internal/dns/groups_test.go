@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+func TestParseNeighbors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]string
+	}{
+		{"ip neigh", `192.168.1.1 dev eth0 lladdr 00:11:22:33:44:55 REACHABLE
+192.168.1.23 dev eth0 lladdr AA:BB:CC:DD:EE:FF STALE
+192.168.1.99 dev eth0  FAILED
+fe80::1 dev eth0 lladdr 00:11:22:33:44:66 router STALE
+2001:db8::5 dev eth0 lladdr 00:11:22:33:44:77 DELAY
+`, map[string]string{
+			"192.168.1.1":  "00:11:22:33:44:55",
+			"192.168.1.23": "aa:bb:cc:dd:ee:ff",
+			"fe80::1":      "00:11:22:33:44:66",
+			"2001:db8::5":  "00:11:22:33:44:77",
+		}},
+		{"arp -an on macOS", `? (192.168.1.1) at 0:11:22:33:44:55 on en0 ifscope [ethernet]
+? (192.168.1.50) at (incomplete) on en0 ifscope [ethernet]
+? (192.168.1.64) at a4:83:e7:1:2:3 on en0 ifscope [ethernet]
+`, map[string]string{
+			"192.168.1.1":  "00:11:22:33:44:55",
+			"192.168.1.64": "a4:83:e7:01:02:03",
+		}},
+		{"ndp -an", `Neighbor                        Linklayer Address  Netif Expire    St Flgs Prbs
+fe80::1%en0                     0:11:22:33:44:66   en0 23h59m58s S  R
+fe80::aede:48ff:fe00:1122%en0   (incomplete)       en0 permanent R
+`, map[string]string{
+			"fe80::1": "00:11:22:33:44:66",
+		}},
+		{"arp -a on Windows", `
+Interface: 192.168.1.10 --- 0x4
+  Internet Address      Physical Address      Type
+  192.168.1.1           00-11-22-33-44-55     dynamic
+  192.168.1.40          3c-22-fb-aa-bb-cc     dynamic
+`, map[string]string{
+			"192.168.1.1":  "00:11:22:33:44:55",
+			"192.168.1.40": "3c:22:fb:aa:bb:cc",
+		}},
+		{"/proc/net/arp", `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         00:11:22:33:44:55     *        eth0
+192.168.1.77     0x1         0x0         00:00:00:00:00:00     *        eth0
+`, map[string]string{
+			"192.168.1.1": "00:11:22:33:44:55",
+		}},
+	}
+	for _, tt := range tests {
+		if got := parseNeighbors(tt.output); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseNeighbors = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientGroupFor(t *testing.T) {
+	s := &Server{groups: newClientGroups([]config.ClientGroup{
+		{Name: "office", Networks: []string{"192.168.1.0/24"}},
+		{Name: "printer", Networks: []string{"192.168.1.50"}},
+		{Name: "lab", Networks: []string{"192.168.1.128/25", "fd00::/64"}},
+		{Name: "console", MACs: []string{"AA-BB-CC-DD-EE-FF"}},
+	}, nil, nil, time.Now())}
+	s.neighbors.snapshot.Store(&neighborSnapshot{loaded: time.Now(), macs: map[string]string{
+		"192.168.1.50":  "aa:bb:cc:dd:ee:ff",
+		"192.168.1.200": "aa:bb:cc:dd:ee:ff",
+		"10.0.0.5":      "aa:bb:cc:dd:ee:ff",
+		"10.0.0.6":      "00:11:22:33:44:55",
+	}})
+
+	tests := []struct {
+		client, want string // want is "" for no group
+	}{
+		{"192.168.1.10", "office"},
+		{"192.168.1.130", "lab"},     // the longer prefix wins
+		{"192.168.1.50", "printer"},  // a single IP beats a MAC address
+		{"192.168.1.200", "console"}, // a MAC address beats any network
+		{"10.0.0.5", "console"},
+		{"10.0.0.6", ""},
+		{"::ffff:192.168.1.10", "office"},
+		{"fd00::1", "lab"},
+		{"not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if group := s.clientGroupFor(tt.client); group != nil {
+			got = group.name
+		}
+		if got != tt.want {
+			t.Errorf("clientGroupFor(%s) = %q, want %q", tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestClientGroupRedirects(t *testing.T) {
+	var global []*redirectRule
+	for _, redirect := range []config.DNSRedirect{
+		{Domain: "*.game.example", Target: "192.0.2.1", Enabled: true},
+		{Domain: "api.game.example", Target: "192.0.2.9", Enabled: true},
+		{Domain: "tracker.example", Target: "0.0.0.0", Enabled: true},
+	} {
+		global = append(global, newRedirectRule(redirect, nil))
+	}
+
+	groups := newClientGroups([]config.ClientGroup{
+		{Name: "dev", Redirects: []config.DNSRedirect{
+			{Domain: "api.game.example", Target: "192.0.2.2", Enabled: true},
+			{Domain: "!tracker.example", Enabled: true},
+		}},
+		{Name: "isolated", IgnoreGlobalRedirects: true, Redirects: []config.DNSRedirect{
+			{Domain: "app.example", Target: "192.0.2.3", Enabled: true},
+		}},
+	}, global, nil, time.Now())
+
+	tests := []struct {
+		group, name string
+		want        string // target, "" for no redirect
+	}{
+		// The group's pattern replaces the global one; the rest fall back
+		{"dev", "api.game.example", "192.0.2.2"},
+		{"dev", "www.game.example", "192.0.2.1"},
+		{"dev", "tracker.example", ""},
+		// Without the global redirects only the group's own apply
+		{"isolated", "app.example", "192.0.2.3"},
+		{"isolated", "www.game.example", ""},
+		{"isolated", "api.game.example", ""},
+	}
+	for _, tt := range tests {
+		var group *clientGroup
+		for _, g := range groups {
+			if g.name == tt.group {
+				group = g
+			}
+		}
+
+		got := ""
+		if result, ok := group.redirects.Match(tt.name + "."); ok {
+			got = result.Value.ipv4[0].String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s redirects to %q, want %q", tt.group, tt.name, got, tt.want)
+		}
+	}
+
+	// PTR names come from the rules a group actually uses
+	isolated := groups[1]
+	if names := isolated.reverse["192.0.2.1"]; len(names) != 0 {
+		t.Errorf("group ignoring global redirects reverses 192.0.2.1 to %v", names)
+	}
+	if names := isolated.reverse["192.0.2.3"]; len(names) != 1 || names[0].name != "app.example." {
+		t.Errorf("192.0.2.3 reverses to %v in its group, want app.example.", names)
+	}
+}
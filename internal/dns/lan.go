@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LANInterface is a network interface other devices can reach Aegis on
+type LANInterface struct {
+	Name string
+	IPv4 net.IP
+	IPv6 net.IP // global or unique local address, nil if the interface has none
+}
+
+// String returns the interface name with its addresses
+func (i *LANInterface) String() string {
+	addresses := []string{i.IPv4.String()}
+	if i.IPv6 != nil {
+		addresses = append(addresses, i.IPv6.String())
+	}
+	return fmt.Sprintf("%s (%s)", i.Name, strings.Join(addresses, ", "))
+}
+
+// LANInterfaces returns the interfaces that are up, aren't loopback and have
+// an IPv4 address, those with private addresses first
+func LANInterfaces() ([]*LANInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+
+	var private, public []*LANInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		lan := &LANInterface{Name: iface.Name}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				if lan.IPv4 == nil {
+					lan.IPv4 = ip4
+				}
+			} else if lan.IPv6 == nil {
+				lan.IPv6 = ipNet.IP
+			}
+		}
+		if lan.IPv4 == nil {
+			continue
+		}
+
+		if lan.IPv4.IsPrivate() {
+			private = append(private, lan)
+		} else {
+			public = append(public, lan)
+		}
+	}
+	return append(private, public...), nil
+}
+
+// SelectLANInterface returns the named interface, or the first usable one
+// when name is empty
+func SelectLANInterface(name string) (*LANInterface, error) {
+	interfaces, err := LANInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no network interface with an IPv4 address is up")
+	}
+	if name == "" {
+		return interfaces[0], nil
+	}
+
+	for _, lan := range interfaces {
+		if lan.Name == name {
+			return lan, nil
+		}
+	}
+	return nil, fmt.Errorf("network interface %s is not up or has no IPv4 address", name)
+}
+
+// rewrite replaces a loopback redirect target with the interface's address of
+// the same family, so other devices connect to this machine instead of
+// themselves. It returns nil for IPv6 loopback when the interface has no IPv6.
+func (i *LANInterface) rewrite(ip net.IP) net.IP {
+	if i == nil || !ip.IsLoopback() {
+		return ip
+	}
+	if ip.To4() != nil {
+		return i.IPv4
+	}
+	return i.IPv6
+}
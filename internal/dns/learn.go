@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+	"golang.org/x/net/publicsuffix"
+)
+
+// LearnedName is a distinct name queried during a learn session
+type LearnedName struct {
+	Name       string // without the trailing dot
+	Types      []string
+	Count      int
+	FirstSeen  time.Time
+	Redirected bool // answered by an existing redirect
+}
+
+// LearnedDomain groups the learned names below one registrable domain
+type LearnedDomain struct {
+	Domain    string // e.g. "epicgames.com" for "ol.epicgames.com"
+	Names     []LearnedName
+	Count     int
+	FirstSeen time.Time
+}
+
+// Learner records every distinct name clients query while learn mode is on
+type Learner struct {
+	mu    sync.Mutex
+	start time.Time
+	names map[string]*LearnedName
+}
+
+// NewLearner creates a learner for a session starting now
+func NewLearner() *Learner {
+	return &Learner{start: time.Now(), names: map[string]*LearnedName{}}
+}
+
+// record notes a query for name. Reverse lookups tell nothing about the
+// hosts a client uses and are left out.
+func (l *Learner) record(name string, qtype uint16, redirected bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || isReverseName(name+".") {
+		return
+	}
+	typ := dns.TypeToString[qtype]
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.names[name]
+	if !ok {
+		entry = &LearnedName{Name: name, FirstSeen: time.Now()}
+		l.names[name] = entry
+	}
+	entry.Count++
+	entry.Redirected = entry.Redirected || redirected
+	for _, existing := range entry.Types {
+		if existing == typ {
+			return
+		}
+	}
+	entry.Types = append(entry.Types, typ)
+}
+
+// Domains returns the learned names grouped by registrable domain, the
+// domains and their names in the order they were first queried
+func (l *Learner) Domains() []LearnedDomain {
+	l.mu.Lock()
+	byDomain := map[string]*LearnedDomain{}
+	for _, entry := range l.names {
+		domain := registrableDomain(entry.Name)
+		group, ok := byDomain[domain]
+		if !ok {
+			group = &LearnedDomain{Domain: domain, FirstSeen: entry.FirstSeen}
+			byDomain[domain] = group
+		}
+		group.Names = append(group.Names, *entry)
+		group.Count += entry.Count
+		if entry.FirstSeen.Before(group.FirstSeen) {
+			group.FirstSeen = entry.FirstSeen
+		}
+	}
+	l.mu.Unlock()
+
+	domains := make([]LearnedDomain, 0, len(byDomain))
+	for _, group := range byDomain {
+		sort.Slice(group.Names, func(i, j int) bool { return group.Names[i].FirstSeen.Before(group.Names[j].FirstSeen) })
+		domains = append(domains, *group)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].FirstSeen.Before(domains[j].FirstSeen) })
+	return domains
+}
+
+// registrableDomain returns the public suffix plus one label of name, or the
+// name itself for suffixes and single-label names
+func registrableDomain(name string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// Suggestions returns wildcard patterns covering the learned names, most
+// specific first: one for the closest parent of all names when there are
+// several, and "**." for the whole registrable domain
+func (d LearnedDomain) Suggestions() []string {
+	var suggestions []string
+	if len(d.Names) > 1 {
+		parent := commonParent(d.Names)
+		if parent != d.Domain && dns.CountLabel(parent) > dns.CountLabel(d.Domain) {
+			pattern := "*." + parent
+			for _, name := range d.Names {
+				if name.Name == parent {
+					pattern = "**." + parent
+					break
+				}
+			}
+			suggestions = append(suggestions, pattern)
+		}
+	}
+	return append(suggestions, "**."+d.Domain)
+}
+
+// commonParent returns the longest name that all names are equal to or below
+func commonParent(names []LearnedName) string {
+	common := dns.SplitDomainName(names[0].Name)
+	for _, name := range names[1:] {
+		labels := dns.SplitDomainName(name.Name)
+		n := 0
+		for n < len(common) && n < len(labels) &&
+			common[len(common)-1-n] == labels[len(labels)-1-n] {
+			n++
+		}
+		common = common[len(common)-n:]
+	}
+	return strings.Join(common, ".")
+}
+
+// Redirect builds a redirect of pattern to target, described with what the
+// session saw of the names it covers
+func (d LearnedDomain) Redirect(pattern, target string) config.DNSRedirect {
+	matcher := NewMatcher[struct{}]()
+	names, count := 0, 0
+	if err := matcher.Insert(pattern, struct{}{}); err == nil {
+		for _, name := range d.Names {
+			if _, ok := matcher.Match(name.Name + "."); ok {
+				names++
+				count += name.Count
+			}
+		}
+	}
+
+	queries := fmt.Sprintf("%d queries", count)
+	if count == 1 {
+		queries = "1 query"
+	}
+	description := fmt.Sprintf("Learned %s: %s", d.FirstSeen.Format("2006-01-02"), queries)
+	if names > 1 {
+		description = fmt.Sprintf("Learned %s: %d names, %s", d.FirstSeen.Format("2006-01-02"), names, queries)
+	}
+	return config.DNSRedirect{
+		Domain:      pattern,
+		Target:      target,
+		Description: description,
+		Enabled:     true,
+	}
+}
+
+// StartLearning makes the running DNS service record every name it is asked
+// for until StopLearning
+func StartLearning() error {
+	if globalDNSService == nil || globalDNSService.server == nil {
+		return fmt.Errorf("DNS service not started")
+	}
+	globalDNSService.server.learner.Store(NewLearner())
+	log.Info("Learn mode on: recording every queried name")
+	return nil
+}
+
+// StopLearning ends learn mode and returns what it recorded
+func StopLearning() []LearnedDomain {
+	if globalDNSService == nil || globalDNSService.server == nil {
+		return nil
+	}
+	learner := globalDNSService.server.learner.Swap(nil)
+	if learner == nil {
+		return nil
+	}
+	domains := learner.Domains()
+	log.Infof("Learn mode off: %d domains queried in %s", len(domains), time.Since(learner.start).Round(time.Second))
+	return domains
+}
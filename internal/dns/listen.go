@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// fallbackPorts are tried when no listen address could be bound and
+// strict_listen is off. The system resolver only ever asks port 53, so these
+// only help clients that are configured with the port by hand.
+var fallbackPorts = []string{"8053", "5353", "9053", "10053"}
+
+// dnsListener is a bound socket the DNS server answers on
+type dnsListener struct {
+	network    string // "udp", "udp4", "tcp6", ...
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+// protocol returns "udp" or "tcp"
+func (l *dnsListener) protocol() string {
+	return l.network[:3]
+}
+
+// addr returns the local address of the socket
+func (l *dnsListener) addr() net.Addr {
+	if l.packetConn != nil {
+		return l.packetConn.LocalAddr()
+	}
+	return l.listener.Addr()
+}
+
+// String returns the protocol and address, e.g. "udp 127.0.0.1:53"
+func (l *dnsListener) String() string {
+	return l.protocol() + " " + l.addr().String()
+}
+
+// close releases the socket
+func (l *dnsListener) close() {
+	if l.packetConn != nil {
+		l.packetConn.Close()
+	} else {
+		l.listener.Close()
+	}
+}
+
+// openListeners returns the sockets to serve DNS on: those passed by systemd
+// socket activation if there are any, otherwise the configured listen
+// addresses. Unless strict_listen is set, addresses that can't be bound are
+// skipped and other ports are tried when none could be bound.
+func (s *Server) openListeners() ([]*dnsListener, error) {
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		log.Infof("Using %d sockets from systemd socket activation", len(inherited))
+		return inherited, nil
+	}
+
+	dnsConfig := config.Config.DNS
+	listeners, err := bindListeners(listenAddresses(dnsConfig, s.lan), dnsConfig.Port, dnsConfig.StrictListen)
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	host := ""
+	if s.lan != nil {
+		host = s.lan.IPv4.String()
+	}
+	for _, port := range fallbackPorts {
+		listeners, _ = bindListeners([]string{net.JoinHostPort(host, port)}, port, false)
+		if len(listeners) > 0 {
+			log.Warnf("No listen address could be bound, DNS is listening on port %s instead. The system resolver only uses port 53; set strict_listen to fail instead", port)
+			return listeners, nil
+		}
+	}
+	return nil, fmt.Errorf("no listen address could be bound")
+}
+
+// listenAddresses returns the configured listen addresses. Without explicit
+// addresses DNS listens on the configured port, on the LAN interface's
+// addresses in LAN mode and on every address otherwise.
+func listenAddresses(dnsConfig config.DNSConfig, lan *LANInterface) []string {
+	if len(dnsConfig.Listen) > 0 {
+		return dnsConfig.Listen
+	}
+	if lan == nil {
+		return []string{":" + dnsConfig.Port}
+	}
+
+	addresses := []string{net.JoinHostPort(lan.IPv4.String(), dnsConfig.Port)}
+	if lan.IPv6 != nil {
+		addresses = append(addresses, net.JoinHostPort(lan.IPv6.String(), dnsConfig.Port))
+	}
+	return addresses
+}
+
+// bindListeners binds every protocol of every address. In strict mode the
+// first failure closes what was bound and is returned; otherwise failures are
+// logged and skipped.
+func bindListeners(addresses []string, defaultPort string, strict bool) ([]*dnsListener, error) {
+	var listeners []*dnsListener
+	for _, value := range addresses {
+		networks, address, err := config.ParseListenAddress(value, defaultPort)
+		if err == nil {
+			for _, network := range networks {
+				var listener *dnsListener
+				if listener, err = bind(network, address); err != nil {
+					break
+				}
+				listeners = append(listeners, listener)
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		if strict {
+			for _, listener := range listeners {
+				listener.close()
+			}
+			return nil, err
+		}
+		log.Warnf("Skipping DNS listen address %s: %v", value, err)
+	}
+	return listeners, nil
+}
+
+// bind opens a socket for network ("udp4", "tcp", ...) on address
+func bind(network, address string) (*dnsListener, error) {
+	if strings.HasPrefix(network, "udp") {
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind UDP %s: %v", address, err)
+		}
+		return &dnsListener{network: network, packetConn: conn}, nil
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind TCP %s: %v", address, err)
+	}
+	return &dnsListener{network: network, listener: listener}, nil
+}
+
+// inheritedListeners returns the sockets passed by systemd socket activation
+// (sd_listen_fds), which lets an unprivileged Aegis serve port 53. Stream
+// sockets are served as TCP and datagram sockets as UDP.
+func inheritedListeners() ([]*dnsListener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are ours now and must not leak into child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []*dnsListener
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+
+		// Both calls duplicate the descriptor, so the file is closed either way
+		if listener, err := net.FileListener(file); err == nil {
+			listeners = append(listeners, &dnsListener{network: "tcp", listener: listener})
+		} else if conn, err := net.FilePacketConn(file); err == nil {
+			listeners = append(listeners, &dnsListener{network: "udp", packetConn: conn})
+		} else {
+			file.Close()
+			for _, listener := range listeners {
+				listener.close()
+			}
+			return nil, fmt.Errorf("inherited socket %s is neither a stream nor a datagram socket", name)
+		}
+		file.Close()
+	}
+	return listeners, nil
+}
+
+// clientHost returns the address local clients reach the DNS server on:
+// the LAN address in LAN mode, otherwise the first IPv4 listener's address
+// (127.0.0.1 for a wildcard), falling back to the first IPv6 listener
+func (s *Server) clientHost() string {
+	if s.lan != nil {
+		return s.lan.IPv4.String()
+	}
+
+	ipv6 := ""
+	for _, listener := range s.listeners {
+		host, _, err := net.SplitHostPort(listener.addr().String())
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			continue
+		case ip.IsUnspecified() && !strings.HasSuffix(listener.network, "6"):
+			return "127.0.0.1"
+		case ip.To4() != nil:
+			return ip.String()
+		case ipv6 == "" && ip.IsUnspecified():
+			ipv6 = "::1"
+		case ipv6 == "":
+			ipv6 = ip.String()
+		}
+	}
+	if ipv6 != "" {
+		return ipv6
+	}
+	return "127.0.0.1"
+}
+
+// port returns the port DNS is served on, as ":53", preferring UDP listeners
+func (s *Server) port() string {
+	port := ""
+	for _, listener := range s.listeners {
+		_, p, err := net.SplitHostPort(listener.addr().String())
+		if err != nil {
+			continue
+		}
+		if listener.protocol() == "udp" {
+			return ":" + p
+		}
+		if port == "" {
+			port = ":" + p
+		}
+	}
+	return port
+}
@@ -0,0 +1,18 @@
+package dns
+
+import (
+	"os"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// TestMain runs the tests against an empty configuration, which tests adjust
+// to what they exercise
+func TestMain(m *testing.M) {
+	config.Config = &config.AppConfig{}
+	config.Config.DNS.Port = "53"
+	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
+}
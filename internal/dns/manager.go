@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -15,6 +16,7 @@ import (
 // Manager handles system DNS configuration across platforms
 type Manager struct {
 	originalDNS map[string][]string // interface -> DNS servers
+	systemDNS   []string            // resolvers in use before we took over
 	ourDNSPort  string              // the port our DNS server is using
 	platform    string
 }
@@ -29,6 +31,8 @@ func NewManager() *Manager {
 
 // GetCurrentDNS retrieves current DNS settings for all active interfaces
 func (dm *Manager) GetCurrentDNS() error {
+	defer dm.captureSystemResolvers()
+
 	switch dm.platform {
 	case "windows":
 		return dm.getCurrentDNSWindows()
@@ -39,10 +43,11 @@ func (dm *Manager) GetCurrentDNS() error {
 	}
 }
 
-// SetDNSToLocal configures system DNS to use our local DNS server
-func (dm *Manager) SetDNSToLocal(port string) error {
+// SetDNSToLocal configures system DNS to use our DNS server at address
+// (an IP without port, "127.0.0.1" unless the server is bound elsewhere)
+func (dm *Manager) SetDNSToLocal(port, address string) error {
 	dm.ourDNSPort = port
-	localDNS := "127.0.0.1" // Only IP address, no port for DNS configuration
+	localDNS := address
 
 	switch dm.platform {
 	case "windows":
@@ -394,6 +399,39 @@ func (dm *Manager) restoreDNSMacOS() error {
 	return nil
 }
 
+// captureSystemResolvers records the resolvers in use before Aegis takes
+// over: the servers set by hand on the interfaces, or else the ones the
+// network assigned, as the system resolver reports them
+func (dm *Manager) captureSystemResolvers() {
+	names := make([]string, 0, len(dm.originalDNS))
+	for name := range dm.originalDNS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var servers []string
+	for _, name := range names {
+		for _, line := range dm.originalDNS[name] {
+			// netsh lines may carry a label before the address
+			if fields := strings.Fields(line); len(fields) > 0 {
+				servers = appendServer(servers, fields[len(fields)-1])
+			}
+		}
+	}
+	if len(servers) == 0 || allLoopback(servers) {
+		servers = readSystemResolvers()
+	}
+
+	dm.systemDNS = servers
+	log.Debugf("System resolvers: %v", servers)
+}
+
+// SystemResolvers returns the resolvers the system used before Aegis took
+// over, as captured by GetCurrentDNS
+func (dm *Manager) SystemResolvers() []string {
+	return dm.systemDNS
+}
+
 // GetOriginalDNS returns the original DNS settings
 func (dm *Manager) GetOriginalDNS() map[string][]string {
 	return dm.originalDNS
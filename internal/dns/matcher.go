@@ -0,0 +1,351 @@
+package dns
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Matcher is a label-based suffix trie that maps domain patterns to values.
+//
+// Supported pattern forms:
+//
+//	example.com          exact name only
+//	*.example.com        any name below example.com (one or more labels), not the apex
+//	**.example.com       example.com itself and any name below it
+//	api-*.example.com    glob within a single label (path.Match syntax)
+//	!pattern             exclusion: a query whose best match is negative is not matched
+//
+// When several patterns match, the most specific one wins: more matched labels
+// beat fewer, an exact terminal beats "*" which beats "**", literal labels beat
+// globs, and longer glob literals beat shorter ones. A negative pattern wins a
+// tie against an otherwise identical positive one. Lookup walks the query's
+// labels from the root, so it costs O(labels) rather than O(patterns).
+type Matcher[T any] struct {
+	root     *trieNode[T]
+	patterns []string
+}
+
+// MatchResult describes the rule that matched a query
+type MatchResult[T any] struct {
+	Value   T
+	Pattern string // the pattern as written in configuration
+}
+
+// MatchCandidate is one of the patterns matching a query, as listed by MatchAll
+type MatchCandidate struct {
+	Pattern string
+	Kind    string // "exact", "wildcard" (*.) or "apex wildcard" (**.)
+	Negated bool
+}
+
+// trieNode is one label position in the trie
+type trieNode[T any] struct {
+	children map[string]*trieNode[T] // literal labels
+	globs    []*globNode[T]          // glob labels such as "api-*"
+	exact    *matchEntry[T]          // pattern ending exactly at this node
+	wildcard *matchEntry[T]          // "*." pattern rooted at this node
+	apex     *matchEntry[T]          // "**." pattern rooted at this node
+}
+
+// globNode is a child reached through a glob label
+type globNode[T any] struct {
+	pattern  string
+	literals int // number of non-wildcard characters, used for precedence
+	node     *trieNode[T]
+}
+
+// matchEntry is a pattern stored at a trie node
+type matchEntry[T any] struct {
+	value    T
+	pattern  string
+	negated  bool
+	literal  int // number of literal labels on the path
+	globLits int // literal characters inside glob labels on the path
+	order    int // insertion order, used as the final tie-breaker
+}
+
+// match kinds in increasing order of precedence
+const (
+	kindApex = iota + 1
+	kindWildcard
+	kindExact
+)
+
+// candidate is a matching entry together with its precedence information
+type candidate[T any] struct {
+	entry *matchEntry[T]
+	depth int
+	kind  int
+}
+
+// NewMatcher creates an empty matcher
+func NewMatcher[T any]() *Matcher[T] {
+	return &Matcher[T]{root: newTrieNode[T]()}
+}
+
+func newTrieNode[T any]() *trieNode[T] {
+	return &trieNode[T]{children: make(map[string]*trieNode[T])}
+}
+
+// splitLabels normalizes a domain name and returns its labels from the root down
+func splitLabels(name string) []string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// Insert adds a pattern to the matcher. Negative patterns ("!…") store no value.
+func (m *Matcher[T]) Insert(pattern string, value T) error {
+	original := strings.TrimSpace(pattern)
+	negated := strings.HasPrefix(original, "!")
+	body := strings.TrimPrefix(original, "!")
+
+	labels := splitLabels(body)
+	if len(labels) == 0 {
+		return fmt.Errorf("empty domain pattern %q", original)
+	}
+
+	kind := kindExact
+	switch labels[len(labels)-1] {
+	case "**":
+		kind = kindApex
+		labels = labels[:len(labels)-1]
+	case "*":
+		kind = kindWildcard
+		labels = labels[:len(labels)-1]
+	}
+	if len(labels) == 0 && kind != kindExact {
+		return fmt.Errorf("pattern %q matches every domain", original)
+	}
+
+	node := m.root
+	literal, globLits := 0, 0
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("pattern %q contains an empty label", original)
+		}
+		if label == "**" {
+			return fmt.Errorf("pattern %q: ** is only allowed as the leftmost label", original)
+		}
+
+		if !strings.ContainsAny(label, "*?[") {
+			child, ok := node.children[label]
+			if !ok {
+				child = newTrieNode[T]()
+				node.children[label] = child
+			}
+			node = child
+			literal++
+			continue
+		}
+
+		if _, err := path.Match(label, ""); err != nil {
+			return fmt.Errorf("pattern %q: invalid glob label %q", original, label)
+		}
+		node = node.globChild(label)
+		globLits += globLiterals(label)
+	}
+
+	entry := &matchEntry[T]{
+		value:    value,
+		pattern:  original,
+		negated:  negated,
+		literal:  literal,
+		globLits: globLits,
+		order:    len(m.patterns),
+	}
+
+	var slot **matchEntry[T]
+	switch kind {
+	case kindApex:
+		slot = &node.apex
+	case kindWildcard:
+		slot = &node.wildcard
+	default:
+		slot = &node.exact
+	}
+
+	// Duplicate patterns are rejected. An exclusion for the same pattern as a
+	// positive entry wins whichever of them is inserted first, so the positive
+	// one is rejected or dropped and never counts as a pattern.
+	switch existing := *slot; {
+	case existing == nil:
+		*slot = entry
+	case existing.negated == negated:
+		return fmt.Errorf("duplicate pattern %q (already defined as %q)", original, existing.pattern)
+	case !negated:
+		return fmt.Errorf("pattern %q is shadowed by the exclusion %q", original, existing.pattern)
+	default:
+		*slot = entry
+		m.removePattern(existing.pattern)
+	}
+
+	m.patterns = append(m.patterns, original)
+	return nil
+}
+
+// removePattern drops a pattern whose entry was replaced from the pattern list
+func (m *Matcher[T]) removePattern(pattern string) {
+	for i, p := range m.patterns {
+		if p == pattern {
+			m.patterns = append(m.patterns[:i], m.patterns[i+1:]...)
+			return
+		}
+	}
+}
+
+// globChild returns the child node for a glob label, creating it if needed
+func (n *trieNode[T]) globChild(label string) *trieNode[T] {
+	for _, g := range n.globs {
+		if g.pattern == label {
+			return g.node
+		}
+	}
+
+	g := &globNode[T]{pattern: label, literals: globLiterals(label), node: newTrieNode[T]()}
+	n.globs = append(n.globs, g)
+
+	// Keep the most specific globs first so matching is deterministic
+	sort.SliceStable(n.globs, func(i, j int) bool {
+		if n.globs[i].literals != n.globs[j].literals {
+			return n.globs[i].literals > n.globs[j].literals
+		}
+		return n.globs[i].pattern < n.globs[j].pattern
+	})
+	return g.node
+}
+
+// globLiterals counts the non-wildcard characters in a glob label
+func globLiterals(label string) int {
+	count := 0
+	for _, r := range label {
+		if r != '*' && r != '?' {
+			count++
+		}
+	}
+	return count
+}
+
+// Match returns the most specific pattern matching name. It reports false if
+// nothing matched or the best match is an exclusion.
+func (m *Matcher[T]) Match(name string) (MatchResult[T], bool) {
+	best, ok := m.best(name)
+	if !ok || best.entry.negated {
+		return MatchResult[T]{}, false
+	}
+	return MatchResult[T]{Value: best.entry.value, Pattern: best.entry.pattern}, true
+}
+
+// MatchAll returns every pattern matching name, exclusions included, from the
+// most specific one, which Match would pick, to the least specific
+func (m *Matcher[T]) MatchAll(name string) []MatchCandidate {
+	var candidates []candidate[T]
+	m.walk(splitLabels(name), func(c candidate[T]) {
+		candidates = append(candidates, c)
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].beats(candidates[j])
+	})
+
+	matches := make([]MatchCandidate, 0, len(candidates))
+	for _, c := range candidates {
+		kind := "exact"
+		switch c.kind {
+		case kindWildcard:
+			kind = "wildcard"
+		case kindApex:
+			kind = "apex wildcard"
+		}
+		matches = append(matches, MatchCandidate{Pattern: c.entry.pattern, Kind: kind, Negated: c.entry.negated})
+	}
+	return matches
+}
+
+// best finds the highest-precedence candidate for name, including exclusions
+func (m *Matcher[T]) best(name string) (candidate[T], bool) {
+	var best candidate[T]
+	found := false
+
+	m.walk(splitLabels(name), func(c candidate[T]) {
+		if !found || c.beats(best) {
+			best = c
+			found = true
+		}
+	})
+
+	return best, found
+}
+
+// walk visits every entry that matches labels
+func (m *Matcher[T]) walk(labels []string, visit func(candidate[T])) {
+	if len(labels) == 0 {
+		return
+	}
+	m.root.walk(labels, 0, visit)
+}
+
+func (n *trieNode[T]) walk(labels []string, depth int, visit func(candidate[T])) {
+	remaining := len(labels) - depth
+
+	if n.apex != nil {
+		visit(candidate[T]{entry: n.apex, depth: depth, kind: kindApex})
+	}
+	if remaining == 0 {
+		if n.exact != nil {
+			visit(candidate[T]{entry: n.exact, depth: depth, kind: kindExact})
+		}
+		return
+	}
+	if n.wildcard != nil {
+		visit(candidate[T]{entry: n.wildcard, depth: depth, kind: kindWildcard})
+	}
+
+	label := labels[depth]
+	if child, ok := n.children[label]; ok {
+		child.walk(labels, depth+1, visit)
+	}
+	for _, g := range n.globs {
+		if ok, _ := path.Match(g.pattern, label); ok {
+			g.node.walk(labels, depth+1, visit)
+		}
+	}
+}
+
+// beats reports whether c takes precedence over other
+func (c candidate[T]) beats(other candidate[T]) bool {
+	if c.depth != other.depth {
+		return c.depth > other.depth
+	}
+	if c.kind != other.kind {
+		return c.kind > other.kind
+	}
+	if c.entry.literal != other.entry.literal {
+		return c.entry.literal > other.entry.literal
+	}
+	if c.entry.globLits != other.entry.globLits {
+		return c.entry.globLits > other.entry.globLits
+	}
+	if c.entry.negated != other.entry.negated {
+		return c.entry.negated
+	}
+	return c.entry.order < other.entry.order
+}
+
+// Len returns the number of patterns in the matcher
+func (m *Matcher[T]) Len() int {
+	return len(m.patterns)
+}
+
+// Patterns returns the patterns in insertion order
+func (m *Matcher[T]) Patterns() []string {
+	return append([]string(nil), m.patterns...)
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcherPrecedence(t *testing.T) {
+	patterns := []string{
+		"example.com",
+		"*.example.com",
+		"**.example.com",
+		"api.example.com",
+		"api-*.example.com",
+		"api-e?.example.com",
+		"*.svc.example.com",
+		"!*.internal.example.com",
+		"!status.example.com",
+		"**.other.org",
+		"*.deep.other.org",
+		"!x.deep.other.org",
+	}
+
+	tests := []struct {
+		name string
+		want string // matching pattern, "" for no match
+	}{
+		// exact beats the wildcards at the same depth
+		{"example.com", "example.com"},
+		{"api.example.com", "api.example.com"},
+		// "*" beats "**" at the same depth
+		{"www.example.com", "*.example.com"},
+		// deeper matches beat shallower ones
+		{"a.svc.example.com", "*.svc.example.com"},
+		{"a.b.svc.example.com", "*.svc.example.com"},
+		// literal labels beat globs, longer glob literals beat shorter ones
+		{"api-eu.example.com", "api-e?.example.com"},
+		{"api-us.example.com", "api-*.example.com"},
+		// exclusions
+		{"status.example.com", ""},
+		{"db.internal.example.com", ""},
+		{"internal.example.com", "*.example.com"},
+		// "**" matches the apex, "*" does not
+		{"other.org", "**.other.org"},
+		{"deep.other.org", "**.other.org"},
+		{"y.deep.other.org", "*.deep.other.org"},
+		{"x.deep.other.org", ""},
+		// labels are matched whole and case-insensitively
+		{"evilexample.com", ""},
+		{"WWW.Example.COM.", "*.example.com"},
+		{"com", ""},
+	}
+
+	m := NewMatcher[string]()
+	for _, p := range patterns {
+		if err := m.Insert(p, p); err != nil {
+			t.Fatalf("Insert(%q): %v", p, err)
+		}
+	}
+
+	for _, tt := range tests {
+		got, ok := m.Match(tt.name)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("Match(%q) = %q, want no match", tt.name, got.Pattern)
+		case tt.want != "" && !ok:
+			t.Errorf("Match(%q): no match, want %q", tt.name, tt.want)
+		case ok && (got.Pattern != tt.want || got.Value != tt.want):
+			t.Errorf("Match(%q) = %q, want %q", tt.name, got.Pattern, tt.want)
+		}
+	}
+}
+
+func TestMatcherExclusionOrder(t *testing.T) {
+	for _, order := range [][]string{
+		{"*.example.com", "!*.example.com"},
+		{"!*.example.com", "*.example.com"},
+	} {
+		m := NewMatcher[int]()
+		for _, p := range order {
+			err := m.Insert(p, 1)
+			// Only a positive pattern arriving after its exclusion is rejected
+			if shadowed := p == order[1] && !strings.HasPrefix(p, "!"); shadowed != (err != nil) {
+				t.Errorf("%v: Insert(%q) = %v", order, p, err)
+			}
+		}
+		if got, ok := m.Match("www.example.com"); ok {
+			t.Errorf("%v: www.example.com matched %q, want excluded", order, got.Pattern)
+		}
+		// The shadowed positive pattern is never counted
+		if patterns := m.Patterns(); m.Len() != 1 || patterns[0] != "!*.example.com" {
+			t.Errorf("%v: Patterns() = %v, want only the exclusion", order, patterns)
+		}
+	}
+}
+
+func TestMatcherInsertErrors(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		err      string
+	}{
+		{[]string{""}, "empty domain pattern"},
+		{[]string{"*"}, "matches every domain"},
+		{[]string{"**"}, "matches every domain"},
+		{[]string{"a..example.com"}, "empty label"},
+		{[]string{"a.**.example.com"}, "only allowed as the leftmost label"},
+		{[]string{"[a.example.com"}, "invalid glob label"},
+		{[]string{"example.com", "Example.com."}, "duplicate pattern"},
+		{[]string{"!example.com", "!example.com"}, "duplicate pattern"},
+	}
+
+	for _, tt := range tests {
+		m := NewMatcher[int]()
+		var err error
+		for _, p := range tt.patterns {
+			if err = m.Insert(p, 0); err != nil {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Insert(%q) = %v, want error containing %q", tt.patterns, err, tt.err)
+		}
+	}
+}
+
+func TestMatcherMatchAll(t *testing.T) {
+	m := NewMatcher[int]()
+	for _, p := range []string{"**.example.com", "*.example.com", "!*.x.example.com", "a.x.example.com"} {
+		if err := m.Insert(p, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := m.MatchAll("b.x.example.com")
+	want := []MatchCandidate{
+		{Pattern: "!*.x.example.com", Kind: "wildcard", Negated: true},
+		{Pattern: "*.example.com", Kind: "wildcard"},
+		{Pattern: "**.example.com", Kind: "apex wildcard"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("MatchAll = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("MatchAll[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+const (
+	// neighborTableTTL is how long the ARP/neighbor table is trusted, so an
+	// address handed to another device moves to its group within a minute
+	neighborTableTTL = time.Minute
+	// neighborRefreshInterval is how often an unknown client may trigger a reload
+	neighborRefreshInterval = 5 * time.Second
+)
+
+// neighborTable maps LAN client IPs to hardware addresses from the system's
+// ARP/neighbor table. A client that just queried us has an entry there.
+// Queries only read the last snapshot; reading the system table runs a
+// command, so it is refreshed in the background and a client new to the
+// table is matched from its next query on.
+type neighborTable struct {
+	snapshot   atomic.Pointer[neighborSnapshot]
+	refreshing atomic.Bool
+}
+
+// neighborSnapshot is the neighbor table as read at one point in time
+type neighborSnapshot struct {
+	macs   map[string]string // IP -> normalized MAC
+	loaded time.Time
+}
+
+// lookup returns the hardware address of ip, or "" if it is unknown
+func (t *neighborTable) lookup(ip net.IP) string {
+	snapshot := t.snapshot.Load()
+	if snapshot == nil {
+		t.refresh()
+		return ""
+	}
+
+	mac, ok := snapshot.macs[ip.String()]
+	if age := time.Since(snapshot.loaded); age >= neighborTableTTL || (!ok && age >= neighborRefreshInterval) {
+		t.refresh()
+	}
+	return mac
+}
+
+// refresh rereads the system table in the background unless a refresh is
+// already running
+func (t *neighborTable) refresh() {
+	if !t.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer t.refreshing.Store(false)
+		t.load()
+	}()
+}
+
+// load reads the system table and replaces the snapshot
+func (t *neighborTable) load() {
+	macs, err := readNeighbors()
+	if err != nil {
+		log.Debugf("Failed to read the neighbor table: %v", err)
+		// Keep the old entries, but don't retry before the next interval
+		if old := t.snapshot.Load(); old != nil {
+			macs = old.macs
+		}
+	}
+	t.snapshot.Store(&neighborSnapshot{macs: macs, loaded: time.Now()})
+}
+
+// readNeighbors reads the system's ARP/neighbor table
+func readNeighbors() (map[string]string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		if out, err := exec.Command("ip", "neigh", "show").Output(); err == nil {
+			return parseNeighbors(string(out)), nil
+		}
+		data, err := os.ReadFile("/proc/net/arp")
+		if err != nil {
+			return nil, err
+		}
+		return parseNeighbors(string(data)), nil
+	case "darwin":
+		out, err := exec.Command("arp", "-an").Output()
+		if err != nil {
+			return nil, err
+		}
+		neighbors := parseNeighbors(string(out))
+		if out, err := exec.Command("ndp", "-an").Output(); err == nil {
+			for ip, mac := range parseNeighbors(string(out)) {
+				neighbors[ip] = mac
+			}
+		}
+		return neighbors, nil
+	default:
+		out, err := exec.Command("arp", "-a").Output()
+		if err != nil {
+			return nil, err
+		}
+		return parseNeighbors(string(out)), nil
+	}
+}
+
+// parseNeighbors extracts IP and MAC pairs from the output of "ip neigh",
+// "arp -a", "ndp -an" or /proc/net/arp: every line holding both an IP
+// address and a hardware address
+func parseNeighbors(output string) map[string]string {
+	neighbors := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		var ip net.IP
+		var mac net.HardwareAddr
+		for _, field := range strings.Fields(line) {
+			field = strings.Trim(field, "()")
+			if host, _, ok := strings.Cut(field, "%"); ok {
+				field = host // "fe80::1%en0"
+			}
+
+			if parsed := net.ParseIP(field); parsed != nil {
+				if ip == nil {
+					ip = parsed
+				}
+				continue
+			}
+			if parsed, err := config.ParseMAC(field); err == nil && mac == nil {
+				mac = parsed
+			}
+		}
+
+		if ip == nil || mac == nil || isZeroMAC(mac) {
+			continue
+		}
+		neighbors[ip.String()] = mac.String()
+	}
+	return neighbors
+}
+
+// isZeroMAC reports whether mac is all zeros, as incomplete ARP entries are
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
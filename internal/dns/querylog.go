@@ -0,0 +1,495 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// queryLogTimeFormat is the timestamp appended to rotated query log files
+const queryLogTimeFormat = "20060102-150405.000"
+
+// queryLogRotateRetry is how long logging continues in the current file
+// after a failed rotation before it is tried again
+const queryLogRotateRetry = time.Minute
+
+// QueryLogEntry is one line of the query log
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"protocol"`
+	Name      string    `json:"qname"`
+	Type      string    `json:"qtype"`
+	Rule      string    `json:"rule,omitempty"`         // matched redirect pattern
+	Group     string    `json:"client_group,omitempty"` // client group whose redirects applied
+	Blocked   string    `json:"blocked,omitempty"`      // block list that answered
+	Local     string    `json:"local,omitempty"`        // reverse lookup answered locally: "host" or "private"
+	Answer    []string  `json:"answer,omitempty"`       // "TYPE data" per answer record
+	Upstream  string    `json:"upstream,omitempty"`     // resolver that answered a forwarded query
+	Zone      string    `json:"forward_zone,omitempty"` // forward zone that chose the resolver
+	Cached    bool      `json:"cached,omitempty"`
+	ACL       string    `json:"acl,omitempty"`    // ACL action other than allow
+	DNSSEC    string    `json:"dnssec,omitempty"` // validation result of a forwarded answer
+	LatencyMs float64   `json:"latency_ms"`
+	Rcode     string    `json:"rcode"`
+}
+
+// String formats the entry as a single human-readable line
+func (e QueryLogEntry) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-15s %-5s %-6s %s", e.Time.Local().Format("15:04:05.000"), e.Client, e.Protocol, e.Type, e.Name)
+
+	if len(e.Answer) > 0 {
+		fmt.Fprintf(&b, " -> %s", strings.Join(e.Answer, ", "))
+	}
+	b.WriteString(" " + e.Rcode)
+
+	switch {
+	case e.Rule != "" && e.Group != "":
+		fmt.Fprintf(&b, " [redirect %s for %s]", e.Rule, e.Group)
+	case e.Rule != "":
+		fmt.Fprintf(&b, " [redirect %s]", e.Rule)
+	case e.Blocked != "":
+		fmt.Fprintf(&b, " [blocked by %s]", e.Blocked)
+	case e.Local != "":
+		fmt.Fprintf(&b, " [local %s]", e.Local)
+	case e.Cached:
+		b.WriteString(" [cache]")
+	case e.Zone != "":
+		fmt.Fprintf(&b, " [%s via %s]", e.Upstream, e.Zone)
+	case e.Upstream != "":
+		fmt.Fprintf(&b, " [%s]", e.Upstream)
+	case e.ACL != "":
+		fmt.Fprintf(&b, " [acl %s]", e.ACL)
+	}
+
+	fmt.Fprintf(&b, " %.1fms", e.LatencyMs)
+	return b.String()
+}
+
+// queryContext collects what happened while answering a single query. It is
+// threaded through resolve so the query log sees which path produced the answer.
+type queryContext struct {
+	client      string
+	protocol    string
+	start       time.Time
+	rule        string // first redirect pattern that matched
+	blocked     string // block list source that answered
+	local       string // source of a locally answered reverse lookup
+	upstream    string
+	forwardZone string
+	cached      bool
+	acl         string       // ACL action applied, empty when allowed
+	dnssec      string       // validation result, empty when not validated
+	group       *clientGroup // client group of the client, nil if none
+	trace       *QueryTrace  // decisions of a traced query, nil otherwise
+}
+
+// newQueryContext starts tracking a query from client over protocol
+func newQueryContext(client, protocol string) *queryContext {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return &queryContext{client: client, protocol: protocol, start: time.Now()}
+}
+
+// groupName returns the name of the client's group, empty if it is in none
+func (qc *queryContext) groupName() string {
+	if qc.group == nil {
+		return ""
+	}
+	return qc.group.name
+}
+
+// entries builds one log entry per question of r; resp is nil for dropped queries
+func (qc *queryContext) entries(r, resp *dns.Msg) []QueryLogEntry {
+	var answer []string
+	rcode := "DROPPED"
+	if resp != nil {
+		for _, rr := range resp.Answer {
+			data := strings.TrimPrefix(rr.String(), rr.Header().String())
+			answer = append(answer, dns.TypeToString[rr.Header().Rrtype]+" "+data)
+		}
+		rcode = dns.RcodeToString[resp.Rcode]
+	}
+
+	latency := float64(time.Since(qc.start).Microseconds()) / 1000
+	entries := make([]QueryLogEntry, 0, len(r.Question))
+	for _, q := range r.Question {
+		entries = append(entries, QueryLogEntry{
+			Time:      qc.start,
+			Client:    qc.client,
+			Protocol:  qc.protocol,
+			Name:      strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+			Type:      dns.TypeToString[q.Qtype],
+			Rule:      qc.rule,
+			Group:     qc.groupName(),
+			Blocked:   qc.blocked,
+			Local:     qc.local,
+			Answer:    answer,
+			Upstream:  qc.upstream,
+			Zone:      qc.forwardZone,
+			Cached:    qc.cached,
+			ACL:       qc.acl,
+			DNSSEC:    qc.dnssec,
+			LatencyMs: latency,
+			Rcode:     rcode,
+		})
+	}
+	return entries
+}
+
+// QueryLog appends entries to a JSONL file, rotating it by size and age
+type QueryLog struct {
+	mu sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file         *os.File
+	size         int64
+	started      time.Time // time of the file's first entry
+	rotateFailed time.Time // time of the last failed rotation
+}
+
+// NewQueryLog opens the configured query log for appending
+func NewQueryLog(cfg config.QueryLogConfig) (*QueryLog, error) {
+	maxAge, _ := config.ParseDuration(cfg.RotateInterval)
+
+	l := &QueryLog{
+		path:       cfg.Path,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxAge:     maxAge,
+		maxBackups: cfg.MaxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens or creates the current log file
+func (l *QueryLog) open() error {
+	if dir := filepath.Dir(l.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create query log directory: %v", err)
+		}
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open query log: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat query log: %v", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.started = time.Now()
+	if l.size > 0 {
+		// Age an existing file from its first entry, so restarts don't postpone rotation
+		if first, err := firstEntryTime(l.path); err == nil {
+			l.started = first
+		}
+	}
+	return nil
+}
+
+// firstEntryTime reads the timestamp of the first entry in a log file
+func firstEntryTime(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return time.Time{}, err
+	}
+
+	var entry QueryLogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return time.Time{}, err
+	}
+	return entry.Time, nil
+}
+
+// Record appends entries to the log
+func (l *QueryLog) Record(entries ...QueryLogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("query log is closed")
+	}
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode query log entry: %v", err)
+		}
+		line = append(line, '\n')
+
+		if l.shouldRotate(int64(len(line))) {
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+
+		n, err := l.file.Write(line)
+		l.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("failed to write query log: %v", err)
+		}
+	}
+	return nil
+}
+
+// shouldRotate reports whether writing n more bytes should start a new file
+func (l *QueryLog) shouldRotate(n int64) bool {
+	if l.size == 0 || time.Since(l.rotateFailed) < queryLogRotateRetry {
+		return false
+	}
+	if l.maxSize > 0 && l.size+n > l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.started) >= l.maxAge
+}
+
+// rotate moves the current file aside and starts a new one; the caller holds
+// l.mu. If the file can't be moved, logging continues in it.
+func (l *QueryLog) rotate() error {
+	// Windows can't rename an open file
+	l.file.Close()
+	l.file = nil
+
+	ext := filepath.Ext(l.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(l.path, ext), time.Now().Format(queryLogTimeFormat), ext)
+	if err := os.Rename(l.path, rotated); err != nil {
+		l.rotateFailed = time.Now()
+		if openErr := l.open(); openErr != nil {
+			return fmt.Errorf("failed to rotate query log: %v; %v", err, openErr)
+		}
+		log.Warnf("Failed to rotate query log, retrying in %s: %v", queryLogRotateRetry, err)
+		return nil
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.pruneBackups()
+	return nil
+}
+
+// pruneBackups deletes the oldest rotated files beyond maxBackups
+func (l *QueryLog) pruneBackups() {
+	if l.maxBackups <= 0 {
+		return
+	}
+
+	backups := queryLogBackups(l.path)
+	for len(backups) > l.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// queryLogBackups returns the rotated files of the log at path, oldest first
+func queryLogBackups(path string) []string {
+	ext := filepath.Ext(path)
+	matches, _ := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	// The timestamp suffix sorts chronologically
+	sort.Strings(matches)
+	return matches
+}
+
+// Path returns the current log file
+func (l *QueryLog) Path() string {
+	return l.path
+}
+
+// Close closes the log file
+func (l *QueryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// QueryLogFilter selects query log entries; zero fields match everything
+type QueryLogFilter struct {
+	Domain     *Matcher[struct{}] // domain patterns, as used by redirects
+	Type       string
+	Client     string
+	Rcode      string
+	Redirected bool // only queries answered by a redirect
+	Blocked    bool // only queries answered by a block list
+	Since      time.Time
+}
+
+// Match reports whether entry passes the filter
+func (f QueryLogFilter) Match(entry QueryLogEntry) bool {
+	if f.Domain != nil {
+		if _, ok := f.Domain.Match(entry.Name); !ok {
+			return false
+		}
+	}
+	if f.Type != "" && !strings.EqualFold(entry.Type, f.Type) {
+		return false
+	}
+	if f.Client != "" && entry.Client != f.Client {
+		return false
+	}
+	if f.Rcode != "" && !strings.EqualFold(entry.Rcode, f.Rcode) {
+		return false
+	}
+	if f.Redirected && entry.Rule == "" {
+		return false
+	}
+	if f.Blocked && entry.Blocked == "" {
+		return false
+	}
+	return f.Since.IsZero() || !entry.Time.Before(f.Since)
+}
+
+// ReadQueryLog returns the entries of the log at path that pass filter, oldest
+// first. With includeRotated the rotated files are read as well.
+func ReadQueryLog(path string, includeRotated bool, filter QueryLogFilter) ([]QueryLogEntry, error) {
+	files := []string{path}
+	if includeRotated {
+		files = append(queryLogBackups(path), path)
+	}
+
+	var entries []QueryLogEntry
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) && name == path {
+				continue
+			}
+			return nil, fmt.Errorf("failed to open query log: %v", err)
+		}
+
+		_, err = readQueryLogEntries(file, func(entry QueryLogEntry) {
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		})
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readQueryLogEntries decodes complete lines from r, skipping malformed ones,
+// and returns the number of bytes consumed
+func readQueryLogEntries(r io.Reader, fn func(QueryLogEntry)) (int64, error) {
+	reader := bufio.NewReader(r)
+	var consumed int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written; leave it for the next read
+			return consumed, nil
+		}
+		if err != nil {
+			return consumed, fmt.Errorf("failed to read query log: %v", err)
+		}
+		consumed += int64(len(line))
+
+		var entry QueryLogEntry
+		if json.Unmarshal(line, &entry) == nil {
+			fn(entry)
+		}
+	}
+}
+
+// FollowQueryLog calls fn for every entry appended to the log at path from now
+// on, following rotations, until stop is closed
+func FollowQueryLog(path string, filter QueryLogFilter, stop <-chan struct{}, fn func(QueryLogEntry)) error {
+	var file *os.File
+	var offset int64
+	tailing := true // only the file that exists when we start is read from its end
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if file == nil {
+			if f, err := os.Open(path); err == nil {
+				file = f
+				if info, err := f.Stat(); err == nil && tailing {
+					offset = info.Size()
+				}
+			}
+			tailing = false
+		}
+
+		if file != nil {
+			// A new file at path means the log rotated; finish reading the old one first
+			current, statErr := os.Stat(path)
+			opened, _ := file.Stat()
+			rotated := statErr == nil && opened != nil && !os.SameFile(current, opened)
+
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to read query log: %v", err)
+			}
+			n, err := readQueryLogEntries(file, func(entry QueryLogEntry) {
+				if filter.Match(entry) {
+					fn(entry)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			offset += n
+
+			if rotated {
+				file.Close()
+				file = nil
+				offset = 0
+				if f, err := os.Open(path); err == nil {
+					file = f
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// countLines returns the number of entries in a log file
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// expire makes the current log file old enough to rotate
+func expire(l *QueryLog) {
+	l.mu.Lock()
+	l.started = l.started.Add(-2 * time.Hour)
+	l.mu.Unlock()
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	l, err := NewQueryLog(config.QueryLogConfig{Path: path, RotateInterval: "1h", MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	entry := QueryLogEntry{Time: time.Now(), Name: "example.com.", Type: "A"}
+	for i := 0; i < 3; i++ {
+		if err := l.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+		expire(l)
+		// Backups are named by time in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := l.Record(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("current file has %d entries after rotating, want 1", n)
+	}
+	if backups := queryLogBackups(path); len(backups) != 2 {
+		t.Errorf("kept backups %v, want the newest 2", backups)
+	}
+}
+
+func TestQueryLogRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	l, err := NewQueryLog(config.QueryLogConfig{Path: path, RotateInterval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	entry := QueryLogEntry{Time: time.Now(), Name: "example.com.", Type: "A"}
+	if err := l.Record(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming fails once the file is gone; logging must go on in a new one
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expire(l)
+	for i := 0; i < 2; i++ {
+		if err := l.Record(entry); err != nil {
+			t.Fatalf("Record after a failed rotation: %v", err)
+		}
+	}
+
+	if n := countLines(t, path); n != 2 {
+		t.Errorf("reopened file has %d entries, want 2", n)
+	}
+	if backups := queryLogBackups(path); len(backups) != 0 {
+		t.Errorf("failed rotation left backups %v", backups)
+	}
+}
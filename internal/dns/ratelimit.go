@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+const (
+	// rateSweepInterval is how often idle buckets are forgotten
+	rateSweepInterval = 10 * time.Second
+	// rateIdleTimeout is how long a bucket may stay unused before it is forgotten
+	rateIdleTimeout = time.Minute
+)
+
+// rateDecision is what to do with a response under response rate limiting
+type rateDecision int
+
+const (
+	rateAllow rateDecision = iota
+	rateDrop
+	rateSlip
+)
+
+// tokenBucket refills at a fixed rate up to a burst size
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	drops  int // responses limited since the bucket last had a token, for slip
+}
+
+// take removes a token if one is available
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimiter implements response rate limiting (RRL) for UDP answers and
+// per-client query quotas. Loopback clients are never limited.
+type RateLimiter struct {
+	mu sync.Mutex
+
+	responseRate float64
+	slip         int
+	v4Mask       net.IPMask
+	v6Mask       net.IPMask
+	queryRate    float64
+	burst        float64
+
+	responses map[string]*tokenBucket // client network + response class
+	clients   map[string]*tokenBucket // client IP
+	lastSweep time.Time
+
+	dropped, slipped, quotaExceeded uint64
+}
+
+// NewRateLimiter creates a rate limiter from configuration
+func NewRateLimiter(cfg config.RateLimitConfig) *RateLimiter {
+	burst := float64(cfg.Burst)
+	if burst < float64(cfg.QueriesPerSecond) {
+		burst = float64(cfg.QueriesPerSecond)
+	}
+
+	return &RateLimiter{
+		responseRate: float64(cfg.ResponsesPerSecond),
+		slip:         cfg.Slip,
+		v4Mask:       net.CIDRMask(cfg.IPv4PrefixLength, 32),
+		v6Mask:       net.CIDRMask(cfg.IPv6PrefixLength, 128),
+		queryRate:    float64(cfg.QueriesPerSecond),
+		burst:        burst,
+		responses:    make(map[string]*tokenBucket),
+		clients:      make(map[string]*tokenBucket),
+	}
+}
+
+// allowQuery charges a query against the client's quota
+func (l *RateLimiter) allowQuery(client string) bool {
+	if l.queryRate <= 0 || isLoopbackClient(client) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket := l.clients[client]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		l.clients[client] = bucket
+	}
+	if bucket.take(now, l.queryRate, l.burst) {
+		return true
+	}
+	l.quotaExceeded++
+	return false
+}
+
+// checkResponse decides whether a UDP response may be sent. Identical
+// responses to one client network are limited, so a spoofed victim address
+// can't be flooded with amplified answers; every slip-th limited response is
+// sent truncated so a real client can retry over TCP. Clients presenting a
+// valid DNS cookie have proven their address and are exempt.
+func (l *RateLimiter) checkResponse(client string, r, resp *dns.Msg) rateDecision {
+	if l.responseRate <= 0 || isLoopbackClient(client) || hasValidCookie(r, client) {
+		return rateAllow
+	}
+
+	network := l.network(client)
+	if network == "" {
+		return rateAllow
+	}
+	key := network + "|" + responseClass(resp)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket := l.responses[key]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		l.responses[key] = bucket
+	}
+	if bucket.take(now, l.responseRate, l.responseRate) {
+		bucket.drops = 0
+		return rateAllow
+	}
+
+	bucket.drops++
+	if l.slip > 0 && bucket.drops%l.slip == 0 {
+		l.slipped++
+		return rateSlip
+	}
+	l.dropped++
+	return rateDrop
+}
+
+// network returns the client's network prefix used as the RRL account
+func (l *RateLimiter) network(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.v4Mask).String()
+	}
+	return ip.Mask(l.v6Mask).String()
+}
+
+// responseClass groups responses the way RRL accounts them: positive answers
+// per name and type, negative answers per zone (so random subdomains of one
+// zone share a bucket) and errors together
+func responseClass(resp *dns.Msg) string {
+	var qname, qtype string
+	if len(resp.Question) > 0 {
+		qname = strings.ToLower(resp.Question[0].Name)
+		qtype = dns.TypeToString[resp.Question[0].Qtype]
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+			return "answer|" + qname + "|" + qtype
+		}
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return dns.RcodeToString[resp.Rcode] + "|" + strings.ToLower(soa.Hdr.Name)
+			}
+		}
+		return dns.RcodeToString[resp.Rcode] + "|" + qname
+	default:
+		return "error"
+	}
+}
+
+// sweep forgets idle buckets; the caller holds l.mu
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for _, buckets := range []map[string]*tokenBucket{l.responses, l.clients} {
+		for key, bucket := range buckets {
+			if now.Sub(bucket.last) > rateIdleTimeout {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// Stats returns the rate limiting counters
+func (l *RateLimiter) Stats() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return map[string]interface{}{
+		"dropped":        l.dropped,
+		"slipped":        l.slipped,
+		"quota_exceeded": l.quotaExceeded,
+		"tracked":        len(l.responses) + len(l.clients),
+	}
+}
+
+// slipResponse is the empty truncated answer sent instead of a limited
+// response, telling a legitimate client to retry over TCP
+func slipResponse(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	return m
+}
+
+// isLoopbackClient reports whether a client address is on this machine
+func isLoopbackClient(client string) bool {
+	ip := net.ParseIP(client)
+	return ip != nil && ip.IsLoopback()
+}
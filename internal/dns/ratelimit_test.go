@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// rewind moves every bucket of l d into the past, as if d had gone by
+func rewind(l *RateLimiter, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, buckets := range []map[string]*tokenBucket{l.responses, l.clients} {
+		for _, bucket := range buckets {
+			bucket.last = bucket.last.Add(-d)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !b.take(now, 1, 3) {
+			t.Fatalf("token %d of a full burst of 3 was refused", i+1)
+		}
+	}
+	if b.take(now, 1, 3) {
+		t.Error("token taken from an empty bucket")
+	}
+	if !b.take(now.Add(time.Second), 1, 3) {
+		t.Error("no token after refilling for a second")
+	}
+	// Refills stop at the burst size
+	for i := 0; i < 3; i++ {
+		if !b.take(now.Add(time.Hour), 1, 3) {
+			t.Fatalf("token %d after a long idle period was refused", i+1)
+		}
+	}
+	if b.take(now.Add(time.Hour), 1, 3) {
+		t.Error("bucket refilled past its burst size")
+	}
+}
+
+func TestRateLimiterResponses(t *testing.T) {
+	l := NewRateLimiter(config.RateLimitConfig{ResponsesPerSecond: 2, Slip: 2, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+	r := cacheQuery("rrl.example.", false, false)
+	resp := positiveAnswer(r, 300)
+
+	want := []rateDecision{rateAllow, rateAllow, rateDrop, rateSlip, rateDrop, rateSlip}
+	for i, decision := range want {
+		if got := l.checkResponse("192.0.2.1", r, resp); got != decision {
+			t.Errorf("response %d: decision %d, want %d", i+1, got, decision)
+		}
+	}
+
+	// Clients of the same /24 share the account, other networks and answers don't
+	if got := l.checkResponse("192.0.2.200", r, resp); got == rateAllow {
+		t.Error("neighbor in the same /24 was not limited")
+	}
+	if got := l.checkResponse("198.51.100.1", r, resp); got != rateAllow {
+		t.Errorf("other network limited with decision %d", got)
+	}
+	other := cacheQuery("other.example.", false, false)
+	if got := l.checkResponse("192.0.2.1", other, positiveAnswer(other, 300)); got != rateAllow {
+		t.Errorf("different answer limited with decision %d", got)
+	}
+
+	stats := l.Stats()
+	if stats["dropped"].(uint64) != 3 || stats["slipped"].(uint64) != 2 {
+		t.Errorf("dropped %v, slipped %v; want 3, 2", stats["dropped"], stats["slipped"])
+	}
+
+	// Loopback clients are never limited
+	for i := 0; i < 10; i++ {
+		if got := l.checkResponse("127.0.0.1", r, resp); got != rateAllow {
+			t.Fatalf("loopback client limited with decision %d", got)
+		}
+	}
+
+	rewind(l, time.Second)
+	if got := l.checkResponse("192.0.2.1", r, resp); got != rateAllow {
+		t.Errorf("decision %d after the bucket refilled, want allow", got)
+	}
+}
+
+func TestRateLimiterNoSlip(t *testing.T) {
+	l := NewRateLimiter(config.RateLimitConfig{ResponsesPerSecond: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+	r := cacheQuery("rrl.example.", false, false)
+	resp := positiveAnswer(r, 300)
+
+	l.checkResponse("192.0.2.1", r, resp)
+	for i := 0; i < 5; i++ {
+		if got := l.checkResponse("192.0.2.1", r, resp); got != rateDrop {
+			t.Errorf("decision %d with slip off, want drop", got)
+		}
+	}
+}
+
+func TestResponseClass(t *testing.T) {
+	a := cacheQuery("a.example.", false, false)
+	b := cacheQuery("b.example.", false, false)
+
+	tests := []struct {
+		name string
+		x, y *dns.Msg
+		same bool
+	}{
+		{"answers for different names", positiveAnswer(a, 300), positiveAnswer(b, 300), false},
+		{"NXDOMAIN in one zone", negativeAnswer(a, dns.RcodeNameError, 300, 300), negativeAnswer(b, dns.RcodeNameError, 300, 300), true},
+		{"NXDOMAIN and NODATA", negativeAnswer(a, dns.RcodeNameError, 300, 300), negativeAnswer(a, dns.RcodeSuccess, 300, 300), false},
+		{"errors", negativeAnswer(a, dns.RcodeServerFailure, 300, 300), negativeAnswer(b, dns.RcodeRefused, 300, 300), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := responseClass(tt.x) == responseClass(tt.y); same != tt.same {
+				t.Errorf("same class = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestRateLimiterQuota(t *testing.T) {
+	l := NewRateLimiter(config.RateLimitConfig{QueriesPerSecond: 2, Burst: 4})
+
+	for i := 0; i < 4; i++ {
+		if !l.allowQuery("192.0.2.1") {
+			t.Fatalf("query %d within the burst was refused", i+1)
+		}
+	}
+	if l.allowQuery("192.0.2.1") {
+		t.Error("query over the quota was allowed")
+	}
+	if !l.allowQuery("192.0.2.2") {
+		t.Error("another client was charged for the first one's queries")
+	}
+	if !l.allowQuery("::1") {
+		t.Error("loopback client was limited")
+	}
+
+	// Half a second refills one query at 2 per second
+	rewind(l, 500*time.Millisecond)
+	if !l.allowQuery("192.0.2.1") {
+		t.Error("quota did not refill")
+	}
+	if l.allowQuery("192.0.2.1") {
+		t.Error("quota refilled more than the elapsed time allows")
+	}
+
+	if exceeded := l.Stats()["quota_exceeded"].(uint64); exceeded != 2 {
+		t.Errorf("quota_exceeded = %d, want 2", exceeded)
+	}
+}
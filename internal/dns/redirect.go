@@ -0,0 +1,355 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+const (
+	// redirectTTL is the default TTL of synthesized redirect answers
+	redirectTTL = 300
+	// maxCNAMEDepth bounds CNAME chains between redirects
+	maxCNAMEDepth = 8
+	// dohCanaryDomain makes Firefox disable its built-in DoH when it gets NXDOMAIN
+	dohCanaryDomain = "use-application-dns.net"
+)
+
+// soaSerial is the serial of synthesized SOA records, fixed for the process lifetime
+var soaSerial = uint32(time.Now().Unix())
+
+// redirectRule is a redirect compiled from configuration
+type redirectRule struct {
+	pattern string
+	summary string
+	zone    string // apex of the synthesized zone, used as the SOA owner
+	ttl     uint32
+	ipv4    []net.IP
+	ipv6    []net.IP
+	host    string // hostname target resolved upstream instead of ipv4/ipv6
+	cname   string
+	txt     []string
+	srv     []config.SRVRecord
+
+	next atomic.Uint32 // round-robin position
+}
+
+// newRedirectRule compiles a configured redirect. In LAN mode loopback
+// targets are answered with the LAN interface's addresses.
+func newRedirectRule(redirect config.DNSRedirect, lan *LANInterface) *redirectRule {
+	rule := &redirectRule{
+		pattern: redirect.Domain,
+		summary: redirect.Summary(),
+		zone:    patternZone(redirect.Domain),
+		ttl:     redirect.TTL,
+		txt:     redirect.TXT,
+		srv:     redirect.SRV,
+	}
+	if rule.ttl == 0 {
+		rule.ttl = redirectTTL
+	}
+
+	if redirect.CNAME != "" {
+		rule.cname = dns.Fqdn(strings.ToLower(redirect.CNAME))
+	}
+	if host := redirect.HostTarget(); host != "" {
+		rule.host = dns.Fqdn(host)
+	}
+
+	ipv4, ipv6 := redirect.AddressTargets()
+	for _, ip := range ipv4 {
+		rule.ipv4 = append(rule.ipv4, lan.rewrite(net.ParseIP(ip).To4()))
+	}
+	for _, ip := range ipv6 {
+		if target := lan.rewrite(net.ParseIP(ip)); target != nil {
+			rule.ipv6 = append(rule.ipv6, target)
+		}
+	}
+
+	return rule
+}
+
+// patternZone returns the literal suffix of a pattern, which becomes the owner
+// of the synthesized SOA: "*.ol.epicgames.com" and "api-*.ol.epicgames.com"
+// both live in "ol.epicgames.com."
+func patternZone(pattern string) string {
+	labels := strings.Split(strings.Trim(strings.TrimPrefix(pattern, "!"), "."), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if strings.ContainsAny(labels[i], "*?[") {
+			labels = labels[i+1:]
+			break
+		}
+	}
+	return dns.Fqdn(strings.ToLower(strings.Join(labels, ".")))
+}
+
+// synthesizedSOA builds the SOA record placed in the authority section of
+// NODATA and NXDOMAIN answers. Its TTL and minimum bound negative caching.
+func synthesizedSOA(zone string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns.aegis.invalid.",
+		Mbox:    "hostmaster.aegis.invalid.",
+		Serial:  soaSerial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// rotate returns ips starting at the rule's next round-robin position
+func (r *redirectRule) rotate(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+
+	start := int(r.next.Add(1)-1) % len(ips)
+	rotated := make([]net.IP, 0, len(ips))
+	rotated = append(rotated, ips[start:]...)
+	return append(rotated, ips[:start]...)
+}
+
+// shouldRedirectQuery checks if a query should be redirected, using the
+// redirects of the client's group if it is in one
+func (s *Server) shouldRedirectQuery(qc *queryContext, queryName string) (*redirectRule, bool) {
+	s.mu.RLock()
+	redirects := s.redirects
+	s.mu.RUnlock()
+	if qc.group != nil {
+		redirects = qc.group.redirects
+	}
+	if qc.trace != nil {
+		traceMatches(qc, redirects, queryName)
+	}
+
+	match, ok := redirects.Match(queryName)
+	if !ok {
+		return nil, false
+	}
+
+	log.Debugf("Query %s matched redirect pattern %s", queryName, match.Pattern)
+	return match.Value, true
+}
+
+// redirectFor returns the client's redirect for a name like
+// shouldRedirectQuery, except that a redirect whose hostname target can't be
+// resolved fails over to forwarding the query
+func (s *Server) redirectFor(qc *queryContext, queryName string) (*redirectRule, bool) {
+	rule, ok := s.shouldRedirectQuery(qc, queryName)
+	if !ok || rule.host == "" {
+		return rule, ok
+	}
+
+	if _, _, _, err := s.targets.lookup(rule.host); err != nil {
+		log.Warnf("Redirect %s: target %s can't be resolved (%v), forwarding %s instead",
+			rule.pattern, strings.TrimSuffix(rule.host, "."), err, queryName)
+		qc.tracef("target %s of %s can't be resolved (%v), forwarding instead", strings.TrimSuffix(rule.host, "."), rule.pattern, err)
+		return nil, false
+	}
+	return rule, true
+}
+
+// addresses returns the rule's A and AAAA targets and the TTL to answer them
+// with, resolving a hostname target
+func (s *Server) addresses(rule *redirectRule) (ipv4, ipv6 []net.IP, ttl uint32) {
+	if rule.host == "" {
+		return rule.ipv4, rule.ipv6, rule.ttl
+	}
+
+	// Answers don't outlive the resolved addresses
+	ipv4, ipv6, remaining, _ := s.targets.lookup(rule.host)
+	return ipv4, ipv6, min(rule.ttl, remaining)
+}
+
+// handleRedirectQuery answers a redirected query from the rule's records
+func (s *Server) handleRedirectQuery(qc *queryContext, m *dns.Msg, q dns.Question, rule *redirectRule, depth int) {
+	log.Infof("Redirecting domain: %s -> %s", q.Name, rule.summary)
+	qc.tracef("redirect %s answers %s with %s", rule.pattern, q.Name, rule.summary)
+	if qc.rule == "" {
+		qc.rule = rule.pattern
+	}
+
+	ipv4, ipv6, ttl := s.addresses(rule)
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	// An alias answers every type with the CNAME and then the target's records
+	if rule.cname != "" {
+		m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: rule.cname})
+		if q.Qtype != dns.TypeCNAME {
+			s.chaseCNAME(qc, m, dns.Question{Name: rule.cname, Qtype: q.Qtype, Qclass: q.Qclass}, depth)
+		}
+		return
+	}
+
+	answered := len(m.Answer)
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		for _, ip := range rule.rotate(ipv4) {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+		}
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		for _, ip := range rule.rotate(ipv6) {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		for _, txt := range rule.txt {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: splitTXT(txt)})
+		}
+	}
+	if q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY {
+		for _, srv := range rule.srv {
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      hdr(dns.TypeSRV),
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				Port:     srv.Port,
+				Target:   dns.Fqdn(srv.Target),
+			})
+		}
+	}
+
+	// Every other type, including HTTPS and SVCB, gets NOERROR/NODATA: the name
+	// exists, it just has no such records. Answering NXDOMAIN would make
+	// resolvers drop the A records too, and forwarding HTTPS/SVCB would leak the
+	// real servers' ECH configuration and alternative endpoints.
+	if len(m.Answer) == answered {
+		m.Ns = append(m.Ns, synthesizedSOA(rule.zone, ttl))
+	}
+}
+
+// answerDoHCanary answers Firefox's DoH canary domain with NXDOMAIN so it
+// keeps using the system resolver, and therefore Aegis
+func answerDoHCanary(m *dns.Msg, q dns.Question) {
+	log.Debugf("Answering DoH canary %s with NXDOMAIN", q.Name)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, synthesizedSOA(dns.Fqdn(dohCanaryDomain), redirectTTL))
+}
+
+// isDoHCanary reports whether name is the DoH canary domain or below it
+func isDoHCanary(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return name == dohCanaryDomain || strings.HasSuffix(name, "."+dohCanaryDomain)
+}
+
+// chaseCNAME appends the records of a redirect's CNAME target, answering from
+// our own redirects when the target is redirected too and from upstream otherwise
+func (s *Server) chaseCNAME(qc *queryContext, m *dns.Msg, q dns.Question, depth int) {
+	if depth >= maxCNAMEDepth {
+		log.Warnf("CNAME chain at %s is too long, stopping", q.Name)
+		return
+	}
+
+	if rule, ok := s.redirectFor(qc, q.Name); ok {
+		s.handleRedirectQuery(qc, m, q, rule, depth+1)
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	failed := new(dns.Msg)
+	failed.SetReply(req)
+
+	resp := s.forwardToUpstream(qc, failed, req)
+	resp = s.rewriteCNAMEChain(qc, req, resp, depth+1)
+	m.Answer = append(m.Answer, resp.Answer...)
+	if len(resp.Answer) == 0 {
+		m.Ns = append(m.Ns, resp.Ns...)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		m.Rcode = resp.Rcode
+	}
+}
+
+// rewriteCNAMEChain rewrites an upstream answer whose CNAME chain enters a
+// redirected domain: the chain is kept up to the redirected name and the
+// redirect's records replace the real ones. With flatten_cnames the chain is
+// left out and the query name answers with the redirect's records directly.
+// Other answers are returned unchanged.
+func (s *Server) rewriteCNAMEChain(qc *queryContext, r, resp *dns.Msg, depth int) *dns.Msg {
+	if len(r.Question) == 0 || r.Question[0].Qtype == dns.TypeCNAME {
+		return resp
+	}
+	q := r.Question[0]
+
+	var chain []dns.RR
+	name := q.Name
+	for range maxCNAMEDepth {
+		cname := findCNAME(resp.Answer, name)
+		if cname == nil {
+			return resp
+		}
+		chain = append(chain, dns.Copy(cname))
+		name = cname.Target
+
+		rule, ok := s.redirectFor(qc, strings.ToLower(name))
+		if !ok {
+			continue
+		}
+
+		log.Infof("Upstream CNAME chain of %s enters redirected domain %s", q.Name, name)
+		qc.tracef("upstream CNAME chain enters redirected domain %s, rewriting the answer", name)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.RecursionAvailable = true
+		m.Answer = chain
+		s.handleRedirectQuery(qc, m, dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}, rule, depth)
+
+		if config.Config.DNS.FlattenCNAMEs {
+			flattenCNAMEs(m, q)
+		}
+		return m
+	}
+	return resp
+}
+
+// findCNAME returns the CNAME record owned by name in rrs, or nil
+func findCNAME(rrs []dns.RR, name string) *dns.CNAME {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname
+		}
+	}
+	return nil
+}
+
+// flattenCNAMEs replaces a CNAME chain in the answer with its final records,
+// owned by the query name and limited to the lowest TTL along the chain
+func flattenCNAMEs(m *dns.Msg, q dns.Question) {
+	ttl := uint32(0)
+	for i, rr := range m.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	var flattened []dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			continue
+		}
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = ttl
+		flattened = append(flattened, rr)
+	}
+	m.Answer = flattened
+}
+
+// splitTXT splits a TXT value into the 255-byte character strings DNS requires
+func splitTXT(value string) []string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+	return append(parts, value)
+}
@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// cnameRR returns a CNAME record from name to target
+func cnameRR(name, target string, ttl uint32) dns.RR {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	}
+}
+
+// aRR returns an A record for name
+func aRR(name, ip string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(ip),
+	}
+}
+
+// upstreamAnswer builds an upstream response to an A query for name
+func upstreamAnswer(name string, answer ...dns.RR) (*dns.Msg, *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = answer
+	return r, resp
+}
+
+// hopChain returns n CNAMEs leading from hop0.example. to target
+func hopChain(n int, target string) []dns.RR {
+	chain := make([]dns.RR, n)
+	for i := range chain {
+		next := fmt.Sprintf("hop%d.example.", i+1)
+		if i == n-1 {
+			next = target
+		}
+		chain[i] = cnameRR(fmt.Sprintf("hop%d.example.", i), next, 300)
+	}
+	return chain
+}
+
+func TestRewriteCNAMEChain(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	config.Config.DNS.Redirects = []config.DNSRedirect{
+		{Domain: "edge.cdn.example", Target: "192.0.2.10", TTL: 60, Enabled: true},
+	}
+
+	s := newServer(nil, nil, true)
+	defer s.Stop()
+	qc := newQueryContext("192.0.2.100", "udp")
+
+	// A chain entering the redirected name keeps its CNAMEs and gets the redirect's address
+	r, resp := upstreamAnswer("www.shop.example.",
+		cnameRR("www.shop.example.", "shop.provider.example.", 300),
+		cnameRR("shop.provider.example.", "edge.cdn.example.", 120),
+		aRR("edge.cdn.example.", "203.0.113.5", 120))
+	rewritten := s.rewriteCNAMEChain(qc, r, resp, 0)
+	if len(rewritten.Answer) != 3 {
+		t.Fatalf("rewritten answer %v, want both CNAMEs and the redirect", rewritten.Answer)
+	}
+	if a, ok := rewritten.Answer[2].(*dns.A); !ok || a.Hdr.Name != "edge.cdn.example." || a.A.String() != "192.0.2.10" {
+		t.Errorf("last record %v, want edge.cdn.example. A 192.0.2.10", rewritten.Answer[2])
+	}
+	if rewritten.Id != r.Id || !rewritten.Authoritative {
+		t.Error("rewritten answer isn't an authoritative reply to the query")
+	}
+
+	// A chain that never enters a redirected name is passed on as it is
+	r, resp = upstreamAnswer("www.other.example.",
+		cnameRR("www.other.example.", "edge.other.example.", 300),
+		aRR("edge.other.example.", "203.0.113.6", 300))
+	if got := s.rewriteCNAMEChain(qc, r, resp, 0); got != resp || len(got.Answer) != 2 {
+		t.Errorf("answer without redirected names was changed to %v", got.Answer)
+	}
+
+	// Chains are followed for maxCNAMEDepth CNAMEs and no further
+	r, resp = upstreamAnswer("hop0.example.", hopChain(maxCNAMEDepth, "edge.cdn.example.")...)
+	if got := s.rewriteCNAMEChain(qc, r, resp, 0); got == resp {
+		t.Errorf("redirect after %d CNAMEs was not applied", maxCNAMEDepth)
+	}
+	r, resp = upstreamAnswer("hop0.example.", hopChain(maxCNAMEDepth+1, "edge.cdn.example.")...)
+	if got := s.rewriteCNAMEChain(qc, r, resp, 0); got != resp {
+		t.Errorf("redirect after %d CNAMEs was applied", maxCNAMEDepth+1)
+	}
+
+	// Flattened, the query name answers with the redirect's address directly
+	config.Config.DNS.FlattenCNAMEs = true
+	r, resp = upstreamAnswer("www.shop.example.",
+		cnameRR("www.shop.example.", "edge.cdn.example.", 300))
+	flattened := s.rewriteCNAMEChain(qc, r, resp, 0)
+	if len(flattened.Answer) != 1 {
+		t.Fatalf("flattened answer %v, want a single A record", flattened.Answer)
+	}
+	if a, ok := flattened.Answer[0].(*dns.A); !ok || a.Hdr.Name != "www.shop.example." || a.A.String() != "192.0.2.10" || a.Hdr.Ttl != 60 {
+		t.Errorf("flattened answer %v, want www.shop.example. 60 A 192.0.2.10", flattened.Answer[0])
+	}
+}
+
+func TestFlattenCNAMEs(t *testing.T) {
+	q := dns.Question{Name: "www.shop.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		cnameRR("www.shop.example.", "shop.provider.example.", 300),
+		cnameRR("shop.provider.example.", "edge.cdn.example.", 30),
+		aRR("edge.cdn.example.", "192.0.2.10", 120),
+		aRR("edge.cdn.example.", "192.0.2.11", 120),
+	}
+	flattenCNAMEs(m, q)
+
+	if len(m.Answer) != 2 {
+		t.Fatalf("flattened answer %v, want the two A records", m.Answer)
+	}
+	for _, rr := range m.Answer {
+		if hdr := rr.Header(); hdr.Name != q.Name || hdr.Ttl != 30 || hdr.Rrtype != dns.TypeA {
+			t.Errorf("flattened record %v, want an A record of %s with the chain's lowest TTL 30", rr, q.Name)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// Sources of locally answered reverse lookups, as recorded in the query log
+const (
+	reverseHost    = "host"    // an address of this machine
+	reversePrivate = "private" // an unknown address in a private range
+)
+
+// privateReverseZones are the reverse zones of private and local address
+// ranges that RFC 6303 says to answer locally instead of forwarding
+var privateReverseZones = func() []string {
+	zones := []string{"0.in-addr.arpa.", "10.in-addr.arpa.", "127.in-addr.arpa.", "254.169.in-addr.arpa.", "168.192.in-addr.arpa."}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa.")
+	}
+	// fc00::/7 unique local and fe80::/10 link-local addresses, :: and ::1
+	zones = append(zones, "c.f.ip6.arpa.", "d.f.ip6.arpa.", "8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa.")
+	for _, ip := range []string{"::", "::1"} {
+		name, _ := dns.ReverseAddr(ip)
+		zones = append(zones, name)
+	}
+	return zones
+}()
+
+// reverseName is a name reverse lookups of an address answer with
+type reverseName struct {
+	name string
+	ttl  uint32
+	rule string // redirect pattern the name comes from, empty for local names
+}
+
+// reverseTable maps addresses, in net.IP's string form, to their names
+type reverseTable map[string][]reverseName
+
+// add appends a name for ip unless the address already has it
+func (t reverseTable) add(ip net.IP, name reverseName) {
+	key := ip.String()
+	for _, existing := range t[key] {
+		if existing.name == name.name {
+			return
+		}
+	}
+	t[key] = append(t[key], name)
+}
+
+// newReverseTable maps the address targets of redirect rules to the literal
+// part of their patterns: a redirect of "*.ol.epicgames.com" to 127.0.0.1
+// makes 127.0.0.1 reverse to "ol.epicgames.com"
+func newReverseTable(rules []*redirectRule) reverseTable {
+	table := reverseTable{}
+	for _, rule := range rules {
+		if rule.zone == "." {
+			continue
+		}
+		name := reverseName{name: rule.zone, ttl: rule.ttl, rule: rule.pattern}
+		for _, ip := range rule.ipv4 {
+			table.add(ip, name)
+		}
+		for _, ip := range rule.ipv6 {
+			table.add(ip, name)
+		}
+	}
+	return table
+}
+
+// localReverseTable maps this machine's addresses to its host name and
+// loopback addresses to localhost
+func localReverseTable() reverseTable {
+	table := reverseTable{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debugf("Failed to list local addresses for reverse lookups: %v", err)
+		return table
+	}
+
+	hostname, _ := os.Hostname()
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		hostname = ""
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		switch {
+		case ipNet.IP.IsLoopback():
+			table.add(ipNet.IP, reverseName{name: "localhost.", ttl: redirectTTL})
+		case hostname != "":
+			table.add(ipNet.IP, reverseName{name: dns.Fqdn(hostname), ttl: redirectTTL})
+		}
+	}
+	return table
+}
+
+// reverseAddress returns the address an in-addr.arpa or ip6.arpa name stands
+// for, or nil if the name is not a complete reverse name
+func reverseAddress(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 || !strings.Contains("0123456789abcdef", nibbles[i]) {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// isReverseName reports whether name is in the reverse DNS tree
+func isReverseName(name string) bool {
+	return dns.IsSubDomain("in-addr.arpa.", name) || dns.IsSubDomain("ip6.arpa.", name)
+}
+
+// privateReverseZone returns the private reverse zone name is in, or ""
+func privateReverseZone(name string) string {
+	for _, zone := range privateReverseZones {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// reverseNames returns the names an address reverses to for the client: those
+// of its redirect targets, or else this machine's own
+func (s *Server) reverseNames(qc *queryContext, ip net.IP) []reverseName {
+	s.mu.RLock()
+	table, local := s.reverse, s.localReverse
+	s.mu.RUnlock()
+	if qc.group != nil {
+		table = qc.group.reverse
+	}
+
+	if names := table[ip.String()]; len(names) > 0 {
+		return names
+	}
+	return local[ip.String()]
+}
+
+// answerReverse answers reverse lookups of redirect targets and of this
+// machine's addresses with synthesized PTR records, and with private_reverse
+// every other lookup in the private ranges with NXDOMAIN. It reports whether
+// it answered; other names are left to the block lists and upstream.
+func (s *Server) answerReverse(qc *queryContext, m *dns.Msg, q dns.Question) bool {
+	name := strings.ToLower(q.Name)
+	if !isReverseName(name) {
+		return false
+	}
+	zone := privateReverseZone(name)
+
+	if ip := reverseAddress(name); ip != nil {
+		if names := s.reverseNames(qc, ip); len(names) > 0 {
+			answerPTR(qc, m, q, names, zone)
+			return true
+		}
+	}
+
+	if zone == "" || !config.Config.DNS.PrivateReverse {
+		return false
+	}
+
+	log.Debugf("Answering reverse lookup %s in private zone %s", q.Name, zone)
+	qc.local = reversePrivate
+	qc.tracef("reverse lookup in private zone %s answered locally", zone)
+	soa := synthesizedSOA(zone, redirectTTL)
+	switch {
+	case name == zone && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+	case name == zone || s.hasReverseBelow(qc, name):
+		// The zone apex and names above known addresses exist without records
+		m.Ns = append(m.Ns, soa)
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soa)
+	}
+	return true
+}
+
+// answerPTR answers a reverse lookup from names; other types than PTR get
+// NODATA. zone is the private zone of the name, empty if it has none.
+func answerPTR(qc *queryContext, m *dns.Msg, q dns.Question, names []reverseName, zone string) {
+	if names[0].rule != "" {
+		qc.rule = names[0].rule
+		qc.tracef("reverse lookup of a target of redirect %s", names[0].rule)
+	} else {
+		qc.local = reverseHost
+		qc.tracef("reverse lookup of an address of this machine")
+	}
+
+	if q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY {
+		if zone == "" {
+			zone = strings.ToLower(q.Name)
+		}
+		m.Ns = append(m.Ns, synthesizedSOA(zone, names[0].ttl))
+		return
+	}
+
+	log.Debugf("Answering reverse lookup %s with %s", q.Name, names[0].name)
+	for _, name := range names {
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: name.ttl},
+			Ptr: name.name,
+		})
+	}
+}
+
+// hasReverseBelow reports whether a known address of the client is below
+// name, which then exists even though it has no records of its own
+func (s *Server) hasReverseBelow(qc *queryContext, name string) bool {
+	s.mu.RLock()
+	tables := []reverseTable{s.reverse, s.localReverse}
+	s.mu.RUnlock()
+	if qc.group != nil {
+		tables[0] = qc.group.reverse
+	}
+
+	for _, table := range tables {
+		for address := range table {
+			if reverse, err := dns.ReverseAddr(address); err == nil && dns.IsSubDomain(name, reverse) {
+				return true
+			}
+		}
+	}
+	return false
+}
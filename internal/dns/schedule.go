@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// maxTransitionWait bounds how long the redirect schedule sleeps, so a
+// transition isn't missed after the clock jumps, e.g. when a laptop wakes up
+const maxTransitionWait = time.Minute
+
+// startSchedule switches scheduled and expiring redirects on and off at their
+// transition times until Stop is called
+func (s *Server) startSchedule() {
+	go func() {
+		last := time.Now()
+		for {
+			wait := maxTransitionWait
+			if transitions := config.UpcomingTransitions(last); len(transitions) > 0 {
+				wait = min(wait, max(time.Until(transitions[0].Time), 0))
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.stopSchedule:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			now := time.Now()
+			if logTransitions(last, now) {
+				s.updateRedirects()
+			}
+			last = now
+		}
+	}()
+}
+
+// logTransitions logs every redirect that turned on or off between last and
+// now and reports whether there were any
+func logTransitions(last, now time.Time) bool {
+	changed := false
+	check := func(group string, redirects []config.DNSRedirect) {
+		for _, redirect := range redirects {
+			active := redirect.ActiveAt(now)
+			if redirect.ActiveAt(last) == active {
+				continue
+			}
+			changed = true
+
+			scope := ""
+			if group != "" {
+				scope = " for client group " + group
+			}
+			if active {
+				log.Infof("⏰ Scheduled redirect %s -> %s is now active%s", redirect.Domain, redirect.Summary(), scope)
+			} else {
+				log.Infof("⏰ Scheduled redirect %s is no longer active%s", redirect.Domain, scope)
+			}
+		}
+	}
+
+	check("", config.Config.DNS.Redirects)
+	for _, group := range config.Config.DNS.ClientGroups {
+		check(group.Name, group.Redirects)
+	}
+	return changed
+}
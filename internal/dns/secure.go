@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+)
+
+// ServeDoH answers an RFC 8484 DNS-over-HTTPS request (GET with a base64url
+// "dns" parameter, or POST with an application/dns-message body) through the
+// same redirect logic as the UDP/TCP listeners
+func (s *Server) ServeDoH(c *fiber.Ctx) error {
+	var packed []byte
+
+	switch c.Method() {
+	case fiber.MethodGet:
+		param := c.Query("dns")
+		if param == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("missing dns parameter")
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid dns parameter")
+		}
+		packed = decoded
+	case fiber.MethodPost:
+		if c.Get(fiber.HeaderContentType) != dohContentType {
+			return c.Status(fiber.StatusUnsupportedMediaType).SendString("expected " + dohContentType)
+		}
+		packed = c.Body()
+	default:
+		return c.SendStatus(fiber.StatusMethodNotAllowed)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("malformed DNS message")
+	}
+
+	qc := newQueryContext(c.Context().RemoteAddr().String(), "doh")
+	if refused, handled := s.applyACL(qc, req); handled {
+		return serveDoHDenied(c, refused)
+	}
+	if s.limiter != nil && !s.limiter.allowQuery(qc.client) {
+		return c.SendStatus(fiber.StatusTooManyRequests)
+	}
+
+	resp := s.resolve(qc, req)
+	out, err := resp.Pack()
+	if err != nil {
+		log.Errorf("Failed to pack DoH response: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	c.Set(fiber.HeaderContentType, dohContentType)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("max-age=%d", minRRTTL(resp.Answer, resp.Ns)))
+	return c.Send(out)
+}
+
+// StartDoT starts a DNS-over-TLS (RFC 7858) listener on address
+func (s *Server) StartDoT(address string, cert tls.Certificate) error {
+	listener, err := tls.Listen("tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"dot"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bind DoT port %s: %v", address, err)
+	}
+
+	s.dotServer = &dns.Server{
+		Listener: listener,
+		Net:      "tcp-tls",
+		Handler:  s.handler("dot"),
+	}
+
+	go func() {
+		if err := s.dotServer.ActivateAndServe(); err != nil {
+			log.Errorf("DoT server stopped: %v", err)
+		}
+	}()
+
+	log.Infof("Serving DNS-over-TLS on %s", address)
+	return nil
+}
+
+// StartDoH starts a dedicated DNS-over-HTTPS listener on address, for setups
+// that do not share the proxy's HTTPS port
+func (s *Server) StartDoH(address, path string, cert tls.Certificate) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to bind DoH port %s: %v", address, err)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get(path, s.ServeDoH)
+	app.Post(path, s.ServeDoH)
+	s.dohApp = app
+
+	tlsListener := tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	})
+
+	go func() {
+		if err := app.Listener(tlsListener); err != nil {
+			log.Errorf("DoH server stopped: %v", err)
+		}
+	}()
+
+	log.Infof("Serving DNS-over-HTTPS on https://%s%s", address, path)
+	return nil
+}
+
+// stopSecure shuts down the DoT and dedicated DoH listeners
+func (s *Server) stopSecure() error {
+	var dotErr, dohErr error
+
+	if s.dotServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dotErr = s.dotServer.ShutdownContext(ctx)
+		s.dotServer = nil
+	}
+
+	if s.dohApp != nil {
+		dohErr = s.dohApp.ShutdownWithTimeout(5 * time.Second)
+		s.dohApp = nil
+	}
+
+	if dotErr != nil {
+		return dotErr
+	}
+	return dohErr
+}
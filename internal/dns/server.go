@@ -2,334 +2,584 @@ package dns
 
 import (
 	"context"
-	"fmt"
-	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
 	"github.com/miekg/dns"
 	"github.com/simplyzetax/aegis/internal/config"
 )
 
 // Server represents our custom DNS server
 type Server struct {
-	udpServer         *dns.Server
-	tcpServer         *dns.Server
-	upstreamDNS       string
-	redirects         map[string]string // domain pattern -> target IP
-	redirectsWildcard map[string]string // wildcard patterns
+	listeners []*dnsListener
+	servers   []*dns.Server // one per listener
+	dotServer *dns.Server
+	dohApp    *fiber.App
+	upstreams *UpstreamPool
+	cache     *Cache    // nil when caching is disabled
+	queryLog  *QueryLog // nil when query logging is disabled
+	blocklist *Blocklist
+	limiter   *RateLimiter // nil when rate limiting is disabled
+	validator *Validator   // nil when DNSSEC validation is disabled
+	acl       *ACL
+	lan       *LANInterface // nil unless LAN mode is on
+	targets   *targetResolver
+	oneShot   bool // built for a single traced query: no query log or background lookups
+
+	// Why the default upstreams differ from upstream_dns, noted in traces
+	systemUnavailable string // reason "system" yields no resolver, empty if it does
+	fallback          bool   // nothing usable was left and fallbackUpstream is used
+
+	// forwardZones routes matching names to dedicated pools; zones lists them
+	forwardZones *Matcher[*forwardZone]
+	zones        []*forwardZone
+
+	anyMinimized atomic.Uint64
+	learner      atomic.Pointer[Learner] // nil unless learn mode is on
+
+	neighbors    neighborTable // MAC addresses of LAN clients, for client groups
+	stopSchedule chan struct{}
+	stopOnce     sync.Once
+
+	mu           sync.RWMutex
+	redirects    *Matcher[*redirectRule] // domain pattern -> redirect records
+	reverse      reverseTable            // redirect target -> names for PTR answers
+	localReverse reverseTable            // this machine's addresses -> host name
+	groups       []*clientGroup
 }
 
-// NewServer creates a new DNS server instance
-func NewServer() *Server {
+// NewServer creates a new DNS server instance. system lists the resolvers
+// the machine used before, for "system" upstreams; lan is nil unless LAN mode is on.
+func NewServer(system []string, lan *LANInterface) *Server {
+	return newServer(system, lan, false)
+}
+
+// newServer creates a server; a one-shot server answers a single traced
+// query and leaves out the query log and background lookups
+func newServer(system []string, lan *LANInterface, oneShot bool) *Server {
+	upstreams := upstreamAddresses(config.Config.DNS.UpstreamDNS, system, lan)
+	fallback := len(upstreams) == 0
+	if fallback {
+		log.Warnf("No usable upstream DNS, falling back to %s", fallbackUpstream)
+		upstreams = []string{fallbackUpstream}
+	}
+
+	resolvers := bootstrapResolvers(upstreams, system, lan)
+
 	server := &Server{
-		upstreamDNS:       config.Config.DNS.UpstreamDNS,
-		redirects:         make(map[string]string),
-		redirectsWildcard: make(map[string]string),
+		upstreams: NewUpstreamPool(upstreams, config.Config.DNS.UpstreamStrategy, resolvers),
+		redirects: NewMatcher[*redirectRule](),
+		blocklist: NewBlocklist(config.Config.DNS.Blocklists),
+		acl:       NewACL(config.Config.DNS.ACL),
+		lan:       lan,
+		oneShot:   oneShot,
+
+		systemUnavailable: systemUnavailable(config.Config.DNS.UpstreamDNS, system, upstreams),
+		fallback:          fallback,
+
+		stopSchedule: make(chan struct{}),
+	}
+	server.forwardZones, server.zones = newForwardZones(config.Config.DNS.ForwardZones, system, lan, resolvers)
+	server.targets = newTargetResolver(func(name string) *UpstreamPool {
+		pool, _ := server.poolFor(name)
+		return pool
+	})
+
+	if config.Config.DNS.RateLimit.Enabled {
+		server.limiter = NewRateLimiter(config.Config.DNS.RateLimit)
+	}
+
+	if config.Config.DNS.Cache.Enabled {
+		server.cache = NewCache(config.Config.DNS.Cache)
+	}
+
+	if config.Config.DNS.DNSSEC.Enabled {
+		validator, err := NewValidator(config.Config.DNS.DNSSEC, func(name string) *UpstreamPool {
+			pool, _ := server.poolFor(name)
+			return pool
+		})
+		if err != nil {
+			log.Errorf("DNSSEC validation disabled: %v", err)
+		} else {
+			server.validator = validator
+		}
+	}
+
+	if config.Config.DNS.QueryLog.Enabled && !oneShot {
+		queryLog, err := NewQueryLog(config.Config.DNS.QueryLog)
+		if err != nil {
+			log.Warnf("Query log disabled: %v", err)
+		} else {
+			server.queryLog = queryLog
+		}
 	}
 
 	server.updateRedirects()
 	return server
 }
 
-// updateRedirects refreshes the redirect maps from configuration
+// updateRedirects rebuilds the redirect matcher and client groups from configuration
 func (s *Server) updateRedirects() {
-	s.redirects = make(map[string]string)
-	s.redirectsWildcard = make(map[string]string)
-
-	for _, redirect := range config.GetEnabledRedirects() {
-		// Normalize domain pattern
-		domain := strings.ToLower(redirect.Domain)
-		if !strings.HasSuffix(domain, ".") {
-			domain += "."
+	now := time.Now()
+	redirects := NewMatcher[*redirectRule]()
+	var rules []*redirectRule
+
+	for _, redirect := range exclusionsFirst(config.GetActiveRedirects(now)) {
+		rule := newRedirectRule(redirect, s.lan)
+		if err := redirects.Insert(redirect.Domain, rule); err != nil {
+			log.Warnf("Skipping redirect %s: %v", redirect.Domain, err)
+			continue
 		}
+		rules = append(rules, rule)
+		log.Debugf("Added redirect: %s -> %s", redirect.Domain, rule.summary)
+	}
+	groups := newClientGroups(config.Config.DNS.ClientGroups, rules, s.lan, now)
+	reverse := newReverseTable(rules)
+	localReverse := localReverseTable()
+
+	// Hostname targets are resolved ahead of their first query, except for
+	// a single traced query that resolves what it needs
+	if !s.oneShot {
+		s.targets.update(hostTargets(now))
+	}
 
-		if strings.HasPrefix(domain, "*.") {
-			// Wildcard pattern
-			pattern := domain[2:] // Remove "*."
-			s.redirectsWildcard[pattern] = redirect.Target
-			log.Debugf("Added wildcard redirect: *.%s -> %s", pattern, redirect.Target)
-		} else {
-			// Exact domain
-			s.redirects[domain] = redirect.Target
-			log.Debugf("Added exact redirect: %s -> %s", domain, redirect.Target)
+	s.mu.Lock()
+	s.redirects = redirects
+	s.reverse = reverse
+	s.localReverse = localReverse
+	s.groups = groups
+	s.mu.Unlock()
+
+	// Read the neighbor table ahead of the first query from a grouped device
+	for _, group := range groups {
+		if len(group.macs) > 0 {
+			if s.oneShot {
+				s.neighbors.load()
+			} else {
+				s.neighbors.refresh()
+			}
+			break
 		}
 	}
 }
 
-// handleDNSRequest processes incoming DNS requests
-func (s *Server) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	// Create response message
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Authoritative = true
-	m.RecursionAvailable = true
+// exclusionsFirst orders redirects so exclusions are inserted before the
+// positive patterns they shadow, which are then skipped instead of being
+// counted and getting reverse entries. Matching doesn't depend on the order.
+func exclusionsFirst(redirects []config.DNSRedirect) []config.DNSRedirect {
+	ordered := make([]config.DNSRedirect, 0, len(redirects))
+	for _, redirect := range redirects {
+		if redirect.IsExclusion() {
+			ordered = append(ordered, redirect)
+		}
+	}
+	for _, redirect := range redirects {
+		if !redirect.IsExclusion() {
+			ordered = append(ordered, redirect)
+		}
+	}
+	return ordered
+}
 
-	// Process each question in the request
-	for _, q := range r.Question {
-		queryName := strings.ToLower(q.Name)
+// hostTargets returns the hostname targets of the redirects active at now
+func hostTargets(now time.Time) map[string]bool {
+	redirects := config.GetActiveRedirects(now)
+	for _, group := range config.Config.DNS.ClientGroups {
+		for _, redirect := range group.Redirects {
+			if redirect.ActiveAt(now) {
+				redirects = append(redirects, redirect)
+			}
+		}
+	}
 
-		// Check if this query matches any of our redirects
-		targetIP, shouldRedirect := s.shouldRedirectQuery(queryName)
+	names := map[string]bool{}
+	for _, redirect := range redirects {
+		if host := redirect.HostTarget(); host != "" && !redirect.IsExclusion() {
+			names[dns.Fqdn(host)] = true
+		}
+	}
+	return names
+}
 
-		if shouldRedirect {
-			log.Debugf("DNS Query (redirecting): %s %s -> %s", q.Name, dns.TypeToString[q.Qtype], targetIP)
-			s.handleRedirectQuery(m, q, targetIP)
-		} else {
-			// Forward to upstream DNS
-			s.forwardToUpstream(m, r, w)
+// handler returns the handler for a listener speaking protocol ("udp", "tcp" or "dot")
+func (s *Server) handler(protocol string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		qc := newQueryContext(w.RemoteAddr().String(), protocol)
+
+		if refused, handled := s.applyACL(qc, r); handled {
+			if refused != nil {
+				w.WriteMsg(refused)
+			}
+			return
+		}
+
+		// Clients over their quota are ignored on UDP, where the source may be spoofed
+		if s.limiter != nil && !s.limiter.allowQuery(qc.client) {
+			if protocol != "udp" {
+				refused := new(dns.Msg)
+				refused.SetRcode(r, dns.RcodeRefused)
+				w.WriteMsg(refused)
+			}
 			return
 		}
+
+		resp := s.resolve(qc, r)
+
+		// Answers that don't fit the client's UDP buffer are truncated so it retries over TCP
+		resp.Compress = true
+		if protocol == "udp" {
+			resp.Truncate(udpResponseSize(r))
+
+			if s.limiter != nil {
+				switch s.limiter.checkResponse(qc.client, r, resp) {
+				case rateDrop:
+					return
+				case rateSlip:
+					resp = slipResponse(r)
+				}
+			}
+		}
+
+		// Send the response
+		if err := w.WriteMsg(resp); err != nil {
+			log.Errorf("Failed to write DNS response: %v", err)
+		}
+	})
+}
+
+// resolve builds the response for a query, either from our redirects or from
+// upstream, and records it in the query log. It is shared by the UDP/TCP, DoT
+// and DoH listeners.
+func (s *Server) resolve(qc *queryContext, r *dns.Msg) *dns.Msg {
+	resp := badEDNSVersion(r)
+	if resp == nil {
+		resp = s.answer(qc, r)
 	}
+	finishEDNS(r, resp, qc.client)
 
-	// Send the response
-	if err := w.WriteMsg(m); err != nil {
-		log.Errorf("Failed to write DNS response: %v", err)
+	if learner := s.learner.Load(); learner != nil && qc.trace == nil {
+		for _, q := range r.Question {
+			learner.record(q.Name, q.Qtype, qc.rule != "")
+		}
 	}
+	s.logQuery(qc, r, resp)
+	return resp
 }
 
-// shouldRedirectQuery checks if a query should be redirected
-func (s *Server) shouldRedirectQuery(queryName string) (string, bool) {
-	queryName = strings.ToLower(queryName)
-	if !strings.HasSuffix(queryName, ".") {
-		queryName += "."
+// logQuery records a query in the query log; resp is nil for dropped queries.
+// Traced queries are not real client traffic and stay out of it.
+func (s *Server) logQuery(qc *queryContext, r, resp *dns.Msg) {
+	if s.queryLog == nil || qc.trace != nil {
+		return
 	}
-
-	// Check exact matches first
-	if targetIP, exists := s.redirects[queryName]; exists {
-		return targetIP, true
+	if err := s.queryLog.Record(qc.entries(r, resp)...); err != nil {
+		log.Warnf("Failed to write query log: %v", err)
 	}
+}
 
-	// Check wildcard patterns
-	for pattern, targetIP := range s.redirectsWildcard {
-		if strings.HasSuffix(queryName, pattern) {
-			return targetIP, true
+// answer builds the response for a query
+func (s *Server) answer(qc *queryContext, r *dns.Msg) *dns.Msg {
+	// Create response message
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	if qc.acl != ACLForwardOnly {
+		qc.group = s.clientGroupFor(qc.client)
+		if qc.group != nil {
+			qc.tracef("client %s is in client group %s", qc.client, qc.group.name)
 		}
 	}
 
-	return "", false
-}
+	// Process each question in the request
+	for _, q := range r.Question {
+		queryName := strings.ToLower(q.Name)
 
-// handleRedirectQuery handles queries that should be redirected
-func (s *Server) handleRedirectQuery(m *dns.Msg, q dns.Question, targetIP string) {
-	log.Infof("Redirecting domain: %s -> %s", q.Name, targetIP)
-
-	switch q.Qtype {
-	case dns.TypeA:
-		// Return A record pointing to target IP
-		rr := &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    300, // 5 minutes TTL
-			},
-			A: net.ParseIP(targetIP),
+		if !config.Config.DNS.AllowDoHCanary && isDoHCanary(queryName) {
+			qc.tracef("DoH canary domain answered with NXDOMAIN")
+			answerDoHCanary(m, q)
+			continue
 		}
-		m.Answer = append(m.Answer, rr)
-
-	case dns.TypeAAAA:
-		// For IPv6, try to parse the target as IPv6, fallback to IPv4-mapped
-		var ipv6 net.IP
-		if ip := net.ParseIP(targetIP); ip != nil {
-			if ip.To4() != nil {
-				// IPv4 address, map to IPv6
-				if targetIP == "127.0.0.1" {
-					ipv6 = net.ParseIP("::1")
-				} else {
-					// Map IPv4 to IPv6
-					ipv6 = ip.To16()
-				}
-			} else {
-				// Already IPv6
-				ipv6 = ip
-			}
-		} else {
-			// Invalid IP, default to ::1
-			ipv6 = net.ParseIP("::1")
+
+		// ANY is the classic amplification query; answer it minimally (RFC 8482)
+		if q.Qtype == dns.TypeANY && !config.Config.DNS.AllowAny {
+			s.anyMinimized.Add(1)
+			qc.tracef("ANY query answered minimally (RFC 8482)")
+			answerMinimalAny(m, q)
+			continue
+		}
+
+		// Forward-only clients always get the real answer
+		if qc.acl == ACLForwardOnly {
+			qc.tracef("forward-only client: redirects and block lists are skipped")
+			return s.forwardToUpstream(qc, m, r)
 		}
 
-		rr := &dns.AAAA{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-				Ttl:    300, // 5 minutes TTL
-			},
-			AAAA: ipv6,
+		// Check if this query matches any of the client's redirects
+		rule, shouldRedirect := s.redirectFor(qc, queryName)
+
+		if shouldRedirect {
+			log.Debugf("DNS Query (redirecting): %s %s -> %s", q.Name, dns.TypeToString[q.Qtype], rule.summary)
+			s.handleRedirectQuery(qc, m, q, rule, 0)
+			continue
 		}
-		m.Answer = append(m.Answer, rr)
-
-	case dns.TypeCNAME:
-		// For CNAME queries, return an A record instead
-		rr := &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    300,
-			},
-			A: net.ParseIP(targetIP),
+
+		// Reverse lookups of redirect targets and local addresses stay here
+		if s.answerReverse(qc, m, q) {
+			continue
+		}
+
+		// Redirects take precedence over block lists
+		if blockRule, pattern, blocked := s.blocklist.Check(queryName); blocked {
+			qc.tracef("blocked by %s in block list %s (%s)", pattern, blockRule.source.name, blockRule.action)
+			qc.blocked = blockRule.source.name
+			s.blocklist.answerBlocked(m, q, blockRule, pattern)
+			continue
 		}
-		m.Answer = append(m.Answer, rr)
 
-	default:
-		// For other record types, return NXDOMAIN
-		m.Rcode = dns.RcodeNameError
+		// Forward to upstream DNS; answers aliasing a redirected domain are rewritten
+		resp := s.forwardToUpstream(qc, m, r)
+		return s.rewriteCNAMEChain(qc, r, resp, 0)
 	}
+
+	return m
+}
+
+// answerMinimalAny answers an ANY query with the single synthesized HINFO
+// record RFC 8482 recommends
+func answerMinimalAny(m *dns.Msg, q dns.Question) {
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+		Cpu: "RFC8482",
+	})
 }
 
-// forwardToUpstream forwards DNS queries to upstream DNS servers
-func (s *Server) forwardToUpstream(m *dns.Msg, originalReq *dns.Msg, w dns.ResponseWriter) {
-	// Create a new DNS client for forwarding
-	client := new(dns.Client)
-	client.Timeout = 5 * time.Second
+// forwardToUpstream answers a query from the cache or the upstream servers and
+// returns the response, or m with SERVFAIL if no upstream answered
+func (s *Server) forwardToUpstream(qc *queryContext, m *dns.Msg, originalReq *dns.Msg) *dns.Msg {
+	// Names in a forward zone go to that zone's upstreams instead of the default pool
+	pool, zone := s.poolFor(originalReq.Question[0].Name)
+	qc.forwardZone = zone
+	if zone != "" {
+		qc.tracef("forward zone %s selects upstreams %s", zone, strings.Join(pool.Addresses(), ", "))
+	}
+
+	// Validated lookups ask upstream for signatures. Clients setting CD
+	// (checking disabled) validate themselves and get the answer unchecked.
+	// Forward zones are usually private and unsigned, while the public tree
+	// above them proves they don't exist, so their answers aren't validated.
+	query := originalReq
+	if s.validator != nil && !originalReq.CheckingDisabled {
+		if zone == "" {
+			query = validatingQuery(originalReq)
+		} else {
+			qc.tracef("DNSSEC validation skipped for forward zone %s", zone)
+		}
+	}
+
+	if s.cache != nil {
+		if cached, prefetch, ok := s.cache.Get(query); ok {
+			if prefetch {
+				go s.prefetch(query.Copy())
+			}
+			qc.cached = true
+			qc.tracef("answered from the cache")
+			if s.validator != nil && cached.AuthenticatedData {
+				qc.dnssec = statusSecure.String()
+			}
+			return stripDNSSEC(originalReq, cached)
+		}
+	}
 
-	// Forward the original request to upstream DNS
-	resp, _, err := client.Exchange(originalReq, s.upstreamDNS)
+	// Forward the request to the upstream pool
+	resp, upstream, err := pool.Exchange(query)
 	if err != nil {
-		log.Errorf("Failed to query upstream DNS %s: %v", s.upstreamDNS, err)
+		if s.cache != nil {
+			if stale, ok := s.cache.GetStale(query); ok {
+				log.Warnf("All upstreams failed, serving stale answer for %s: %v", originalReq.Question[0].Name, err)
+				qc.cached = true
+				qc.tracef("every upstream failed (%v), answered from an expired cache entry", err)
+				return stripDNSSEC(originalReq, stale)
+			}
+		}
+
+		log.Errorf("Failed to query upstream DNS: %v", err)
+		qc.tracef("every upstream failed: %v", err)
 		// Return SERVFAIL if we fail to query upstream
 		m.Rcode = dns.RcodeServerFailure
-		if err := w.WriteMsg(m); err != nil {
-			log.Errorf("Failed to write DNS error response: %v", err)
-		}
-		return
+		return m
 	}
 
-	// Forward the response from upstream
-	if err := w.WriteMsg(resp); err != nil {
-		log.Errorf("Failed to write DNS response from upstream: %v", err)
+	if query != originalReq {
+		var status securityStatus
+		resp, status = s.validator.Validate(query, resp)
+		qc.dnssec = status.String()
+		qc.tracef("DNSSEC validation: %s", qc.dnssec)
 	}
 
-	// Log forwarded queries for domains we care about
+	if s.cache != nil {
+		s.cache.Set(query, resp)
+	}
+
+	qc.upstream = upstream.Address
+	qc.tracef("forwarded to %s, answered %s", upstream.Address, dns.RcodeToString[resp.Rcode])
 	for _, q := range originalReq.Question {
-		if s.isInterestingDomain(q.Name) {
-			log.Debugf("Forwarded to %s: %s %s", s.upstreamDNS, q.Name, dns.TypeToString[q.Qtype])
-		}
+		log.Debugf("Forwarded to %s: %s %s", upstream.Address, q.Name, dns.TypeToString[q.Qtype])
 	}
+
+	return stripDNSSEC(originalReq, resp)
 }
 
-// isInterestingDomain checks if we should log this domain
-func (s *Server) isInterestingDomain(domain string) bool {
-	domain = strings.ToLower(domain)
-	interestingDomains := []string{
-		"epicgames.com",
-		"unrealengine.com",
-		"fortnite.com",
-	}
+// prefetch refreshes a popular cache entry before it expires
+func (s *Server) prefetch(r *dns.Msg) {
+	defer s.cache.prefetchDone(r)
 
-	for _, interesting := range interestingDomains {
-		if strings.Contains(domain, interesting) {
-			return true
-		}
+	pool, zone := s.poolFor(r.Question[0].Name)
+	resp, _, err := pool.Exchange(r)
+	if err != nil {
+		log.Debugf("Prefetch of %s failed: %v", r.Question[0].Name, err)
+		return
+	}
+	if s.validator != nil && !r.CheckingDisabled && zone == "" {
+		resp, _ = s.validator.Validate(r, resp)
 	}
-	return false
+	s.cache.Set(r, resp)
 }
 
-// Start starts the DNS server on the specified address
-func (s *Server) Start(address string) error {
+// Start binds the listen addresses and starts serving DNS on them
+func (s *Server) Start() error {
 	// Update redirects before starting
 	s.updateRedirects()
 
-	// Test if we can bind to the ports
-	if err := s.testPortAvailability(address); err != nil {
+	listeners, err := s.openListeners()
+	if err != nil {
 		return err
 	}
-
-	// Create UDP server
-	s.udpServer = &dns.Server{
-		Addr:    address,
-		Net:     "udp",
-		Handler: dns.HandlerFunc(s.handleDNSRequest),
-	}
-
-	// Create TCP server
-	s.tcpServer = &dns.Server{
-		Addr:    address,
-		Net:     "tcp",
-		Handler: dns.HandlerFunc(s.handleDNSRequest),
+	s.listeners = listeners
+
+	for _, listener := range listeners {
+		s.servers = append(s.servers, &dns.Server{
+			PacketConn: listener.packetConn,
+			Listener:   listener.listener,
+			Net:        listener.protocol(),
+			Handler:    s.handler(listener.protocol()),
+		})
+		log.Infof("Starting DNS server on %s", listener)
 	}
 
-	log.Infof("Starting DNS server on %s (UDP/TCP)", address)
-
-	// Start UDP server in a goroutine
-	go func() {
-		if err := s.udpServer.ListenAndServe(); err != nil {
-			log.Errorf("Failed to start DNS UDP server: %v", err)
+	// Probe upstreams in the background so dead resolvers leave rotation
+	if interval, err := config.ParseDuration(config.Config.DNS.HealthCheckInterval); err == nil {
+		s.upstreams.StartHealthChecks(interval)
+		for _, zone := range s.zones {
+			zone.pool.StartHealthChecks(interval)
 		}
-	}()
+	}
+	if interval, err := config.ParseDuration(config.Config.DNS.Blocklists.ReloadInterval); err == nil {
+		s.blocklist.StartReloading(interval)
+	}
+	s.startSchedule()
 
-	// Start TCP server in a goroutine
-	go func() {
-		if err := s.tcpServer.ListenAndServe(); err != nil {
-			log.Errorf("Failed to start DNS TCP server: %v", err)
-		}
-	}()
+	for i, server := range s.servers {
+		go func() {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Errorf("DNS server on %s stopped: %v", listeners[i], err)
+			}
+		}()
+	}
 
 	// Give the servers a moment to start
 	time.Sleep(100 * time.Millisecond)
 
-	log.Infof("DNS server started successfully with %d active redirects", len(config.GetEnabledRedirects()))
-	return nil
-}
-
-// testPortAvailability tests if the UDP and TCP ports are available
-func (s *Server) testPortAvailability(address string) error {
-	// Test UDP port
-	listener, err := net.ListenPacket("udp", address)
-	if err != nil {
-		return fmt.Errorf("failed to bind UDP port %s: %v", address, err)
-	}
-	listener.Close()
-
-	// Test TCP port
-	tcpListener, err := net.Listen("tcp", address)
-	if err != nil {
-		return fmt.Errorf("failed to bind TCP port %s: %v", address, err)
-	}
-	tcpListener.Close()
-
+	log.Infof("DNS server started successfully with %d active redirects", len(config.GetActiveRedirects(time.Now())))
 	return nil
 }
 
 // Stop stops the DNS server
 func (s *Server) Stop() error {
-	var udpErr, tcpErr error
+	var stopErr error
 
-	if s.udpServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		udpErr = s.udpServer.ShutdownContext(ctx)
+	s.upstreams.Stop()
+	for _, zone := range s.zones {
+		zone.pool.Stop()
+	}
+	s.blocklist.Stop()
+	s.targets.stop()
+	s.stopOnce.Do(func() {
+		close(s.stopSchedule)
+	})
+	if err := s.stopSecure(); err != nil {
+		log.Warnf("Failed to stop encrypted DNS listeners: %v", err)
 	}
 
-	if s.tcpServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		tcpErr = s.tcpServer.ShutdownContext(ctx)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range s.servers {
+		if err := server.ShutdownContext(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
 	}
 
-	if udpErr != nil {
-		return udpErr
+	if s.queryLog != nil {
+		if err := s.queryLog.Close(); err != nil {
+			log.Warnf("Failed to close query log: %v", err)
+		}
 	}
-	return tcpErr
+
+	return stopErr
 }
 
 // ReloadRedirects updates the server's redirect configuration
 func (s *Server) ReloadRedirects() {
 	log.Debug("Reloading DNS redirects from configuration")
 	s.updateRedirects()
-	log.Infof("Reloaded %d active DNS redirects", len(config.GetEnabledRedirects()))
+	log.Infof("Reloaded %d active DNS redirects", len(config.GetActiveRedirects(time.Now())))
 }
 
 // GetRedirectStatus returns information about current redirects
 func (s *Server) GetRedirectStatus() map[string]interface{} {
-	return map[string]interface{}{
-		"exact_redirects":    s.redirects,
-		"wildcard_redirects": s.redirectsWildcard,
-		"upstream_dns":       s.upstreamDNS,
-		"enabled_count":      len(config.GetEnabledRedirects()),
-		"total_count":        len(config.Config.DNS.Redirects),
+	s.mu.RLock()
+	patterns := s.redirects.Patterns()
+	s.mu.RUnlock()
+
+	status := map[string]interface{}{
+		"redirect_patterns": patterns,
+		"upstream_dns":      s.upstreams.Addresses(),
+		"upstream_strategy": s.upstreams.Strategy(),
+		"upstreams":         s.upstreams.Stats(),
+		"forward_zones":     s.forwardZoneStats(),
+		"enabled_count":     len(config.GetActiveRedirects(time.Now())),
+		"total_count":       len(config.Config.DNS.Redirects),
+		"blocked_queries":   s.blocklist.blocked.Load(),
+		"blocklist":         s.blocklist.Stats(),
+		"any_minimized":     s.anyMinimized.Load(),
+		"client_groups":     s.clientGroupStats(),
+		"redirect_targets":  s.targets.Stats(),
+	}
+
+	if s.cache != nil {
+		status["cache"] = s.cache.Stats()
+	}
+	if s.queryLog != nil {
+		status["query_log"] = s.queryLog.Path()
+	}
+	if s.limiter != nil {
+		status["rate_limit"] = s.limiter.Stats()
+	}
+	if s.validator != nil {
+		status["dnssec"] = s.validator.Stats()
+	}
+	if s.lan != nil {
+		status["lan"] = s.lan.String()
+	}
+	listeners := make([]string, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		listeners = append(listeners, listener.String())
 	}
+	status["listeners"] = listeners
+	return status
 }
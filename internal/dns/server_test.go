@@ -0,0 +1,29 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+func TestShadowedRedirects(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+
+	// Whichever comes first, the exclusion wins and the redirect is dropped
+	for _, redirects := range [][]config.DNSRedirect{
+		{{Domain: "app.example", Target: "192.0.2.10", Enabled: true}, {Domain: "!app.example", Enabled: true}},
+		{{Domain: "!app.example", Enabled: true}, {Domain: "app.example", Target: "192.0.2.10", Enabled: true}},
+	} {
+		config.Config.DNS.Redirects = redirects
+		s := newServer(nil, nil, true)
+		s.Stop()
+
+		if patterns := s.redirects.Patterns(); len(patterns) != 1 || patterns[0] != "!app.example" {
+			t.Errorf("%s first: patterns %v, want only the exclusion", redirects[0].Domain, patterns)
+		}
+		if names := s.reverse["192.0.2.10"]; len(names) != 0 {
+			t.Errorf("%s first: shadowed redirect reverses to %v", redirects[0].Domain, names)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package dns
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
 	"github.com/miekg/dns"
 	"github.com/simplyzetax/aegis/internal/config"
+	"github.com/simplyzetax/aegis/internal/ssl"
 )
 
 // Service manages both the DNS server and system DNS settings
@@ -19,66 +24,130 @@ type Service struct {
 // globalDNSService tracks the DNS service instance
 var globalDNSService *Service
 
-// NewService creates a new DNS service instance
-func NewService() *Service {
+// NewService creates a new DNS service instance. The manager has captured
+// the system's DNS settings, whose resolvers "system" upstreams forward to.
+func NewService(manager *Manager, lan *LANInterface) *Service {
 	return &Service{
-		server:  NewServer(),
-		manager: NewManager(),
+		server:  NewServer(manager.SystemResolvers(), lan),
+		manager: manager,
 	}
 }
 
 // StartService starts the DNS server and configures system DNS
 func StartService() (string, error) {
-	globalDNSService = NewService()
+	// In LAN mode everything binds to one interface that other devices can reach
+	var lan *LANInterface
+	if config.Config.LAN.Enabled {
+		var err error
+		if lan, err = SelectLANInterface(config.Config.LAN.Interface); err != nil {
+			return "", fmt.Errorf("LAN mode: %v", err)
+		}
+		log.Infof("LAN mode: serving on %s", lan)
+	}
 
-	// Get current DNS settings first
+	// Get current DNS settings first, before the server needs the system resolvers
+	manager := NewManager()
 	log.Info("Getting current DNS settings...")
-	if err := globalDNSService.manager.GetCurrentDNS(); err != nil {
+	if err := manager.GetCurrentDNS(); err != nil {
 		log.Warnf("Failed to get current DNS settings: %v", err)
 		log.Info("Continuing without DNS management...")
 	} else {
-		if len(globalDNSService.manager.GetOriginalDNS()) > 0 {
+		if len(manager.GetOriginalDNS()) > 0 {
 			log.Info("Current DNS settings saved")
 			// Set up signal handlers for graceful cleanup
-			globalDNSService.manager.SetupSignalHandlers()
+			manager.SetupSignalHandlers()
 		} else {
 			log.Info("No manageable network interfaces found")
 			log.Info("Continuing without DNS management...")
 		}
 	}
 
-	// Try to start DNS server on various ports
-	ports := []string{":53", ":8053", ":5353", ":9053", ":10053"}
+	globalDNSService = NewService(manager, lan)
 
-	var lastErr error
-	for _, port := range ports {
-		log.Debugf("Trying to start DNS server on port %s", port)
-		if err := globalDNSService.server.Start(port); err != nil {
-			lastErr = err
-			log.Debugf("Port %s failed: %v", port, err)
-			continue
-		}
+	if err := globalDNSService.server.Start(); err != nil {
+		return "", err
+	}
 
-		globalDNSService.port = port
-		log.Infof("DNS server successfully started on port %s", port)
-
-		// Configure system DNS if we have original settings and auto-manage is enabled
-		if config.Config.DNS.AutoManageSystem && len(globalDNSService.manager.GetOriginalDNS()) > 0 {
-			log.Info("Configuring system DNS to use local DNS server...")
-			if err := globalDNSService.manager.SetDNSToLocal(port); err != nil {
-				log.Warnf("Failed to configure system DNS: %v", err)
-				log.Infof("You may need to manually configure DNS to use 127.0.0.1")
-			} else {
-				log.Info("System DNS configured successfully")
-			}
+	port := globalDNSService.server.port()
+	globalDNSService.port = port
+	log.Infof("DNS server successfully started on port %s", port)
+
+	// Configure system DNS if we have original settings and auto-manage is enabled.
+	// Operating systems only ask port 53, so any other port is left to the user.
+	switch {
+	case !config.Config.DNS.AutoManageSystem || len(globalDNSService.manager.GetOriginalDNS()) == 0:
+		log.Infof("DNS management disabled or unavailable - manually configure DNS to use %s", ClientHost())
+	case port != ":53":
+		log.Warnf("Not configuring system DNS: the DNS server is not on port 53")
+	default:
+		log.Info("Configuring system DNS to use local DNS server...")
+		if err := globalDNSService.manager.SetDNSToLocal(port, ClientHost()); err != nil {
+			log.Warnf("Failed to configure system DNS: %v", err)
+			log.Infof("You may need to manually configure DNS to use %s", ClientHost())
 		} else {
-			log.Info("DNS management disabled or unavailable - manually configure DNS to use 127.0.0.1")
+			log.Info("System DNS configured successfully")
 		}
+	}
+
+	return port, nil
+}
 
-		return port, nil
+// ListenHost returns the host listeners bind to: the LAN interface's address
+// in LAN mode, otherwise "" for every address
+func ListenHost() string {
+	if globalDNSService == nil || globalDNSService.server == nil || globalDNSService.server.lan == nil {
+		return ""
 	}
+	return globalDNSService.server.lan.IPv4.String()
+}
 
-	return "", fmt.Errorf("failed to start DNS server on any port: %v", lastErr)
+// ClientHost returns the address clients use to reach the DNS server: the
+// LAN interface's address in LAN mode, otherwise a local listen address
+func ClientHost() string {
+	if globalDNSService == nil || globalDNSService.server == nil {
+		return "127.0.0.1"
+	}
+	return globalDNSService.server.clientHost()
+}
+
+// StartSecureListeners starts the DoT listener and the dedicated DoH listener
+// if they are enabled. proxyCert is used unless a separate certificate is configured.
+func StartSecureListeners(proxyCert tls.Certificate) error {
+	if globalDNSService == nil || globalDNSService.server == nil {
+		return fmt.Errorf("DNS service not started")
+	}
+
+	dnsConfig := config.Config.DNS
+
+	if dnsConfig.DoT.Enabled {
+		cert := proxyCert
+		if dnsConfig.DoT.Certificate != "" {
+			cert = ssl.LoadCert(dnsConfig.DoT.Certificate)
+		}
+		if err := globalDNSService.server.StartDoT(net.JoinHostPort(ListenHost(), dnsConfig.DoT.Port), cert); err != nil {
+			return err
+		}
+	}
+
+	if dnsConfig.DoH.Enabled && dnsConfig.DoH.Port != "" {
+		cert := proxyCert
+		if dnsConfig.DoH.Certificate != "" {
+			cert = ssl.LoadCert(dnsConfig.DoH.Certificate)
+		}
+		if err := globalDNSService.server.StartDoH(net.JoinHostPort(ListenHost(), dnsConfig.DoH.Port), dnsConfig.DoH.Path, cert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DoHHandler serves DNS-over-HTTPS on the proxy's own HTTPS listener
+func DoHHandler(c *fiber.Ctx) error {
+	if globalDNSService == nil || globalDNSService.server == nil {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("DNS service not started")
+	}
+	return globalDNSService.server.ServeDoH(c)
 }
 
 // StopService stops the DNS server and restores original DNS settings
@@ -98,6 +167,7 @@ func StopService() error {
 	if config.Config.DNS.AutoManageSystem && globalDNSService.manager != nil {
 		managerErr = globalDNSService.manager.RestoreOriginalDNS()
 	}
+	globalDNSService = nil
 
 	if serverErr != nil {
 		return serverErr
@@ -115,25 +185,37 @@ func TestDNSServer(port string) error {
 	client := new(dns.Client)
 	client.Timeout = 2 * time.Second
 
-	// Test with a configured redirect (if any exist)
-	redirects := config.GetEnabledRedirects()
-	if len(redirects) == 0 {
+	// Test with the first configured redirect that answers A queries
+	var redirect config.DNSRedirect
+	var expectedIPs []string
+	for _, candidate := range config.GetActiveRedirects(time.Now()) {
+		ipv4, _ := candidate.AddressTargets()
+		if candidate.IsExclusion() || candidate.CNAME != "" || len(ipv4) == 0 || strings.ContainsAny(candidate.Domain, "?[") {
+			continue
+		}
+		redirect = candidate
+		for _, ip := range ipv4 {
+			expectedIPs = append(expectedIPs, globalDNSService.server.lan.rewrite(net.ParseIP(ip)).String())
+		}
+		break
+	}
+	if len(expectedIPs) == 0 {
 		log.Info("No DNS redirects configured - skipping test")
 		return nil
 	}
 
-	// Use the first redirect for testing
-	testDomain := redirects[0].Domain
-	if testDomain[0] == '*' && len(testDomain) > 2 {
-		// For wildcard domains, create a test subdomain
-		testDomain = "test" + testDomain[1:]
+	// For wildcard domains, create a test subdomain
+	testDomain := redirect.Domain
+	if strings.HasPrefix(testDomain, "**.") {
+		testDomain = testDomain[3:]
 	}
+	testDomain = strings.ReplaceAll(testDomain, "*", "test")
 
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
 
 	// Use the actual server address
-	serverAddr := fmt.Sprintf("127.0.0.1%s", port)
+	serverAddr := net.JoinHostPort(ClientHost(), strings.TrimPrefix(port, ":"))
 	resp, _, err := client.Exchange(m, serverAddr)
 	if err != nil {
 		return fmt.Errorf("DNS test failed: %v", err)
@@ -145,13 +227,13 @@ func TestDNSServer(port string) error {
 
 	// Check if we got the expected redirect response
 	if a, ok := resp.Answer[0].(*dns.A); ok {
-		expectedIP := redirects[0].Target
-		if a.A.String() == expectedIP {
-			log.Debugf("DNS test successful: %s redirected to %s", testDomain, expectedIP)
-			return nil
-		} else {
-			return fmt.Errorf("unexpected DNS response: got %s, expected %s", a.A.String(), expectedIP)
+		for _, expectedIP := range expectedIPs {
+			if a.A.String() == expectedIP {
+				log.Debugf("DNS test successful: %s redirected to %s", testDomain, expectedIP)
+				return nil
+			}
 		}
+		return fmt.Errorf("unexpected DNS response: got %s, expected one of %s", a.A.String(), strings.Join(expectedIPs, ", "))
 	}
 
 	return fmt.Errorf("unexpected DNS response type")
@@ -177,10 +259,9 @@ func GetServiceStatus() map[string]interface{} {
 	}
 
 	status := map[string]interface{}{
-		"running":      true,
-		"port":         globalDNSService.port,
-		"auto_manage":  config.Config.DNS.AutoManageSystem,
-		"upstream_dns": config.Config.DNS.UpstreamDNS,
+		"running":     true,
+		"port":        globalDNSService.port,
+		"auto_manage": config.Config.DNS.AutoManageSystem,
 	}
 
 	// Add server status
@@ -195,6 +276,7 @@ func GetServiceStatus() map[string]interface{} {
 	if globalDNSService.manager != nil {
 		status["original_dns_count"] = len(globalDNSService.manager.GetOriginalDNS())
 		status["original_dns"] = globalDNSService.manager.GetOriginalDNS()
+		status["system_dns"] = globalDNSService.manager.SystemResolvers()
 	}
 
 	return status
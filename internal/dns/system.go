@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// fallbackUpstream is used when upstream_dns leaves no usable resolver
+const fallbackUpstream = "1.1.1.1:53"
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	// resolvedConfPath lists systemd-resolved's real upstreams behind its 127.0.0.53 stub
+	resolvedConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+// readSystemResolvers returns the resolvers the operating system is using
+// right now, from resolv.conf or, on macOS, scutil. Loopback stubs such as
+// systemd-resolved's are replaced by the servers behind them where known.
+func readSystemResolvers() []string {
+	servers := readResolvConf(resolvConfPath)
+	if allLoopback(servers) {
+		if behind := readResolvConf(resolvedConfPath); len(behind) > 0 {
+			servers = behind
+		}
+	}
+	if len(servers) > 0 || runtime.GOOS != "darwin" {
+		return servers
+	}
+
+	output, err := exec.Command("scutil", "--dns").Output()
+	if err != nil {
+		log.Debugf("Failed to read resolvers from scutil: %v", err)
+		return nil
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && strings.HasPrefix(key, "nameserver[") {
+			servers = appendServer(servers, strings.TrimSpace(value))
+		}
+	}
+	return servers
+}
+
+// readResolvConf returns the nameserver entries of a resolv.conf file
+func readResolvConf(path string) []string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var servers []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = appendServer(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// appendServer appends a resolver IP unless it is invalid or already listed.
+// Zone suffixes of link-local IPv6 resolvers ("fe80::1%en0") are kept.
+func appendServer(servers []string, server string) []string {
+	host, _, _ := strings.Cut(server, "%")
+	if net.ParseIP(host) == nil {
+		return servers
+	}
+	for _, existing := range servers {
+		if existing == server {
+			return servers
+		}
+	}
+	return append(servers, server)
+}
+
+// allLoopback reports whether every server is a loopback address
+func allLoopback(servers []string) bool {
+	for _, server := range servers {
+		if ip := net.ParseIP(server); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return len(servers) > 0
+}
+
+// upstreamAddresses expands "system" entries of an upstream list into the
+// system's resolvers and drops upstreams that would send queries back to
+// Aegis: loopback system resolvers, left behind when an earlier run didn't
+// restore the system settings, and any upstream at our own listen address
+func upstreamAddresses(configured, system []string, lan *LANInterface) []string {
+	own := ownListenAddresses(lan)
+
+	var addresses []string
+	for _, address := range configured {
+		if !strings.EqualFold(strings.TrimSpace(address), config.SystemUpstream) {
+			if isOwnAddress(address, own) {
+				log.Warnf("Skipping upstream DNS %s: it is this DNS server and would loop queries back to it", address)
+				continue
+			}
+			addresses = append(addresses, address)
+			continue
+		}
+
+		if len(system) == 0 {
+			log.Warnf("Upstream DNS \"system\": no system resolvers were found")
+		}
+		for _, server := range system {
+			if ip := net.ParseIP(server); (ip != nil && ip.IsLoopback()) || isOwnAddress(server, own) {
+				log.Warnf("Skipping system resolver %s: it points back at this machine, probably left over from an earlier run", server)
+				continue
+			}
+			addresses = append(addresses, server)
+		}
+	}
+	return addresses
+}
+
+// systemUnavailable explains why "system" in configured contributed none of
+// upstreams: no system resolvers were found, or all of them point back at
+// this machine, as when another instance owns the system's DNS. It returns
+// "" when "system" isn't configured or one of its resolvers is in use.
+func systemUnavailable(configured, system, upstreams []string) string {
+	wanted := false
+	for _, address := range configured {
+		if strings.EqualFold(strings.TrimSpace(address), config.SystemUpstream) {
+			wanted = true
+		}
+	}
+	if !wanted {
+		return ""
+	}
+
+	for _, server := range system {
+		for _, upstream := range upstreams {
+			if upstream == server {
+				return ""
+			}
+		}
+	}
+	if len(system) == 0 {
+		return "no system resolvers were found"
+	}
+	return fmt.Sprintf("the system resolvers %s point back at this machine", strings.Join(system, ", "))
+}
+
+// bootstrapResolvers returns the plain DNS servers host names of encrypted
+// upstreams are looked up through: the plain upstreams by IP, then the
+// system's resolvers that don't point back at this machine
+func bootstrapResolvers(upstreams, system []string, lan *LANInterface) []string {
+	own := ownListenAddresses(lan)
+
+	var resolvers []string
+	add := func(address string) {
+		spec, err := parseUpstreamSpec(address)
+		if err != nil || (spec.scheme != "udp" && spec.scheme != "tcp") {
+			return
+		}
+		ip := net.ParseIP(spec.host)
+		if ip == nil || ip.IsLoopback() || isOwnAddress(address, own) {
+			return
+		}
+		resolver := net.JoinHostPort(spec.host, spec.port)
+		for _, existing := range resolvers {
+			if existing == resolver {
+				return
+			}
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	for _, address := range upstreams {
+		add(address)
+	}
+	for _, address := range system {
+		add(address)
+	}
+	return resolvers
+}
+
+// ownListenAddresses returns the UDP/TCP addresses the DNS server listens on
+func ownListenAddresses(lan *LANInterface) []string {
+	dnsConfig := config.Config.DNS
+	var own []string
+	for _, value := range listenAddresses(dnsConfig, lan) {
+		if _, address, err := config.ParseListenAddress(value, dnsConfig.Port); err == nil {
+			own = append(own, address)
+		}
+	}
+	return own
+}
+
+// isOwnAddress reports whether a plain UDP/TCP upstream is one of the listen
+// addresses, counting every local address for listeners on all addresses
+func isOwnAddress(upstream string, own []string) bool {
+	spec, err := parseUpstreamSpec(upstream)
+	if err != nil || (spec.scheme != "udp" && spec.scheme != "tcp") {
+		return false
+	}
+	ip := net.ParseIP(spec.host)
+	if ip == nil {
+		return false
+	}
+
+	for _, address := range own {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || port != spec.port {
+			continue
+		}
+		listen := net.ParseIP(host)
+		switch {
+		case listen != nil && listen.Equal(ip):
+			return true
+		case (host == "" || listen.IsUnspecified()) && isLocalIP(ip):
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is loopback, unspecified or assigned to one
+// of this machine's interfaces
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// localIPv4 returns an address of a non-loopback interface of this machine
+func localIPv4(t *testing.T) string {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skipf("no interface addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return ""
+}
+
+func TestUpstreamAddresses(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	local := localIPv4(t)
+
+	tests := []struct {
+		name       string
+		listen     []string // empty listens on every address
+		configured []string
+		system     []string
+		want       []string
+	}{
+		{"loopback system resolvers are dropped", nil, []string{"system"}, []string{"127.0.0.1", "::1"}, nil},
+		{"usable system resolvers are kept", nil, []string{"system", "198.51.100.2"}, []string{"127.0.0.53", "198.51.100.1"}, []string{"198.51.100.1", "198.51.100.2"}},
+		{"no system resolvers", nil, []string{"system"}, nil, nil},
+		{"our listen address", []string{"127.0.0.1:5300"}, []string{"127.0.0.1:5300", "udp://127.0.0.1:5300", "127.0.0.1"}, nil, []string{"127.0.0.1"}},
+		{"a local IP while listening on every address", nil, []string{local, "tcp://" + local + ":53", "198.51.100.1"}, nil, []string{"198.51.100.1"}},
+		{"a local IP on another port", nil, []string{local + ":5353"}, nil, []string{local + ":5353"}},
+		{"a local IP not listened on", []string{"127.0.0.1:53"}, []string{local}, nil, []string{local}},
+		{"encrypted upstreams never loop", nil, []string{"tls://" + local}, nil, []string{"tls://" + local}},
+		{"our address as system resolver", []string{"198.51.100.9:53"}, []string{"system"}, []string{"198.51.100.9"}, nil},
+	}
+	for _, tt := range tests {
+		config.Config.DNS.Listen = tt.listen
+		if got := upstreamAddresses(tt.configured, tt.system, nil); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: upstreamAddresses(%v, %v) = %v, want %v", tt.name, tt.configured, tt.system, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	config.Config.DNS.UpstreamDNS = []string{config.SystemUpstream}
+
+	// Another instance owns the system's DNS: nothing usable is left
+	s := newServer([]string{"127.0.0.1"}, nil, true)
+	defer s.Stop()
+	if addresses := s.upstreams.Addresses(); len(addresses) != 1 || addresses[0] != fallbackUpstream {
+		t.Errorf("upstreams = %v, want the fallback %s", addresses, fallbackUpstream)
+	}
+	if !s.fallback || s.systemUnavailable == "" {
+		t.Error("falling back isn't recorded for traces")
+	}
+}
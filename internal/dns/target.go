@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// minTargetTTL and maxTargetTTL bound how long resolved hostname targets are used
+	minTargetTTL = 10 * time.Second
+	maxTargetTTL = time.Hour
+	// targetRetryInterval is how long a failed resolution is remembered, so a
+	// dead upstream doesn't hold up every query for the target
+	targetRetryInterval = 10 * time.Second
+)
+
+// hostTarget is a redirect target hostname with its resolved addresses
+type hostTarget struct {
+	name string
+
+	mu          sync.RWMutex
+	ipv4        []net.IP
+	ipv6        []net.IP
+	expires     time.Time
+	refreshAt   time.Time   // when to re-resolve in the background
+	err         error       // last resolution error
+	failedUntil time.Time   // when to retry after a failure
+	timer       *time.Timer // re-resolves the target at refreshAt or after a failure
+
+	resolving  sync.Mutex // serializes resolutions holding up queries
+	refreshing atomic.Bool
+}
+
+// targetResolver resolves hostname targets through the upstream pools,
+// bypassing redirects, and keeps them by TTL across redirect reloads. Every
+// target is re-resolved on a timer before its TTL runs out, so queries don't
+// wait for the upstream.
+type targetResolver struct {
+	poolFor func(name string) *UpstreamPool
+
+	mu      sync.Mutex
+	targets map[string]*hostTarget
+	stopped bool
+}
+
+// newTargetResolver creates a resolver asking the pool poolFor picks for each name
+func newTargetResolver(poolFor func(name string) *UpstreamPool) *targetResolver {
+	return &targetResolver{poolFor: poolFor, targets: map[string]*hostTarget{}}
+}
+
+// target returns the entry of a hostname, creating it if needed
+func (r *targetResolver) target(name string) *hostTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.targets[name]
+	if !ok {
+		t = &hostTarget{name: name}
+		r.targets[name] = t
+	}
+	return t
+}
+
+// update keeps the entries of names, resolving new ones in the background,
+// and drops the rest
+func (r *targetResolver) update(names map[string]bool) {
+	r.mu.Lock()
+	for name, t := range r.targets {
+		if !names[name] {
+			delete(r.targets, name)
+			t.stopTimer()
+		}
+	}
+	r.mu.Unlock()
+
+	for name := range names {
+		go r.lookup(name)
+	}
+}
+
+// stop ends the background refreshes of every target
+func (r *targetResolver) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	for _, t := range r.targets {
+		t.stopTimer()
+	}
+}
+
+// refresh re-resolves a target in the background unless it was dropped,
+// the resolver stopped or a refresh is already running
+func (r *targetResolver) refresh(t *hostTarget) {
+	r.mu.Lock()
+	wanted := !r.stopped && r.targets[t.name] == t
+	r.mu.Unlock()
+	if !wanted || !t.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	defer t.refreshing.Store(false)
+	r.resolve(t)
+}
+
+// lookup returns the addresses of a hostname target and the seconds they
+// remain valid. Fresh addresses are returned at once; a query that finds
+// them due for a refresh the timer hasn't done yet starts one in the
+// background. Expired ones are resolved first.
+func (r *targetResolver) lookup(name string) (ipv4, ipv6 []net.IP, ttl uint32, err error) {
+	t := r.target(name)
+	if ipv4, ipv6, ttl, ok := t.current(); ok {
+		if time.Now().After(t.refreshTime()) {
+			go r.refresh(t)
+		}
+		return ipv4, ipv6, ttl, nil
+	}
+
+	t.resolving.Lock()
+	defer t.resolving.Unlock()
+
+	// Another query may have resolved it meanwhile
+	if ipv4, ipv6, ttl, ok := t.current(); ok {
+		return ipv4, ipv6, ttl, nil
+	}
+	if err := t.recentError(); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := r.resolve(t); err != nil {
+		return nil, nil, 0, err
+	}
+	ipv4, ipv6, ttl, _ = t.current()
+	return ipv4, ipv6, ttl, nil
+}
+
+// current returns the target's addresses if they have not expired
+func (t *hostTarget) current() (ipv4, ipv6 []net.IP, ttl uint32, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	remaining := time.Until(t.expires)
+	if remaining <= 0 {
+		return nil, nil, 0, false
+	}
+	return t.ipv4, t.ipv6, uint32(max(remaining/time.Second, 1)), true
+}
+
+// refreshTime returns when the target should be re-resolved
+func (t *hostTarget) refreshTime() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.refreshAt
+}
+
+// recentError returns the last resolution error while it is still remembered
+func (t *hostTarget) recentError() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if time.Now().Before(t.failedUntil) {
+		return t.err
+	}
+	return nil
+}
+
+// stopTimer cancels the target's next background refresh
+func (t *hostTarget) stopTimer() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// scheduleRefresh arms the timer re-resolving the target after d; the caller holds t.mu
+func (r *targetResolver) scheduleRefresh(t *hostTarget, d time.Duration) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(d, func() { r.refresh(t) })
+}
+
+// resolve queries the target's A and AAAA records upstream. On failure the
+// previous addresses stay in use until they expire, and the target is
+// retried in the background.
+func (r *targetResolver) resolve(t *hostTarget) error {
+	pool := r.poolFor(t.name)
+
+	var ipv4, ipv6 []net.IP
+	var lastErr error
+	ttl := maxTargetTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(t.name, qtype)
+
+		resp, _, err := pool.Exchange(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("upstream answered %s", dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		// The answer may start with the CNAME chain leading to the addresses
+		for _, rr := range resp.Answer {
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			switch record := rr.(type) {
+			case *dns.A:
+				ipv4 = append(ipv4, record.A)
+			case *dns.AAAA:
+				ipv6 = append(ipv6, record.AAAA)
+			}
+		}
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no A or AAAA records")
+		}
+		if t.err == nil || t.err.Error() != lastErr.Error() {
+			log.Warnf("Failed to resolve redirect target %s: %v", strings.TrimSuffix(t.name, "."), lastErr)
+		}
+		t.err = lastErr
+		t.failedUntil = now.Add(targetRetryInterval)
+		r.scheduleRefresh(t, targetRetryInterval)
+		return lastErr
+	}
+
+	ttl = max(ttl, minTargetTTL)
+	if !sameIPs(t.ipv4, ipv4) || !sameIPs(t.ipv6, ipv6) {
+		log.Infof("Redirect target %s resolves to %s", strings.TrimSuffix(t.name, "."), joinIPs(append(ipv4, ipv6...)))
+	}
+	t.ipv4, t.ipv6 = ipv4, ipv6
+	t.expires = now.Add(ttl)
+	t.refreshAt = now.Add(ttl - ttl/5)
+	t.err = nil
+	t.failedUntil = time.Time{}
+	r.scheduleRefresh(t, ttl-ttl/5)
+	return nil
+}
+
+// sameIPs reports whether two address lists hold the same addresses
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, ip := range a {
+		seen[ip.String()] = true
+	}
+	for _, ip := range b {
+		if !seen[ip.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// joinIPs formats addresses as a comma-separated list
+func joinIPs(ips []net.IP) string {
+	values := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+	return strings.Join(values, ", ")
+}
+
+// Stats describes the hostname targets for the status output
+func (r *targetResolver) Stats() []map[string]interface{} {
+	r.mu.Lock()
+	targets := make([]*hostTarget, 0, len(r.targets))
+	for _, t := range r.targets {
+		targets = append(targets, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+
+	stats := make([]map[string]interface{}, 0, len(targets))
+	for _, t := range targets {
+		t.mu.RLock()
+		stat := map[string]interface{}{
+			"name":      strings.TrimSuffix(t.name, "."),
+			"addresses": joinIPs(append(append([]net.IP{}, t.ipv4...), t.ipv6...)),
+			"expires":   t.expires,
+		}
+		if t.err != nil {
+			stat["error"] = t.err.Error()
+		}
+		t.mu.RUnlock()
+		stats = append(stats, stat)
+	}
+	return stats
+}
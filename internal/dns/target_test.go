@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTargetUpstream starts a UDP server answering A queries with the
+// address in answer, and returns the pool asking it and the query counter
+func startTargetUpstream(t *testing.T, answer *atomic.Value) (*UpstreamPool, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := &atomic.Int32{}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP(answer.Load().(string)),
+				})
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	pool := NewUpstreamPool([]string{conn.LocalAddr().String()}, "", nil)
+	t.Cleanup(pool.Stop)
+	return pool, queries
+}
+
+// timerArmed reports whether a target has a background refresh scheduled
+func timerArmed(target *hostTarget) bool {
+	target.mu.RLock()
+	defer target.mu.RUnlock()
+	return target.timer != nil
+}
+
+func TestTargetBackgroundRefresh(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("192.0.2.1")
+	pool, queries := startTargetUpstream(t, &answer)
+	r := newTargetResolver(func(string) *UpstreamPool { return pool })
+
+	const name = "origin.example."
+	ipv4, _, ttl, err := r.lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipv4) != 1 || !ipv4[0].Equal(net.ParseIP("192.0.2.1")) || ttl > 300 {
+		t.Fatalf("lookup = %v with TTL %d, want 192.0.2.1 for up to 300s", ipv4, ttl)
+	}
+	target := r.target(name)
+	if !timerArmed(target) {
+		t.Fatal("no background refresh scheduled after resolving")
+	}
+
+	// What the timer runs: the new address is in place before any query asks
+	answer.Store("192.0.2.2")
+	r.refresh(target)
+	before := queries.Load()
+	if ipv4, _, _, _ := r.lookup(name); len(ipv4) != 1 || !ipv4[0].Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("lookup after the refresh = %v, want 192.0.2.2", ipv4)
+	}
+	if queries.Load() != before {
+		t.Error("lookup of a refreshed target went upstream")
+	}
+
+	// Dropped targets stop refreshing
+	r.update(map[string]bool{})
+	if timerArmed(target) {
+		t.Error("dropped target still has a refresh scheduled")
+	}
+	before = queries.Load()
+	r.refresh(target)
+	if queries.Load() != before {
+		t.Error("dropped target was refreshed")
+	}
+}
+
+func TestTargetResolverStop(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("192.0.2.1")
+	pool, queries := startTargetUpstream(t, &answer)
+	r := newTargetResolver(func(string) *UpstreamPool { return pool })
+
+	if _, _, _, err := r.lookup("origin.example."); err != nil {
+		t.Fatal(err)
+	}
+	target := r.target("origin.example.")
+	r.stop()
+	if timerArmed(target) {
+		t.Error("refresh still scheduled after stop")
+	}
+
+	before := queries.Load()
+	r.refresh(target)
+	if queries.Load() != before {
+		t.Error("stopped resolver refreshed a target")
+	}
+}
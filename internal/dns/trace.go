@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+// TraceStep is one decision taken while answering a traced query
+type TraceStep struct {
+	Elapsed time.Duration // since the query arrived
+	Message string
+}
+
+// QueryTrace is the answer to a traced query together with the decisions
+// that produced it
+type QueryTrace struct {
+	Client   string
+	Query    *dns.Msg
+	Response *dns.Msg
+	Steps    []TraceStep
+	Duration time.Duration
+}
+
+// tracef records a step of a traced query; untraced queries skip it
+func (qc *queryContext) tracef(format string, args ...interface{}) {
+	if qc.trace == nil {
+		return
+	}
+	qc.trace.Steps = append(qc.trace.Steps, TraceStep{
+		Elapsed: time.Since(qc.start),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Trace answers r the way a client at the given IP would get it, through the
+// ACL, redirects, block lists, cache and upstreams, recording every decision.
+// Rate limits don't apply.
+func (s *Server) Trace(r *dns.Msg, client string) *QueryTrace {
+	qc := newQueryContext(client, "trace")
+	qc.trace = &QueryTrace{Client: qc.client, Query: r}
+
+	if s.systemUnavailable != "" {
+		qc.tracef("upstream \"system\" is unavailable: %s", s.systemUnavailable)
+	}
+	if s.fallback {
+		qc.tracef("no usable upstream DNS is configured, forwarding to %s instead", fallbackUpstream)
+	}
+
+	if action := s.acl.actionFor(qc.client); action != ACLAllow {
+		qc.tracef("acl: client %s is %s", qc.client, action)
+	}
+	if refused, handled := s.applyACL(qc, r); handled {
+		if refused == nil {
+			qc.tracef("query dropped")
+		}
+		qc.trace.Response = refused
+	} else {
+		for _, q := range r.Question {
+			s.traceInactive(qc, strings.ToLower(q.Name))
+		}
+		qc.trace.Response = s.resolve(qc, r)
+	}
+
+	qc.trace.Duration = time.Since(qc.start)
+	return qc.trace
+}
+
+// NewQuery builds a recursive query for name. An IP address is looked up in
+// reverse like dig -x, and qtype defaults to A, or PTR for addresses.
+func NewQuery(name, qtype string) (*dns.Msg, error) {
+	name = strings.TrimSpace(name)
+	if ip := net.ParseIP(name); ip != nil {
+		name, _ = dns.ReverseAddr(ip.String())
+		if qtype == "" {
+			qtype = "PTR"
+		}
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return nil, fmt.Errorf("invalid domain name %q", name)
+	}
+
+	if qtype == "" {
+		qtype = "A"
+	}
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return nil, fmt.Errorf("unknown query type %q", qtype)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), t)
+	r.RecursionDesired = true
+	return r, nil
+}
+
+// TraceQuery traces r as the client at the given IP would send it. It goes
+// through the running DNS service, or when there is none in this process
+// through a temporary server built from the configuration, which doesn't
+// write the query log or resolve redirect targets it isn't asked about.
+func TraceQuery(r *dns.Msg, client string) (*QueryTrace, error) {
+	if net.ParseIP(client) == nil {
+		return nil, fmt.Errorf("invalid client IP %q", client)
+	}
+
+	if globalDNSService != nil && globalDNSService.server != nil {
+		return globalDNSService.server.Trace(r, client), nil
+	}
+
+	server := newServer(readSystemResolvers(), nil, true)
+	defer server.Stop()
+	return server.Trace(r, client), nil
+}
+
+// traceInactive notes the configured redirects matching name that are not
+// answering right now, the usual reason a redirect "doesn't take effect"
+func (s *Server) traceInactive(qc *queryContext, name string) {
+	now := time.Now()
+	redirects := config.Config.DNS.Redirects
+	if group := s.clientGroupFor(qc.client); group != nil {
+		redirects = append(append([]config.DNSRedirect{}, config.GroupRedirects(group.name)...), redirects...)
+	}
+
+	for _, redirect := range redirects {
+		if redirect.ActiveAt(now) {
+			continue
+		}
+		matcher := NewMatcher[struct{}]()
+		if err := matcher.Insert(strings.TrimPrefix(redirect.Domain, "!"), struct{}{}); err != nil {
+			continue
+		}
+		if _, ok := matcher.Match(name); !ok {
+			continue
+		}
+
+		reason := "disabled"
+		if redirect.Enabled {
+			reason = "outside its schedule: " + redirect.ScheduleSummary(now)
+		}
+		qc.tracef("redirect %s matches but is %s", redirect.Domain, reason)
+	}
+}
+
+// traceMatches records every pattern of redirects matching name and which one wins
+func traceMatches(qc *queryContext, redirects *Matcher[*redirectRule], name string) {
+	scope := "global redirects"
+	if qc.group != nil {
+		scope = "redirects of client group " + qc.group.name
+	}
+
+	matches := redirects.MatchAll(name)
+	if len(matches) == 0 {
+		qc.tracef("no pattern in the %s matches %s", scope, name)
+		return
+	}
+	for i, match := range matches {
+		switch {
+		case i > 0:
+			qc.tracef("skipped %s rule %s: %s is more specific", match.Kind, match.Pattern, matches[0].Pattern)
+		case match.Negated:
+			qc.tracef("%s exclusion %s matches, so no redirect applies", match.Kind, match.Pattern)
+		default:
+			qc.tracef("%s rule %s matches (%s)", match.Kind, match.Pattern, scope)
+		}
+	}
+}
+
+// Lines formats the trace like dig output: the question, the answer sections
+// and the trace steps with their timings
+func (t *QueryTrace) Lines() []string {
+	var lines []string
+	for _, q := range t.Query.Question {
+		lines = append(lines, fmt.Sprintf(";; QUESTION: %s %s from %s", q.Name, dns.TypeToString[q.Qtype], t.Client))
+	}
+
+	if t.Response == nil {
+		lines = append(lines, ";; no response (dropped)")
+	} else {
+		lines = append(lines, fmt.Sprintf(";; STATUS: %s, %d answers, %d authority",
+			dns.RcodeToString[t.Response.Rcode], len(t.Response.Answer), len(t.Response.Ns)))
+		lines = append(lines, formatSection("ANSWER", t.Response.Answer)...)
+		lines = append(lines, formatSection("AUTHORITY", t.Response.Ns)...)
+	}
+
+	lines = append(lines, "", ";; TRACE:")
+	for _, step := range t.Steps {
+		lines = append(lines, fmt.Sprintf("   +%7.2fms  %s", float64(step.Elapsed.Microseconds())/1000, step.Message))
+	}
+	lines = append(lines, fmt.Sprintf(";; Query time: %.2fms", float64(t.Duration.Microseconds())/1000))
+	return lines
+}
+
+// formatSection formats the records of a response section, leaving out OPT
+func formatSection(name string, rrs []dns.RR) []string {
+	var lines []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "", ";; "+name+" SECTION:")
+		}
+		lines = append(lines, rr.String())
+	}
+	return lines
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/simplyzetax/aegis/internal/config"
+)
+
+func TestNewQuery(t *testing.T) {
+	tests := []struct {
+		name, qtype string
+		wantName    string
+		wantType    uint16
+		wantErr     bool
+	}{
+		{"example.com", "", "example.com.", dns.TypeA, false},
+		{"example.com.", "aaaa", "example.com.", dns.TypeAAAA, false},
+		{"192.0.2.1", "", "1.2.0.192.in-addr.arpa.", dns.TypePTR, false},
+		{"2001:db8::1", "", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR, false},
+		{"", "", "", 0, true},
+		{"example.com", "BOGUS", "", 0, true},
+	}
+	for _, tt := range tests {
+		r, err := NewQuery(tt.name, tt.qtype)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewQuery(%q, %q) accepted", tt.name, tt.qtype)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewQuery(%q, %q): %v", tt.name, tt.qtype, err)
+			continue
+		}
+		if q := r.Question[0]; q.Name != tt.wantName || q.Qtype != tt.wantType || !r.RecursionDesired {
+			t.Errorf("NewQuery(%q, %q) = %s %s, want %s %s", tt.name, tt.qtype,
+				q.Name, dns.TypeToString[q.Qtype], tt.wantName, dns.TypeToString[tt.wantType])
+		}
+	}
+}
+
+func TestTraceQuery(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+
+	logPath := filepath.Join(t.TempDir(), "queries.jsonl")
+	config.Config.DNS.QueryLog = config.QueryLogConfig{Enabled: true, Path: logPath}
+	config.Config.DNS.Redirects = []config.DNSRedirect{
+		{Domain: "*.game.example", Target: "192.0.2.10", Enabled: true},
+		{Domain: "api.game.example", Target: "192.0.2.11"},
+	}
+
+	r, err := NewQuery("match.game.example", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := TraceQuery(r, "192.0.2.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Response == nil || len(trace.Response.Answer) != 1 || trace.Response.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Fatalf("traced answer = %v, want 192.0.2.10", trace.Response)
+	}
+	if output := strings.Join(trace.Lines(), "\n"); !strings.Contains(output, "*.game.example") {
+		t.Errorf("trace doesn't name the matching rule:\n%s", output)
+	}
+
+	// A disabled redirect that would match is pointed out
+	r, _ = NewQuery("api.game.example", "A")
+	trace, err = TraceQuery(r, "192.0.2.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := strings.Join(trace.Lines(), "\n"); !strings.Contains(output, "api.game.example matches but is disabled") {
+		t.Errorf("trace doesn't mention the disabled redirect:\n%s", output)
+	}
+
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("tracing without a running service created the query log (%v)", err)
+	}
+	if _, err := TraceQuery(r, "not-an-ip"); err == nil {
+		t.Error("invalid client IP accepted")
+	}
+}
+
+func TestTraceSystemUnavailable(t *testing.T) {
+	dnsConfig := config.Config.DNS
+	t.Cleanup(func() { config.Config.DNS = dnsConfig })
+	config.Config.DNS.UpstreamDNS = []string{config.SystemUpstream}
+	config.Config.DNS.Redirects = []config.DNSRedirect{{Domain: "app.example", Target: "192.0.2.10", Enabled: true}}
+
+	r, _ := NewQuery("app.example", "A")
+	tests := []struct {
+		system []string
+		want   []string // trace contents, none when the system resolvers are used
+	}{
+		// Another instance owns the system's DNS
+		{[]string{"127.0.0.1"}, []string{"the system resolvers 127.0.0.1 point back at this machine", "forwarding to " + fallbackUpstream}},
+		{nil, []string{"no system resolvers were found", "forwarding to " + fallbackUpstream}},
+		{[]string{"198.51.100.53"}, nil},
+	}
+	for _, tt := range tests {
+		s := newServer(tt.system, nil, true)
+		output := strings.Join(s.Trace(r, "192.0.2.100").Lines(), "\n")
+		s.Stop()
+
+		for _, want := range tt.want {
+			if !strings.Contains(output, want) {
+				t.Errorf("system %v: trace doesn't say %q:\n%s", tt.system, want, output)
+			}
+		}
+		if tt.want == nil && strings.Contains(output, "unavailable") {
+			t.Errorf("system %v: trace reports usable system resolvers as unavailable:\n%s", tt.system, output)
+		}
+	}
+}
@@ -0,0 +1,713 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// transport sends queries to an upstream over one protocol
+type transport interface {
+	exchange(r *dns.Msg) (*dns.Msg, time.Duration, error)
+	close()
+}
+
+// upstreamSpec is a parsed upstream entry from configuration
+type upstreamSpec struct {
+	scheme    string   // udp, tcp, tls, https or quic
+	host      string   // hostname or IP, used for TLS verification
+	port      string   // port to connect to
+	path      string   // DoH request path
+	bootstrap []string // IPs to connect to instead of resolving host
+	pins      []string // base64 SHA-256 SPKI pins
+}
+
+const (
+	dohContentType = "application/dns-message"
+	dotIdleConns   = 4
+)
+
+// parseUpstreamSpec parses an upstream entry. Plain "host" and "host:port"
+// entries are UDP; URLs select the protocol:
+//
+//	udp://9.9.9.9  tcp://9.9.9.9:53  tls://dns.quad9.net  https://dns.google/dns-query  quic://dns.adguard-dns.com
+//
+// The query parameters "bootstrap" (comma-separated IPs to connect to, so the
+// host never has to be resolved) and "pin" (base64 SHA-256 of the server's
+// SubjectPublicKeyInfo, repeatable) are consumed by Aegis and not sent upstream.
+func parseUpstreamSpec(address string) (*upstreamSpec, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return nil, fmt.Errorf("empty upstream address")
+	}
+
+	if !strings.Contains(address, "://") {
+		normalized, err := normalizeUpstreamAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		host, port, _ := net.SplitHostPort(normalized)
+		return &upstreamSpec{scheme: "udp", host: host, port: port}, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %q: %v", address, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream URL %q has no host", address)
+	}
+
+	spec := &upstreamSpec{scheme: strings.ToLower(u.Scheme), host: u.Hostname(), port: u.Port()}
+
+	query := u.Query()
+	for _, value := range query["bootstrap"] {
+		for _, ip := range strings.Split(value, ",") {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("upstream %q: bootstrap %q is not an IP address", address, ip)
+			}
+			spec.bootstrap = append(spec.bootstrap, ip)
+		}
+	}
+	for _, pin := range query["pin"] {
+		// Base64 may contain "+", which query decoding turns into a space
+		pin = strings.ReplaceAll(pin, " ", "+")
+		if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("upstream %q: pin must be a base64 SHA-256 digest", address)
+		}
+		spec.pins = append(spec.pins, pin)
+	}
+
+	defaultPort := ""
+	switch spec.scheme {
+	case "udp", "tcp":
+		defaultPort = "53"
+	case "tls", "quic":
+		defaultPort = "853"
+	case "https":
+		defaultPort = "443"
+		spec.path = u.EscapedPath()
+		if spec.path == "" {
+			spec.path = "/dns-query"
+		}
+	default:
+		return nil, fmt.Errorf("upstream %q: unsupported scheme %q", address, spec.scheme)
+	}
+	if spec.port == "" {
+		spec.port = defaultPort
+	}
+
+	if len(spec.pins) > 0 && spec.scheme != "tls" && spec.scheme != "https" && spec.scheme != "quic" {
+		return nil, fmt.Errorf("upstream %q: pins are only meaningful for tls://, https:// and quic://", address)
+	}
+
+	return spec, nil
+}
+
+// String returns a display form of the upstream without Aegis-specific parameters
+func (spec *upstreamSpec) String() string {
+	hostPort := net.JoinHostPort(spec.host, spec.port)
+	switch spec.scheme {
+	case "udp":
+		return hostPort
+	case "https":
+		return "https://" + hostPort + spec.path
+	default:
+		return spec.scheme + "://" + hostPort
+	}
+}
+
+// newTransport creates the transport for a parsed upstream. Encrypted
+// upstreams without bootstrap IPs look their host up through resolvers.
+func newTransport(spec *upstreamSpec, resolvers []string) transport {
+	switch spec.scheme {
+	case "tls":
+		return newTLSTransport(spec, resolvers)
+	case "https":
+		return newHTTPSTransport(spec, resolvers)
+	case "quic":
+		return newQUICTransport(spec, resolvers)
+	default:
+		return newPlainTransport(spec)
+	}
+}
+
+// plainTransport is classic DNS over UDP or TCP. Truncated UDP answers are
+// retried over TCP, and queries carry an EDNS cookie (RFC 7873) so the
+// upstream can tell our queries from spoofed ones.
+type plainTransport struct {
+	address   string
+	client    *dns.Client
+	tcpClient *dns.Client // nil when client already uses TCP
+
+	mu           sync.Mutex
+	clientCookie string
+	serverCookie string
+}
+
+func newPlainTransport(spec *upstreamSpec) *plainTransport {
+	t := &plainTransport{
+		address: net.JoinHostPort(spec.host, spec.port),
+		client:  &dns.Client{Net: spec.scheme, Timeout: upstreamTimeout},
+	}
+	if spec.scheme != "tcp" {
+		t.tcpClient = &dns.Client{Net: "tcp", Timeout: upstreamTimeout}
+	}
+
+	cookie := make([]byte, clientCookieLen/2)
+	rand.Read(cookie)
+	t.clientCookie = hex.EncodeToString(cookie)
+	return t
+}
+
+func (t *plainTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	query := t.withCookie(r)
+
+	resp, rtt, err := t.client.Exchange(query, t.address)
+	if err == nil && resp.Truncated && t.tcpClient != nil {
+		log.Debugf("Truncated answer from %s, retrying over TCP", t.address)
+		var tcpRTT time.Duration
+		resp, tcpRTT, err = t.tcpClient.Exchange(query, t.address)
+		rtt += tcpRTT
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	t.learnCookie(resp)
+	return resp, rtt, nil
+}
+
+// withCookie returns a copy of r carrying our cookie for this upstream
+func (t *plainTransport) withCookie(r *dns.Msg) *dns.Msg {
+	query := r.Copy()
+	opt := query.IsEdns0()
+	if opt == nil {
+		return query
+	}
+
+	t.mu.Lock()
+	cookie := t.clientCookie + t.serverCookie
+	t.mu.Unlock()
+
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return query
+}
+
+// learnCookie remembers the server cookie the upstream returned
+func (t *plainTransport) learnCookie(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok || len(cookie.Cookie) <= clientCookieLen || !strings.EqualFold(cookie.Cookie[:clientCookieLen], t.clientCookie) {
+			continue
+		}
+		t.mu.Lock()
+		t.serverCookie = cookie.Cookie[clientCookieLen:]
+		t.mu.Unlock()
+	}
+}
+
+func (t *plainTransport) close() {}
+
+// bootstrapDialer connects to an upstream host, preferring configured
+// bootstrap IPs over a DNS lookup of the host name. Lookups go to plain
+// resolvers and never to the system resolver, which is Aegis itself once it
+// manages the system DNS settings.
+type bootstrapDialer struct {
+	host      string
+	port      string
+	dialer    net.Dialer
+	resolvers []string // "ip:port" of plain DNS servers to look host up through
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newBootstrapDialer(spec *upstreamSpec, resolvers []string) *bootstrapDialer {
+	d := &bootstrapDialer{
+		host:      spec.host,
+		port:      spec.port,
+		dialer:    net.Dialer{Timeout: upstreamTimeout, KeepAlive: 30 * time.Second},
+		resolvers: resolvers,
+	}
+
+	switch {
+	case len(spec.bootstrap) > 0:
+		d.addrs = spec.bootstrap
+	case net.ParseIP(spec.host) != nil:
+		d.addrs = []string{spec.host}
+	default:
+		log.Debugf("Upstream %s has no bootstrap IPs, resolving it through %v", spec.host, resolvers)
+		if err := d.resolve(); err != nil {
+			log.Warnf("Failed to resolve upstream %s (add ?bootstrap=<ip> to avoid this): %v", spec.host, err)
+		}
+	}
+	return d
+}
+
+// resolve looks the host's A and AAAA records up through the first of the
+// plain resolvers that knows them
+func (d *bootstrapDialer) resolve() error {
+	if len(d.resolvers) == 0 {
+		return fmt.Errorf("no plain DNS resolver to look it up through")
+	}
+
+	client := &dns.Client{Timeout: upstreamTimeout}
+	var ips []string
+	var lastErr error
+	for _, resolver := range d.resolvers {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(d.host), qtype)
+			resp, _, err := client.Exchange(req, resolver)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch record := rr.(type) {
+				case *dns.A:
+					ips = append(ips, record.A.String())
+				case *dns.AAAA:
+					ips = append(ips, record.AAAA.String())
+				}
+			}
+		}
+		if len(ips) > 0 {
+			break
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no A or AAAA records")
+		}
+		return lastErr
+	}
+
+	d.mu.Lock()
+	d.addrs = ips
+	d.mu.Unlock()
+	return nil
+}
+
+// addresses returns the "ip:port" addresses of the upstream host, resolving
+// it first if that hasn't succeeded yet
+func (d *bootstrapDialer) addresses() ([]string, error) {
+	d.mu.Lock()
+	addrs := d.addrs
+	d.mu.Unlock()
+
+	if len(addrs) == 0 {
+		if err := d.resolve(); err != nil {
+			return nil, fmt.Errorf("cannot resolve upstream host %s: %v", d.host, err)
+		}
+		d.mu.Lock()
+		addrs = d.addrs
+		d.mu.Unlock()
+	}
+
+	hostPorts := make([]string, 0, len(addrs))
+	for _, ip := range addrs {
+		hostPorts = append(hostPorts, net.JoinHostPort(ip, d.port))
+	}
+	return hostPorts, nil
+}
+
+// DialContext connects to the first reachable address of the upstream host
+func (d *bootstrapDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	addrs, err := d.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// needsBootstrap reports whether connecting to an upstream needs a DNS lookup
+// of its host name
+func needsBootstrap(spec *upstreamSpec) bool {
+	switch spec.scheme {
+	case "tls", "https", "quic":
+		return len(spec.bootstrap) == 0 && net.ParseIP(spec.host) == nil
+	}
+	return false
+}
+
+// newTLSConfig builds a TLS configuration that verifies the upstream host name
+// and, when pins are configured, its public key
+func newTLSConfig(spec *upstreamSpec, nextProtos ...string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName:         spec.host,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         nextProtos,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+
+	if len(spec.pins) > 0 {
+		pins := spec.pins
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				fingerprint := base64.StdEncoding.EncodeToString(sum[:])
+				for _, pin := range pins {
+					if fingerprint == pin {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate presented by %s matches the configured SPKI pins", spec.host)
+		}
+	}
+	return cfg
+}
+
+// tlsTransport is DNS over TLS (RFC 7858) with a small pool of reusable connections
+type tlsTransport struct {
+	dialer    *bootstrapDialer
+	tlsConfig *tls.Config
+	idle      chan *dns.Conn
+}
+
+func newTLSTransport(spec *upstreamSpec, resolvers []string) *tlsTransport {
+	return &tlsTransport{
+		dialer:    newBootstrapDialer(spec, resolvers),
+		tlsConfig: newTLSConfig(spec, "dot"),
+		idle:      make(chan *dns.Conn, dotIdleConns),
+	}
+}
+
+// dial opens a new TLS connection to the upstream
+func (t *tlsTransport) dial() (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	raw, err := t.dialer.DialContext(ctx, "tcp", "")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, t.tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (t *tlsTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	// A pooled connection may have been closed by the server in the meantime,
+	// so a failure on a reused connection is retried once on a fresh one
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused := t.get()
+		if conn == nil {
+			var err error
+			if conn, err = t.dial(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		resp, err := t.roundTrip(conn, r)
+		if err != nil {
+			conn.Close()
+			if reused {
+				continue
+			}
+			return nil, 0, err
+		}
+
+		t.put(conn)
+		return resp, time.Since(start), nil
+	}
+
+	return nil, 0, fmt.Errorf("DNS-over-TLS exchange failed")
+}
+
+// roundTrip writes a query and reads the matching response on conn
+func (t *tlsTransport) roundTrip(conn *dns.Conn, r *dns.Msg) (*dns.Msg, error) {
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if err := conn.WriteMsg(r); err != nil {
+		return nil, err
+	}
+
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != r.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
+
+// get returns an idle connection if one is available
+func (t *tlsTransport) get() (*dns.Conn, bool) {
+	select {
+	case conn := <-t.idle:
+		return conn, true
+	default:
+		return nil, false
+	}
+}
+
+// put returns a connection to the idle pool, closing it if the pool is full
+func (t *tlsTransport) put(conn *dns.Conn) {
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (t *tlsTransport) close() {
+	for {
+		select {
+		case conn := <-t.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// httpsTransport is DNS over HTTPS (RFC 8484) using POST requests over a
+// keep-alive HTTP/2 client
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSTransport(spec *upstreamSpec, resolvers []string) *httpsTransport {
+	dialer := newBootstrapDialer(spec, resolvers)
+
+	return &httpsTransport{
+		url: "https://" + net.JoinHostPort(spec.host, spec.port) + spec.path,
+		client: &http.Client{
+			Timeout: upstreamTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSClientConfig:     newTLSConfig(spec),
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: dotIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: upstreamTimeout,
+			},
+		},
+	}
+}
+
+func (t *httpsTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 recommends ID 0 so responses are cache friendly
+	query := r.Copy()
+	query.Id = 0
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	start := time.Now()
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned HTTP %d", httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("invalid DoH response: %v", err)
+	}
+	resp.Id = r.Id
+	return resp, rtt, nil
+}
+
+func (t *httpsTransport) close() {
+	t.client.CloseIdleConnections()
+}
+
+// quicTransport is DNS over QUIC (RFC 9250): one stream per query over a
+// single QUIC connection that is kept open between queries
+type quicTransport struct {
+	dialer    *bootstrapDialer
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func newQUICTransport(spec *upstreamSpec, resolvers []string) *quicTransport {
+	return &quicTransport{
+		dialer:    newBootstrapDialer(spec, resolvers),
+		tlsConfig: newTLSConfig(spec, "doq"),
+	}
+}
+
+// connection returns the open QUIC connection, dialing one if there is none
+func (t *quicTransport) connection(ctx context.Context) (quic.Connection, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, true, nil
+	}
+
+	addrs, err := t.dialer.addresses()
+	if err != nil {
+		return nil, false, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := quic.DialAddr(ctx, addr, t.tlsConfig, &quic.Config{
+			HandshakeIdleTimeout: upstreamTimeout,
+			MaxIdleTimeout:       90 * time.Second,
+		})
+		if err == nil {
+			t.conn = conn
+			return conn, false, nil
+		}
+		lastErr = err
+	}
+	return nil, false, lastErr
+}
+
+// drop closes conn unless it was already replaced
+func (t *quicTransport) drop(conn quic.Connection) {
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+func (t *quicTransport) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 9250 requires ID 0; the client's ID is restored on the answer
+	query := r.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	start := time.Now()
+
+	// The server may have closed an idle connection, so a failure on a reused
+	// connection is retried once on a fresh one
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused, err := t.connection(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		resp, err := t.roundTrip(ctx, conn, packed)
+		if err != nil {
+			t.drop(conn)
+			if reused {
+				continue
+			}
+			return nil, 0, err
+		}
+		resp.Id = r.Id
+		return resp, time.Since(start), nil
+	}
+
+	return nil, 0, fmt.Errorf("DNS-over-QUIC exchange failed")
+}
+
+// roundTrip sends a packed query on a new stream of conn and reads the answer
+func (t *quicTransport) roundTrip(ctx context.Context, conn quic.Connection, packed []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// Messages carry a two-byte length prefix, and the client closes its
+	// side of the stream once the query is sent
+	msg := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(msg, uint16(len(packed)))
+	copy(msg[2:], packed)
+	if _, err := stream.Write(msg); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	stream.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid DoQ response: %v", err)
+	}
+	return resp, nil
+}
+
+func (t *quicTransport) close() {
+	t.mu.Lock()
+	conn := t.conn
+	t.conn = nil
+	t.mu.Unlock()
+	if conn != nil {
+		conn.CloseWithError(0, "")
+	}
+}
@@ -0,0 +1,364 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testHost is the name the test servers' certificate is issued for. It
+// doesn't resolve, so reaching the servers needs bootstrap IPs or resolvers.
+const testHost = "dns.test"
+
+// testCertificate creates a self-signed certificate for testHost and a pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testHost},
+		DNSNames:     []string{testHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// spkiPin returns the pin of a certificate as configured in upstream URLs
+func spkiPin(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// testAnswer answers every question with an A record for 192.0.2.1
+func testAnswer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range r.Question {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	return m
+}
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// startDoT starts a DNS-over-TLS stand-in on 127.0.0.1 and returns its port
+func startDoT(t *testing.T, cert tls.Certificate) (string, *countingListener) {
+	t.Helper()
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: raw}
+
+	server := &dns.Server{
+		Listener: tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(testAnswer(r))
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	_, port, _ := net.SplitHostPort(raw.Addr().String())
+	return port, listener
+}
+
+// startDoH starts a DNS-over-HTTPS stand-in and returns its port and a
+// counter of new connections
+func startDoH(t *testing.T, cert tls.Certificate) (string, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r := new(dns.Msg)
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dohContentType || r.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		packed, _ := testAnswer(r).Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return port, &conns
+}
+
+// startDoQ starts a DNS-over-QUIC stand-in and returns its port and a counter
+// of accepted connections
+func startDoQ(t *testing.T, cert tls.Certificate) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var length [2]byte
+					if _, err := io.ReadFull(stream, length[:]); err != nil {
+						return
+					}
+					body := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(stream, body); err != nil {
+						return
+					}
+					r := new(dns.Msg)
+					if r.Unpack(body) != nil || r.Id != 0 {
+						stream.CancelWrite(1)
+						continue
+					}
+					packed, _ := testAnswer(r).Pack()
+					stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, &conns
+}
+
+// startPlainResolver starts a UDP server answering testHost with 127.0.0.1
+func startPlainResolver(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Name == testHost+"." && r.Question[0].Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("127.0.0.1"),
+				})
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// trustTransport makes a transport trust the test certificate
+func trustTransport(t *testing.T, tr transport, roots *x509.CertPool) {
+	t.Helper()
+	switch tr := tr.(type) {
+	case *tlsTransport:
+		tr.tlsConfig.RootCAs = roots
+	case *httpsTransport:
+		tr.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	case *quicTransport:
+		tr.tlsConfig.RootCAs = roots
+	default:
+		t.Fatalf("unexpected transport %T", tr)
+	}
+}
+
+// newTestTransport parses address and creates its transport trusting roots
+func newTestTransport(t *testing.T, address string, resolvers []string, roots *x509.CertPool) transport {
+	t.Helper()
+	spec, err := parseUpstreamSpec(address)
+	if err != nil {
+		t.Fatalf("parseUpstreamSpec(%q): %v", address, err)
+	}
+	tr := newTransport(spec, resolvers)
+	trustTransport(t, tr, roots)
+	t.Cleanup(tr.close)
+	return tr
+}
+
+// exchangeA sends an A query for name and checks the test answer comes back
+func exchangeA(t *testing.T, tr transport, name string) {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	resp, _, err := tr.exchange(r)
+	if err != nil {
+		t.Fatalf("exchange %s: %v", name, err)
+	}
+	if resp.Id != r.Id {
+		t.Errorf("response ID %d, want %d", resp.Id, r.Id)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("answer %v, want 192.0.2.1", resp.Answer)
+	}
+}
+
+func TestEncryptedTransports(t *testing.T) {
+	cert, roots := testCertificate(t)
+	dotPort, dotListener := startDoT(t, cert)
+	dohPort, dohConns := startDoH(t, cert)
+	doqPort, doqConns := startDoQ(t, cert)
+
+	tests := []struct {
+		name        string
+		address     string
+		connections func() int32
+	}{
+		{"tls", "tls://" + testHost + ":" + dotPort + "?bootstrap=127.0.0.1", func() int32 { return dotListener.accepted.Load() }},
+		{"https", "https://" + testHost + ":" + dohPort + "/dns-query?bootstrap=127.0.0.1", dohConns.Load},
+		{"quic", "quic://" + testHost + ":" + doqPort + "?bootstrap=127.0.0.1", doqConns.Load},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestTransport(t, tt.address, nil, roots)
+			before := tt.connections()
+			for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+				exchangeA(t, tr, name)
+			}
+			if opened := tt.connections() - before; opened != 1 {
+				t.Errorf("%d connections for three queries, want 1 reused connection", opened)
+			}
+		})
+	}
+}
+
+func TestEncryptedTransportPins(t *testing.T) {
+	cert, roots := testCertificate(t)
+	dotPort, _ := startDoT(t, cert)
+	dohPort, _ := startDoH(t, cert)
+	doqPort, _ := startDoQ(t, cert)
+
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	for _, address := range []string{
+		"tls://" + testHost + ":" + dotPort,
+		"https://" + testHost + ":" + dohPort + "/dns-query",
+		"quic://" + testHost + ":" + doqPort,
+	} {
+		t.Run(strings.SplitN(address, ":", 2)[0], func(t *testing.T) {
+			good := newTestTransport(t, address+"?bootstrap=127.0.0.1&pin="+strings.ReplaceAll(spkiPin(cert), "+", "%2B"), nil, roots)
+			exchangeA(t, good, "pinned.example.")
+
+			bad := newTestTransport(t, address+"?bootstrap=127.0.0.1&pin="+strings.ReplaceAll(wrongPin, "+", "%2B"), nil, roots)
+			r := new(dns.Msg)
+			r.SetQuestion("pinned.example.", dns.TypeA)
+			if _, _, err := bad.exchange(r); err == nil || !strings.Contains(err.Error(), "SPKI pins") {
+				t.Errorf("exchange with a wrong pin: got %v, want a pin mismatch", err)
+			}
+		})
+	}
+}
+
+func TestBootstrapDialing(t *testing.T) {
+	cert, roots := testCertificate(t)
+	dotPort, _ := startDoT(t, cert)
+	resolver := startPlainResolver(t)
+
+	t.Run("bootstrap IPs", func(t *testing.T) {
+		// The unreachable address is skipped for the next one
+		tr := newTestTransport(t, "tls://"+testHost+":"+dotPort+"?bootstrap=127.0.0.2,127.0.0.1", nil, roots)
+		exchangeA(t, tr, "bootstrap.example.")
+	})
+
+	t.Run("plain resolver", func(t *testing.T) {
+		tr := newTestTransport(t, "tls://"+testHost+":"+dotPort, []string{resolver}, roots)
+		if addrs := tr.(*tlsTransport).dialer.addrs; len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Errorf("resolved %v, want [127.0.0.1]", addrs)
+		}
+		exchangeA(t, tr, "resolved.example.")
+	})
+
+	t.Run("no resolver", func(t *testing.T) {
+		if _, err := NewUpstream("tls://"+testHost+":"+dotPort, nil); err == nil {
+			t.Error("NewUpstream accepted a host name without bootstrap IPs or resolvers")
+		}
+		if _, err := NewUpstream("tls://127.0.0.1:"+dotPort, nil); err != nil {
+			t.Errorf("NewUpstream rejected an IP upstream: %v", err)
+		}
+	})
+}
+
+func TestBootstrapResolvers(t *testing.T) {
+	got := bootstrapResolvers(
+		[]string{"tls://dns.quad9.net", "9.9.9.9", "tcp://1.1.1.1:5353", "127.0.0.1:5300"},
+		[]string{"192.168.1.1", "9.9.9.9", "127.0.0.53"},
+		nil,
+	)
+	want := []string{"9.9.9.9:53", "1.1.1.1:5353", "192.168.1.1:53"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("bootstrapResolvers = %v, want %v", got, want)
+	}
+}
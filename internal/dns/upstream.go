@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	StrategyFailover = "failover" // try upstreams in configured order
+	StrategyParallel = "parallel" // race all healthy upstreams, first answer wins
+	StrategyFastest  = "fastest"  // prefer the upstream with the lowest observed latency
+)
+
+const (
+	upstreamTimeout = 3 * time.Second
+	// maxConsecutiveFailures takes an upstream out of rotation until it answers again
+	maxConsecutiveFailures = 3
+)
+
+// Upstream is a single upstream resolver together with its health and latency statistics
+type Upstream struct {
+	Address   string
+	transport transport
+
+	mu                  sync.Mutex
+	healthy             bool
+	latency             time.Duration // moving average over successful exchanges
+	queries             uint64
+	failures            uint64
+	consecutiveFailures int
+	lastError           string
+}
+
+// UpstreamPool distributes queries over a set of upstream resolvers
+type UpstreamPool struct {
+	upstreams []*Upstream
+	strategy  string
+	probe     dns.Question // what health checks ask
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewUpstream creates an upstream from a configured entry, either a plain
+// "host[:port]" address or a udp://, tcp://, tls://, https:// or quic:// URL.
+// resolvers are the plain DNS servers encrypted upstreams without bootstrap
+// IPs look their host name up through.
+func NewUpstream(address string, resolvers []string) (*Upstream, error) {
+	spec, err := parseUpstreamSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	if needsBootstrap(spec) && len(resolvers) == 0 {
+		return nil, fmt.Errorf("no plain DNS resolver is available to look up %s, add ?bootstrap=<ip>", spec.host)
+	}
+
+	return &Upstream{
+		Address:   spec.String(),
+		transport: newTransport(spec, resolvers),
+		healthy:   true,
+	}, nil
+}
+
+// normalizeUpstreamAddress adds the default DNS port when none is given
+func normalizeUpstreamAddress(address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("empty upstream address")
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if host == "" || port == "" {
+			return "", fmt.Errorf("invalid upstream address %q", address)
+		}
+		return address, nil
+	}
+
+	// No port given; this also covers bare IPv6 addresses
+	return net.JoinHostPort(address, "53"), nil
+}
+
+// NewUpstreamPool creates a pool from configured addresses. Invalid entries are
+// logged and skipped.
+func NewUpstreamPool(addresses []string, strategy string, resolvers []string) *UpstreamPool {
+	pool := &UpstreamPool{
+		strategy: strategy,
+		probe:    dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+		stop:     make(chan struct{}),
+	}
+
+	for _, address := range addresses {
+		upstream, err := NewUpstream(address, resolvers)
+		if err != nil {
+			log.Warnf("Skipping upstream DNS %q: %v", address, err)
+			continue
+		}
+		pool.upstreams = append(pool.upstreams, upstream)
+	}
+
+	if pool.strategy == "" {
+		pool.strategy = StrategyFailover
+	}
+	return pool
+}
+
+// Exchange sends a query to the pool according to its strategy and returns the
+// response together with the upstream that produced it
+func (p *UpstreamPool) Exchange(r *dns.Msg) (*dns.Msg, *Upstream, error) {
+	if len(p.upstreams) == 0 {
+		return nil, nil, fmt.Errorf("no upstream DNS servers configured")
+	}
+	r = upstreamQuery(r)
+
+	switch p.strategy {
+	case StrategyParallel:
+		return p.exchangeParallel(r)
+	case StrategyFastest:
+		return p.exchangeSequential(r, p.byLatency())
+	default:
+		return p.exchangeSequential(r, p.inOrder())
+	}
+}
+
+// exchangeSequential tries candidates one after another until one answers usefully
+func (p *UpstreamPool) exchangeSequential(r *dns.Msg, candidates []*Upstream) (*dns.Msg, *Upstream, error) {
+	var lastResp *dns.Msg
+	var lastUpstream *Upstream
+	var lastErr error
+
+	for _, upstream := range candidates {
+		resp, err := upstream.Exchange(r)
+		if err != nil {
+			lastErr = err
+			log.Debugf("Upstream %s failed, trying next: %v", upstream.Address, err)
+			continue
+		}
+		if isServerFailure(resp) {
+			lastResp, lastUpstream = resp, upstream
+			log.Debugf("Upstream %s answered %s, trying next", upstream.Address, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, upstream, nil
+	}
+
+	if lastResp != nil {
+		return lastResp, lastUpstream, nil
+	}
+	return nil, nil, fmt.Errorf("all upstream DNS servers failed: %v", lastErr)
+}
+
+// exchangeParallel races all candidates and returns the first useful answer
+func (p *UpstreamPool) exchangeParallel(r *dns.Msg) (*dns.Msg, *Upstream, error) {
+	type result struct {
+		resp     *dns.Msg
+		upstream *Upstream
+		err      error
+	}
+
+	// Only healthy upstreams race; the others get a chance when none is left
+	candidates := p.healthy()
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+	results := make(chan result, len(candidates))
+	for _, upstream := range candidates {
+		go func(upstream *Upstream, req *dns.Msg) {
+			resp, err := upstream.Exchange(req)
+			results <- result{resp: resp, upstream: upstream, err: err}
+		}(upstream, r.Copy())
+	}
+
+	var fallback *result
+	var lastErr error
+	for range candidates {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		if isServerFailure(res.resp) {
+			fallback = &res
+			continue
+		}
+		return res.resp, res.upstream, nil
+	}
+
+	if fallback != nil {
+		return fallback.resp, fallback.upstream, nil
+	}
+	return nil, nil, fmt.Errorf("all upstream DNS servers failed: %v", lastErr)
+}
+
+// inOrder returns healthy upstreams in configured order, followed by unhealthy
+// ones as a last resort
+func (p *UpstreamPool) inOrder() []*Upstream {
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	var unhealthy []*Upstream
+
+	for _, upstream := range p.upstreams {
+		if upstream.IsHealthy() {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// healthy returns the upstreams currently in rotation, in configured order
+func (p *UpstreamPool) healthy() []*Upstream {
+	var healthy []*Upstream
+	for _, upstream := range p.upstreams {
+		if upstream.IsHealthy() {
+			healthy = append(healthy, upstream)
+		}
+	}
+	return healthy
+}
+
+// byLatency returns upstreams ordered by observed latency, healthy ones first.
+// Upstreams that were never measured sort first so they get a chance to be.
+func (p *UpstreamPool) byLatency() []*Upstream {
+	candidates := p.inOrder()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		hi, hj := candidates[i].IsHealthy(), candidates[j].IsHealthy()
+		if hi != hj {
+			return hi
+		}
+		return candidates[i].Latency() < candidates[j].Latency()
+	})
+	return candidates
+}
+
+// isServerFailure reports whether a response indicates the upstream could not answer
+func isServerFailure(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+}
+
+// Exchange sends a single query to this upstream and records the outcome
+func (u *Upstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	resp, rtt, err := u.transport.exchange(r)
+	u.record(rtt, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream DNS %s: %v", u.Address, err)
+	}
+	return resp, nil
+}
+
+// record updates the statistics after an exchange
+func (u *Upstream) record(rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.queries++
+	if err != nil {
+		u.failures++
+		u.consecutiveFailures++
+		u.lastError = err.Error()
+		if u.healthy && u.consecutiveFailures >= maxConsecutiveFailures {
+			u.healthy = false
+			log.Warnf("Upstream DNS %s marked down after %d consecutive failures", u.Address, u.consecutiveFailures)
+		}
+		return
+	}
+
+	// Any answer returns an upstream to rotation, also when health checks are disabled
+	u.consecutiveFailures = 0
+	if !u.healthy {
+		u.healthy = true
+		log.Infof("Upstream DNS %s is reachable again, returning it to rotation", u.Address)
+	}
+	if u.latency == 0 {
+		u.latency = rtt
+	} else {
+		u.latency = (u.latency*7 + rtt*3) / 10
+	}
+}
+
+// IsHealthy reports whether the upstream is currently in rotation
+func (u *Upstream) IsHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// Latency returns the moving average latency of successful exchanges
+func (u *Upstream) Latency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
+
+// probeZone makes health checks ask for the SOA of zone instead of the root
+// NS set, which resolvers authoritative only for zone refuse
+func (p *UpstreamPool) probeZone(zone string) {
+	p.probe = dns.Question{Name: dns.Fqdn(zone), Qtype: dns.TypeSOA, Qclass: dns.ClassINET}
+}
+
+// checkHealth probes the upstream with question q. Unlike queries, a single
+// failed or refused probe takes the upstream out of rotation.
+func (u *Upstream) checkHealth(q dns.Question) {
+	probe := new(dns.Msg)
+	probe.SetQuestion(q.Name, q.Qtype)
+
+	resp, rtt, err := u.transport.exchange(probe)
+	if err == nil && isServerFailure(resp) {
+		err = fmt.Errorf("health check answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	u.record(rtt, err)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil && u.healthy {
+		u.healthy = false
+		log.Warnf("Upstream DNS %s failed health check, taking it out of rotation: %v", u.Address, err)
+	}
+}
+
+// StartHealthChecks probes every upstream periodically until Stop is called
+func (p *UpstreamPool) StartHealthChecks(interval time.Duration) {
+	if interval <= 0 || len(p.upstreams) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				var wg sync.WaitGroup
+				for _, upstream := range p.upstreams {
+					wg.Add(1)
+					go func(upstream *Upstream) {
+						defer wg.Done()
+						upstream.checkHealth(p.probe)
+					}(upstream)
+				}
+				wg.Wait()
+			}
+		}
+	}()
+}
+
+// Stop ends background health checking and closes pooled connections
+func (p *UpstreamPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		for _, upstream := range p.upstreams {
+			upstream.transport.close()
+		}
+	})
+}
+
+// Stats returns per-upstream health, latency and error counters
+func (p *UpstreamPool) Stats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		u.mu.Lock()
+		stats = append(stats, map[string]interface{}{
+			"address":    u.Address,
+			"healthy":    u.healthy,
+			"latency_ms": float64(u.latency.Microseconds()) / 1000,
+			"queries":    u.queries,
+			"errors":     u.failures,
+			"last_error": u.lastError,
+		})
+		u.mu.Unlock()
+	}
+	return stats
+}
+
+// Strategy returns the pool's selection strategy
+func (p *UpstreamPool) Strategy() string {
+	return p.strategy
+}
+
+// Addresses returns the configured upstream addresses
+func (p *UpstreamPool) Addresses() []string {
+	addresses := make([]string, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		addresses = append(addresses, u.Address)
+	}
+	return addresses
+}
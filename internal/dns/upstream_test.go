@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// deadUpstream returns a local address nothing answers on
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	return address
+}
+
+// newTestPool creates a pool over addresses that is stopped with the test
+func newTestPool(t *testing.T, strategy string, addresses ...string) *UpstreamPool {
+	t.Helper()
+	pool := NewUpstreamPool(addresses, strategy, nil)
+	if len(pool.upstreams) != len(addresses) {
+		t.Fatalf("pool has %d upstreams, want %d", len(pool.upstreams), len(addresses))
+	}
+	t.Cleanup(pool.Stop)
+	return pool
+}
+
+// exchangeTestHost asks pool for testHost and returns the upstream that answered
+func exchangeTestHost(t *testing.T, pool *UpstreamPool) *Upstream {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(testHost+".", dns.TypeA)
+	resp, upstream, err := pool.Exchange(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer %v, want the A record of %s", resp.Answer, testHost)
+	}
+	return upstream
+}
+
+// markDown takes an upstream out of rotation the way failed queries do
+func markDown(u *Upstream) {
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		u.record(0, errors.New("timeout"))
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	dead, first, second := deadUpstream(t), startPlainResolver(t), startPlainResolver(t)
+	pool := newTestPool(t, "", dead, first, second)
+
+	if upstream := exchangeTestHost(t, pool); upstream.Address != first {
+		t.Errorf("answered by %s, want the first working upstream %s", upstream.Address, first)
+	}
+	if pool.upstreams[0].queries != 1 || pool.upstreams[2].queries != 0 {
+		t.Error("failover didn't try upstreams in configured order")
+	}
+
+	// After enough failures the dead upstream leaves rotation and is tried last
+	for i := 1; i < maxConsecutiveFailures; i++ {
+		exchangeTestHost(t, pool)
+	}
+	if pool.upstreams[0].IsHealthy() {
+		t.Fatalf("upstream still healthy after %d consecutive failures", maxConsecutiveFailures)
+	}
+	if order := pool.inOrder(); order[0].Address != first || order[2].Address != dead {
+		t.Errorf("order after marking down = %s, %s, %s; want the dead upstream last",
+			order[0].Address, order[1].Address, order[2].Address)
+	}
+}
+
+func TestUpstreamRecovery(t *testing.T) {
+	// Health checks are off, so only a successful query can restore the upstream
+	pool := newTestPool(t, "", startPlainResolver(t))
+	upstream := pool.upstreams[0]
+
+	markDown(upstream)
+	if upstream.IsHealthy() {
+		t.Fatal("upstream still healthy after failing")
+	}
+	exchangeTestHost(t, pool)
+	if !upstream.IsHealthy() {
+		t.Error("upstream stayed down after answering")
+	}
+
+	// A passing health check keeps it in rotation; a single failed one takes an upstream out
+	upstream.checkHealth(dns.Question{Name: "probe.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if !upstream.IsHealthy() {
+		t.Fatal("NOERROR health check failed")
+	}
+	dead := newTestPool(t, "", deadUpstream(t)).upstreams[0]
+	dead.checkHealth(pool.probe)
+	if dead.IsHealthy() {
+		t.Error("unreachable upstream passed the health check")
+	}
+}
+
+func TestUpstreamFastest(t *testing.T) {
+	slow, fast, unmeasured, down := startPlainResolver(t), startPlainResolver(t), startPlainResolver(t), startPlainResolver(t)
+	pool := newTestPool(t, StrategyFastest, slow, fast, unmeasured, down)
+	pool.upstreams[0].latency = 40 * time.Millisecond
+	pool.upstreams[1].latency = 5 * time.Millisecond
+	pool.upstreams[3].latency = time.Millisecond
+	markDown(pool.upstreams[3])
+
+	want := []string{unmeasured, fast, slow, down}
+	for i, upstream := range pool.byLatency() {
+		if upstream.Address != want[i] {
+			t.Errorf("position %d is %s, want %s", i, upstream.Address, want[i])
+		}
+	}
+	if upstream := exchangeTestHost(t, pool); upstream.Address != unmeasured {
+		t.Errorf("answered by %s, want the unmeasured upstream %s", upstream.Address, unmeasured)
+	}
+}
+
+func TestUpstreamParallel(t *testing.T) {
+	pool := newTestPool(t, StrategyParallel, startPlainResolver(t), startPlainResolver(t))
+	up, down := pool.upstreams[0], pool.upstreams[1]
+	markDown(down)
+	sent := down.queries
+
+	if upstream := exchangeTestHost(t, pool); upstream != up {
+		t.Errorf("answered by %s, want the healthy upstream %s", upstream.Address, up.Address)
+	}
+	if down.queries != sent {
+		t.Error("upstream out of rotation was raced")
+	}
+
+	// With none healthy, the pool still races them all
+	markDown(up)
+	exchangeTestHost(t, pool)
+}
@@ -2,11 +2,15 @@ package ui
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/huh"
 	"github.com/charmbracelet/log"
 	"github.com/simplyzetax/aegis/internal/config"
+	"github.com/simplyzetax/aegis/internal/dns"
 	"github.com/simplyzetax/aegis/internal/ssl"
 )
 
@@ -430,31 +434,53 @@ func cleanupCertificatesForm() error {
 
 // DNSRedirectManagerForm shows the DNS redirect management interface
 func DNSRedirectManagerForm() error {
+	return redirectManagerForm("")
+}
+
+// redirectManagerForm manages the redirects of a client group, or the global
+// redirects when group is empty
+func redirectManagerForm(group string) error {
 	for {
-		action, err := showRedirectMainMenu()
+		action, err := showRedirectMainMenu(group)
 		if err != nil {
 			return err
 		}
 
 		switch action {
 		case "list":
-			showRedirectList()
+			showRedirectList(group)
 		case "add":
-			if err := addRedirectForm(); err != nil {
+			if err := addRedirectForm(group); err != nil {
 				log.Errorf("Failed to add redirect: %v", err)
 			}
 		case "edit":
-			if err := editRedirectForm(); err != nil {
+			if err := editRedirectForm(group); err != nil {
 				log.Errorf("Failed to edit redirect: %v", err)
 			}
 		case "toggle":
-			if err := toggleRedirectForm(); err != nil {
+			if err := toggleRedirectForm(group); err != nil {
 				log.Errorf("Failed to toggle redirect: %v", err)
 			}
+		case "enable-for":
+			if err := enableRedirectForForm(group); err != nil {
+				log.Errorf("Failed to enable redirect: %v", err)
+			}
 		case "remove":
-			if err := removeRedirectForm(); err != nil {
+			if err := removeRedirectForm(group); err != nil {
 				log.Errorf("Failed to remove redirect: %v", err)
 			}
+		case "import":
+			if err := importRedirectsForm(); err != nil {
+				log.Errorf("Failed to import redirects: %v", err)
+			}
+		case "learn":
+			if err := learnModeForm(); err != nil {
+				log.Errorf("Learn mode error: %v", err)
+			}
+		case "groups":
+			if err := clientGroupManagerForm(); err != nil {
+				log.Errorf("Client group management error: %v", err)
+			}
 		case "exit":
 			return nil
 		}
@@ -462,22 +488,37 @@ func DNSRedirectManagerForm() error {
 }
 
 // showRedirectMainMenu displays the main menu for redirect management
-func showRedirectMainMenu() (string, error) {
+func showRedirectMainMenu(group string) (string, error) {
 	var action string
 
+	options := []huh.Option[string]{
+		huh.NewOption("📋 List current redirects", "list"),
+		huh.NewOption("➕ Add new redirect", "add"),
+		huh.NewOption("✏️  Edit redirect", "edit"),
+		huh.NewOption("🔄 Toggle redirect on/off", "toggle"),
+		huh.NewOption("⏱️  Enable redirect for a while", "enable-for"),
+		huh.NewOption("🗑️  Remove redirect", "remove"),
+	}
+	title, description, back := "DNS Redirect Management", "Manage your DNS redirects", "🚪 Back to main menu"
+	if group == "" {
+		options = append(options,
+			huh.NewOption("📥 Import from hosts or zone file", "import"),
+			huh.NewOption("🎓 Learn redirects from a game session", "learn"),
+			huh.NewOption("👥 Client groups", "groups"),
+		)
+	} else {
+		title = fmt.Sprintf("Redirects of client group %s", group)
+		description = "These redirects only apply to the group's clients"
+		back = "🚪 Back to client groups"
+	}
+	options = append(options, huh.NewOption(back, "exit"))
+
 	form := huh.NewForm(
 		huh.NewGroup(
 			huh.NewSelect[string]().
-				Title("DNS Redirect Management").
-				Description("Manage your DNS redirects").
-				Options(
-					huh.NewOption("📋 List current redirects", "list"),
-					huh.NewOption("➕ Add new redirect", "add"),
-					huh.NewOption("✏️  Edit redirect", "edit"),
-					huh.NewOption("🔄 Toggle redirect on/off", "toggle"),
-					huh.NewOption("🗑️  Remove redirect", "remove"),
-					huh.NewOption("🚪 Back to main menu", "exit"),
-				).
+				Title(title).
+				Description(description).
+				Options(options...).
 				Value(&action),
 		),
 	)
@@ -486,8 +527,8 @@ func showRedirectMainMenu() (string, error) {
 }
 
 // showRedirectList displays all current redirects
-func showRedirectList() {
-	redirects := config.Config.DNS.Redirects
+func showRedirectList(group string) {
+	redirects := config.GroupRedirects(group)
 
 	if len(redirects) == 0 {
 		log.Info("No DNS redirects configured")
@@ -495,32 +536,234 @@ func showRedirectList() {
 	}
 
 	log.Info("Current DNS redirects:")
+	now := time.Now()
 	for i, redirect := range redirects {
 		status := "✅ Enabled"
-		if !redirect.Enabled {
+		switch {
+		case !redirect.Enabled:
 			status = "❌ Disabled"
+		case !redirect.ActiveAt(now):
+			status = "⏰ Inactive"
 		}
 		log.Infof("%d. %s -> %s (%s) [%s]",
-			i+1, redirect.Domain, redirect.Target, redirect.Description, status)
+			i+1, redirect.Domain, redirect.Summary(), redirect.Description, status)
+		if redirect.IsScheduled() {
+			log.Infof("   scheduled: %s", redirect.ScheduleSummary(now))
+		}
+		if redirect.Source != "" {
+			log.Infof("   imported from %s", redirect.Source)
+		}
+	}
+}
+
+// redirectRecordFields holds the record inputs shared by the add and edit forms
+type redirectRecordFields struct {
+	targets string // comma-separated IPv4 and IPv6 addresses, or a hostname
+	cname   string
+	txt     string // "|"-separated TXT values
+	srv     string // comma-separated "priority weight port target" entries
+	ttl     string // seconds, empty for the default
+}
+
+// newRedirectRecordFields fills the inputs from an existing redirect
+func newRedirectRecordFields(redirect config.DNSRedirect) *redirectRecordFields {
+	ipv4, ipv6 := redirect.AddressTargets()
+
+	var srv []string
+	for _, record := range redirect.SRV {
+		srv = append(srv, record.String())
+	}
+
+	targets := append(ipv4, ipv6...)
+	if host := redirect.HostTarget(); host != "" {
+		targets = append([]string{host}, targets...)
+	}
+
+	fields := &redirectRecordFields{
+		targets: strings.Join(targets, ", "),
+		cname:   redirect.CNAME,
+		txt:     strings.Join(redirect.TXT, " | "),
+		srv:     strings.Join(srv, ", "),
+	}
+	if redirect.TTL > 0 {
+		fields.ttl = strconv.FormatUint(uint64(redirect.TTL), 10)
+	}
+	return fields
+}
+
+// group returns the form group for the record inputs
+func (f *redirectRecordFields) group() *huh.Group {
+	return huh.NewGroup(
+		huh.NewInput().
+			Title("Targets").
+			Description("IPv4 and/or IPv6 addresses, comma-separated (usually 127.0.0.1), answered round-robin. Or a hostname, resolved through upstream DNS").
+			Value(&f.targets).
+			Placeholder("127.0.0.1"),
+		huh.NewInput().
+			Title("CNAME alias (optional)").
+			Description("Answer with an alias to another name instead of addresses").
+			Value(&f.cname),
+		huh.NewInput().
+			Title("TXT records (optional)").
+			Description("Separate multiple records with |").
+			Value(&f.txt),
+		huh.NewInput().
+			Title("SRV records (optional)").
+			Description("\"priority weight port target\", comma-separated, e.g. 10 5 443 game.example.com").
+			Value(&f.srv),
+		huh.NewInput().
+			Title("TTL (optional)").
+			Description("Seconds clients may cache the answers, default 300").
+			Value(&f.ttl).
+			Placeholder("300"),
+	)
+}
+
+// apply writes the inputs into redirect
+func (f *redirectRecordFields) apply(redirect *config.DNSRedirect) error {
+	redirect.Target = ""
+	redirect.IPv4 = nil
+	redirect.IPv6 = nil
+	redirect.CNAME = strings.TrimSpace(f.cname)
+	redirect.TXT = nil
+	redirect.SRV = nil
+	redirect.TTL = 0
+
+	if ttl := strings.TrimSpace(f.ttl); ttl != "" {
+		seconds, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a TTL in seconds", ttl)
+		}
+		redirect.TTL = uint32(seconds)
+	}
+
+	targets := splitList(f.targets, ",")
+	for _, target := range targets {
+		ip := net.ParseIP(target)
+		switch {
+		case ip == nil && len(targets) > 1:
+			return fmt.Errorf("%q is not an IP address; a hostname must be the only target", target)
+		case ip == nil:
+			redirect.Target = target
+		case redirect.Target == "":
+			redirect.Target = ip.String()
+		case ip.To4() != nil:
+			redirect.IPv4 = append(redirect.IPv4, ip.String())
+		default:
+			redirect.IPv6 = append(redirect.IPv6, ip.String())
+		}
+	}
+
+	redirect.TXT = splitList(f.txt, "|")
+
+	for _, entry := range splitList(f.srv, ",") {
+		record, err := config.ParseSRVRecord(entry)
+		if err != nil {
+			return err
+		}
+		redirect.SRV = append(redirect.SRV, record)
+	}
+
+	return nil
+}
+
+// splitList splits a separated input and drops empty entries
+func splitList(value, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// redirectScheduleFields holds the time limit inputs shared by the add and edit forms
+type redirectScheduleFields struct {
+	from     string
+	until    string
+	schedule string
+	duration string
+}
+
+// newRedirectScheduleFields fills the inputs from an existing redirect
+func newRedirectScheduleFields(redirect config.DNSRedirect) *redirectScheduleFields {
+	return &redirectScheduleFields{
+		from:     redirect.ActiveFrom,
+		until:    redirect.ActiveUntil,
+		schedule: redirect.Schedule,
+		duration: redirect.ScheduleDuration,
+	}
+}
+
+// group returns the form group for the time limit inputs
+func (f *redirectScheduleFields) group() *huh.Group {
+	return huh.NewGroup(
+		huh.NewInput().
+			Title("Active from (optional)").
+			Description("Local time such as 2025-06-01 18:00; empty means now").
+			Value(&f.from),
+		huh.NewInput().
+			Title("Active until (optional)").
+			Description("Local time such as 2025-06-01 22:00, or a duration from now such as 2h; empty means forever").
+			Value(&f.until),
+		huh.NewInput().
+			Title("Schedule (optional)").
+			Description("Cron expression starting each active window, e.g. \"0 18 * * fri\" or @daily").
+			Value(&f.schedule),
+		huh.NewInput().
+			Title("Window length").
+			Description("How long the redirect stays active each time the schedule fires, e.g. 2h").
+			Value(&f.duration),
+	)
+}
+
+// apply writes the inputs into redirect
+func (f *redirectScheduleFields) apply(redirect *config.DNSRedirect) error {
+	redirect.ActiveFrom = ""
+	redirect.ActiveUntil = ""
+	redirect.Schedule = strings.TrimSpace(f.schedule)
+	redirect.ScheduleDuration = strings.TrimSpace(f.duration)
+
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{{f.from, &redirect.ActiveFrom}, {f.until, &redirect.ActiveUntil}} {
+		value := strings.TrimSpace(field.value)
+		if value == "" {
+			continue
+		}
+		// A duration is relative to now, which makes "for the next two hours" easy
+		if d, err := time.ParseDuration(value); err == nil {
+			*field.target = time.Now().Add(d).Truncate(time.Second).Format(time.RFC3339)
+			continue
+		}
+		t, err := config.ParseTime(value)
+		if err != nil {
+			return err
+		}
+		*field.target = t.Format(time.RFC3339)
 	}
+	return nil
 }
 
 // addRedirectForm shows the form to add a new redirect
-func addRedirectForm() error {
-	var domain, target, description string
+func addRedirectForm(group string) error {
+	var domain, description string
 	enabled := true
+	records := &redirectRecordFields{}
+	schedule := &redirectScheduleFields{}
 
 	form := huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
 				Title("Domain pattern").
-				Description("e.g., *.example.com or specific.domain.com").
+				Description("e.g., *.example.com, **.example.com, api-*.example.com or !excluded.example.com").
 				Value(&domain),
-			huh.NewInput().
-				Title("Target IP").
-				Description("IP address to redirect to (usually 127.0.0.1)").
-				Value(&target).
-				Placeholder("127.0.0.1"),
+		),
+		records.group(),
+		schedule.group(),
+		huh.NewGroup(
 			huh.NewInput().
 				Title("Description").
 				Description("Human-readable description for this redirect").
@@ -535,32 +778,34 @@ func addRedirectForm() error {
 		return err
 	}
 
-	if domain == "" || target == "" {
-		return fmt.Errorf("domain and target are required")
+	redirect := config.DNSRedirect{
+		Domain:  domain,
+		Enabled: enabled,
 	}
-
-	if description == "" {
-		description = fmt.Sprintf("Redirect %s to %s", domain, target)
+	if err := records.apply(&redirect); err != nil {
+		return err
+	}
+	if err := schedule.apply(&redirect); err != nil {
+		return err
 	}
 
-	redirect := config.DNSRedirect{
-		Domain:      domain,
-		Target:      target,
-		Description: description,
-		Enabled:     enabled,
+	if description == "" {
+		description = fmt.Sprintf("Redirect %s to %s", domain, redirect.Summary())
 	}
+	redirect.Description = description
 
-	if err := config.AddRedirect(redirect); err != nil {
+	if err := config.AddGroupRedirect(group, redirect); err != nil {
 		return err
 	}
 
-	log.Infof("Added redirect: %s -> %s", domain, target)
+	log.Infof("Added redirect: %s -> %s", domain, redirect.Summary())
 	return nil
 }
 
 // editRedirectForm shows the form to edit an existing redirect
-func editRedirectForm() error {
-	if len(config.Config.DNS.Redirects) == 0 {
+func editRedirectForm(group string) error {
+	redirects := config.GroupRedirects(group)
+	if len(redirects) == 0 {
 		log.Info("No redirects to edit")
 		return nil
 	}
@@ -569,13 +814,13 @@ func editRedirectForm() error {
 	var selectedIndex int
 	var options []huh.Option[int]
 
-	for i, redirect := range config.Config.DNS.Redirects {
+	for i, redirect := range redirects {
 		status := "Enabled"
 		if !redirect.Enabled {
 			status = "Disabled"
 		}
 		label := fmt.Sprintf("%s -> %s (%s) [%s]",
-			redirect.Domain, redirect.Target, redirect.Description, status)
+			redirect.Domain, redirect.Summary(), redirect.Description, status)
 		options = append(options, huh.NewOption(label, i))
 	}
 
@@ -593,20 +838,22 @@ func editRedirectForm() error {
 	}
 
 	// Edit the selected redirect
-	redirect := config.Config.DNS.Redirects[selectedIndex]
+	redirect := redirects[selectedIndex]
 	domain := redirect.Domain
-	target := redirect.Target
 	description := redirect.Description
 	enabled := redirect.Enabled
+	records := newRedirectRecordFields(redirect)
+	schedule := newRedirectScheduleFields(redirect)
 
 	editForm := huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
 				Title("Domain pattern").
 				Value(&domain),
-			huh.NewInput().
-				Title("Target IP").
-				Value(&target),
+		),
+		records.group(),
+		schedule.group(),
+		huh.NewGroup(
 			huh.NewInput().
 				Title("Description").
 				Value(&description),
@@ -621,24 +868,28 @@ func editRedirectForm() error {
 	}
 
 	// Update the redirect
-	config.Config.DNS.Redirects[selectedIndex] = config.DNSRedirect{
-		Domain:      domain,
-		Target:      target,
-		Description: description,
-		Enabled:     enabled,
+	redirect.Domain = domain
+	redirect.Description = description
+	redirect.Enabled = enabled
+	if err := records.apply(&redirect); err != nil {
+		return err
+	}
+	if err := schedule.apply(&redirect); err != nil {
+		return err
 	}
 
-	if err := config.Save(); err != nil {
+	if err := config.UpdateGroupRedirect(group, selectedIndex, redirect); err != nil {
 		return err
 	}
 
-	log.Infof("Updated redirect: %s -> %s", domain, target)
+	log.Infof("Updated redirect: %s -> %s", domain, redirect.Summary())
 	return nil
 }
 
 // toggleRedirectForm shows the form to toggle redirects on/off
-func toggleRedirectForm() error {
-	if len(config.Config.DNS.Redirects) == 0 {
+func toggleRedirectForm(group string) error {
+	redirects := config.GroupRedirects(group)
+	if len(redirects) == 0 {
 		log.Info("No redirects to toggle")
 		return nil
 	}
@@ -646,13 +897,13 @@ func toggleRedirectForm() error {
 	var selectedIndex int
 	var options []huh.Option[int]
 
-	for i, redirect := range config.Config.DNS.Redirects {
+	for i, redirect := range redirects {
 		status := "✅ Enabled"
 		if !redirect.Enabled {
 			status = "❌ Disabled"
 		}
 		label := fmt.Sprintf("%s -> %s (%s) [%s]",
-			redirect.Domain, redirect.Target, redirect.Description, status)
+			redirect.Domain, redirect.Summary(), redirect.Description, status)
 		options = append(options, huh.NewOption(label, i))
 	}
 
@@ -669,11 +920,11 @@ func toggleRedirectForm() error {
 		return err
 	}
 
-	if err := config.ToggleRedirect(selectedIndex); err != nil {
+	if err := config.ToggleGroupRedirect(group, selectedIndex); err != nil {
 		return err
 	}
 
-	redirect := config.Config.DNS.Redirects[selectedIndex]
+	redirect := config.GroupRedirects(group)[selectedIndex]
 	status := "enabled"
 	if !redirect.Enabled {
 		status = "disabled"
@@ -682,9 +933,63 @@ func toggleRedirectForm() error {
 	return nil
 }
 
+// enableRedirectForForm enables a redirect until a duration from now, after
+// which the running server stops answering it on its own
+func enableRedirectForForm(group string) error {
+	redirects := config.GroupRedirects(group)
+	if len(redirects) == 0 {
+		log.Info("No redirects to enable")
+		return nil
+	}
+
+	var selectedIndex int
+	var options []huh.Option[int]
+	for i, redirect := range redirects {
+		if redirect.Schedule != "" {
+			continue
+		}
+		label := fmt.Sprintf("%s -> %s (%s)", redirect.Domain, redirect.Summary(), redirect.Description)
+		options = append(options, huh.NewOption(label, i))
+	}
+	if len(options) == 0 {
+		log.Info("Every redirect follows a schedule; edit one to change it")
+		return nil
+	}
+
+	duration := "2h"
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[int]().
+				Title("Select redirect to enable").
+				Options(options...).
+				Value(&selectedIndex),
+			huh.NewInput().
+				Title("For how long?").
+				Description("e.g., 30m, 2h or 24h").
+				Value(&duration),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(duration))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", duration)
+	}
+	if err := config.EnableGroupRedirectFor(group, selectedIndex, d); err != nil {
+		return err
+	}
+
+	redirect := config.GroupRedirects(group)[selectedIndex]
+	log.Infof("Redirect %s is enabled %s", redirect.Domain, redirect.ScheduleSummary(time.Now()))
+	return nil
+}
+
 // removeRedirectForm shows the form to remove redirects
-func removeRedirectForm() error {
-	if len(config.Config.DNS.Redirects) == 0 {
+func removeRedirectForm(group string) error {
+	redirects := config.GroupRedirects(group)
+	if len(redirects) == 0 {
 		log.Info("No redirects to remove")
 		return nil
 	}
@@ -692,13 +997,13 @@ func removeRedirectForm() error {
 	var selectedIndex int
 	var options []huh.Option[int]
 
-	for i, redirect := range config.Config.DNS.Redirects {
+	for i, redirect := range redirects {
 		status := "Enabled"
 		if !redirect.Enabled {
 			status = "Disabled"
 		}
 		label := fmt.Sprintf("%s -> %s (%s) [%s]",
-			redirect.Domain, redirect.Target, redirect.Description, status)
+			redirect.Domain, redirect.Summary(), redirect.Description, status)
 		options = append(options, huh.NewOption(label, i))
 	}
 
@@ -715,13 +1020,13 @@ func removeRedirectForm() error {
 		return err
 	}
 
-	redirect := config.Config.DNS.Redirects[selectedIndex]
+	redirect := redirects[selectedIndex]
 	var confirm bool
 
 	confirmForm := huh.NewForm(
 		huh.NewGroup(
 			huh.NewConfirm().
-				Title(fmt.Sprintf("Remove redirect %s -> %s?", redirect.Domain, redirect.Target)).
+				Title(fmt.Sprintf("Remove redirect %s -> %s?", redirect.Domain, redirect.Summary())).
 				Description("This action cannot be undone").
 				Value(&confirm),
 		),
@@ -735,14 +1040,464 @@ func removeRedirectForm() error {
 		return nil
 	}
 
-	if err := config.RemoveRedirect(selectedIndex); err != nil {
+	if err := config.RemoveGroupRedirect(group, selectedIndex); err != nil {
 		return err
 	}
 
-	log.Infof("Removed redirect: %s -> %s", redirect.Domain, redirect.Target)
+	log.Infof("Removed redirect: %s -> %s", redirect.Domain, redirect.Summary())
 	return nil
 }
 
+// importRedirectsForm imports redirects from a hosts or zone file. It previews
+// the changes, asks about each domain that already has a redirect from
+// elsewhere and then applies the chosen changes.
+func importRedirectsForm() error {
+	var path, format, origin string
+
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("File to import").
+				Description("A hosts file or an RFC 1035 zone file. Importing the same file again updates its redirects").
+				Value(&path),
+			huh.NewSelect[string]().
+				Title("Format").
+				Options(
+					huh.NewOption("Detect from file name", ""),
+					huh.NewOption("Hosts file", config.ImportHosts),
+					huh.NewOption("Zone file", config.ImportZone),
+				).
+				Value(&format),
+			huh.NewInput().
+				Title("Zone origin (optional)").
+				Description("Apex of zone files without $ORIGIN, taken from names like db.example.com when empty").
+				Value(&origin),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+
+	path = strings.TrimSpace(path)
+	redirects, warnings, err := config.ImportRedirects(path, format, strings.TrimSpace(origin))
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	if err != nil {
+		return err
+	}
+	source, err := config.ImportSource(path)
+	if err != nil {
+		return err
+	}
+
+	// An emptied file still removes what earlier imports of it added
+	changes := config.PlanImport(source, redirects)
+	if len(changes) == 0 {
+		log.Info("No redirects found in the file")
+		return nil
+	}
+	var options []huh.Option[int]
+	var selected, conflicts []int
+	unchanged := 0
+	for i, change := range changes {
+		switch change.Action {
+		case config.ImportUnchanged:
+			unchanged++
+		case config.ImportConflict:
+			conflicts = append(conflicts, i)
+		default:
+			options = append(options, huh.NewOption(importChangeLabel(change), i))
+			selected = append(selected, i)
+		}
+	}
+
+	if len(options) > 0 {
+		previewForm := huh.NewForm(
+			huh.NewGroup(
+				huh.NewMultiSelect[int]().
+					Title(fmt.Sprintf("Changes from %s", source)).
+					Description("Deselect the changes you don't want").
+					Options(options...).
+					Value(&selected),
+			),
+		)
+		if err := previewForm.Run(); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range conflicts {
+		change := changes[i]
+		existing := change.Existing()
+		from := "added by hand"
+		if existing.Source != "" {
+			from = "imported from " + existing.Source
+		}
+
+		var replace bool
+		conflictForm := huh.NewForm(
+			huh.NewGroup(
+				huh.NewConfirm().
+					Title(fmt.Sprintf("%s already redirects to %s", existing.Domain, existing.Summary())).
+					Description(fmt.Sprintf("The existing redirect was %s. Replace it with %s from the file?", from, change.Redirect.Summary())).
+					Affirmative("Replace").
+					Negative("Keep existing").
+					Value(&replace),
+			),
+		)
+		if err := conflictForm.Run(); err != nil {
+			return err
+		}
+		if replace {
+			selected = append(selected, i)
+		}
+	}
+
+	if len(selected) == 0 {
+		log.Infof("Nothing to import (%d redirects unchanged)", unchanged)
+		return nil
+	}
+
+	var apply []config.ImportChange
+	counts := map[string]int{}
+	for _, i := range selected {
+		apply = append(apply, changes[i])
+		counts[changes[i].Action]++
+	}
+	if err := config.ApplyImport(apply); err != nil {
+		return err
+	}
+
+	log.Infof("Imported %s: %d added, %d updated, %d replaced, %d removed, %d unchanged",
+		source, counts[config.ImportAdd], counts[config.ImportUpdate],
+		counts[config.ImportConflict], counts[config.ImportRemove], unchanged)
+	return nil
+}
+
+// importChangeLabel describes an import change in the preview
+func importChangeLabel(change config.ImportChange) string {
+	redirect := change.Redirect
+	switch change.Action {
+	case config.ImportUpdate:
+		return fmt.Sprintf("✏️  Update %s: %s -> %s", redirect.Domain, change.Existing().Summary(), redirect.Summary())
+	case config.ImportRemove:
+		return fmt.Sprintf("🗑️  Remove %s -> %s (no longer in the file)", redirect.Domain, redirect.Summary())
+	default:
+		return fmt.Sprintf("➕ Add %s -> %s", redirect.Domain, redirect.Summary())
+	}
+}
+
+// learnModeForm runs the DNS server while recording every name clients
+// query, then offers to redirect the chosen names or suggested wildcards
+func learnModeForm() error {
+	if _, err := dns.StartService(); err != nil {
+		return fmt.Errorf("failed to start DNS server: %v", err)
+	}
+	if err := dns.StartLearning(); err != nil {
+		dns.StopService()
+		return err
+	}
+
+	waitForm := huh.NewForm(
+		huh.NewGroup(
+			huh.NewNote().
+				Title("🎓 Learning").
+				Description(fmt.Sprintf("Point the device at %s if it doesn't use this machine's DNS, then start the game and play through login and matchmaking. Every name it looks up is recorded.", dns.ClientHost())).
+				Next(true).
+				NextLabel("Stop learning"),
+		),
+	)
+	runErr := waitForm.Run()
+	domains := dns.StopLearning()
+	if err := dns.StopService(); err != nil {
+		log.Warnf("Failed to stop DNS server: %v", err)
+	}
+	if runErr != nil {
+		return runErr
+	}
+	if len(domains) == 0 {
+		log.Info("No queries were recorded")
+		return nil
+	}
+
+	// Each pattern is offered once, under the domain it came from
+	var options []huh.Option[string]
+	source := map[string]dns.LearnedDomain{}
+	for _, domain := range domains {
+		log.Infof("%s: %d queries, %d names, first seen %s",
+			domain.Domain, domain.Count, len(domain.Names), domain.FirstSeen.Format("15:04:05"))
+		for _, pattern := range domain.Suggestions() {
+			options = append(options, huh.NewOption(fmt.Sprintf("%s (suggested wildcard)", pattern), pattern))
+			source[pattern] = domain
+		}
+		for _, name := range domain.Names {
+			label := fmt.Sprintf("%s (%d queries, %s)", name.Name, name.Count, strings.Join(name.Types, " "))
+			if name.Redirected {
+				label += " [redirected]"
+			}
+			log.Infof("   %s", label)
+			options = append(options, huh.NewOption("   "+label, name.Name))
+			source[name.Name] = domain
+		}
+	}
+
+	var selected []string
+	target := dns.ClientHost()
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewMultiSelect[string]().
+				Title("Names to redirect").
+				Description("Select single names or the suggested wildcards; nothing selected adds no redirects").
+				Options(options...).
+				Filterable(true).
+				Value(&selected),
+		),
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Target").
+				Description("IP address or hostname the selected names are redirected to").
+				Value(&target),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, redirect := range config.Config.DNS.Redirects {
+		existing[strings.ToLower(redirect.Domain)] = true
+	}
+	for _, pattern := range selected {
+		if existing[pattern] {
+			log.Infof("Skipping %s: a redirect for it already exists", pattern)
+			continue
+		}
+		redirect := source[pattern].Redirect(pattern, strings.TrimSpace(target))
+		if err := config.AddRedirect(redirect); err != nil {
+			log.Errorf("Failed to add redirect %s: %v", pattern, err)
+			continue
+		}
+		log.Infof("Added redirect: %s -> %s (%s)", pattern, redirect.Summary(), redirect.Description)
+	}
+	return nil
+}
+
+// clientGroupManagerForm manages the client groups that get their own redirects
+func clientGroupManagerForm() error {
+	for {
+		var action string
+		form := huh.NewForm(
+			huh.NewGroup(
+				huh.NewSelect[string]().
+					Title("Client Groups").
+					Description("Give some clients, by IP range or MAC address, their own redirects").
+					Options(
+						huh.NewOption("📋 List client groups", "list"),
+						huh.NewOption("➕ Add client group", "add"),
+						huh.NewOption("✏️  Edit client group", "edit"),
+						huh.NewOption("🌐 Manage a group's redirects", "redirects"),
+						huh.NewOption("🗑️  Remove client group", "remove"),
+						huh.NewOption("🚪 Back to DNS redirects", "exit"),
+					).
+					Value(&action),
+			),
+		)
+		if err := form.Run(); err != nil {
+			return err
+		}
+
+		switch action {
+		case "list":
+			showClientGroupList()
+		case "add":
+			if err := clientGroupForm(-1); err != nil {
+				log.Errorf("Failed to add client group: %v", err)
+			}
+		case "edit", "redirects", "remove":
+			index, ok, err := selectClientGroup()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			switch action {
+			case "edit":
+				err = clientGroupForm(index)
+			case "redirects":
+				err = redirectManagerForm(config.Config.DNS.ClientGroups[index].Name)
+			case "remove":
+				err = removeClientGroupForm(index)
+			}
+			if err != nil {
+				log.Errorf("Client group error: %v", err)
+			}
+		case "exit":
+			return nil
+		}
+	}
+}
+
+// showClientGroupList displays all client groups
+func showClientGroupList() {
+	groups := config.Config.DNS.ClientGroups
+	if len(groups) == 0 {
+		log.Info("No client groups configured")
+		return
+	}
+
+	log.Info("Client groups:")
+	for i, group := range groups {
+		log.Infof("%d. %s: %s (%d redirects)", i+1, group.Name, clientGroupMembers(group), len(group.Redirects))
+		if group.IgnoreGlobalRedirects {
+			log.Info("   global redirects don't apply")
+		}
+	}
+}
+
+// clientGroupMembers describes the networks and MAC addresses of a group
+func clientGroupMembers(group config.ClientGroup) string {
+	return strings.Join(append(append([]string{}, group.Networks...), group.MACs...), ", ")
+}
+
+// selectClientGroup asks for a client group and returns its index. ok is
+// false when there are no groups.
+func selectClientGroup() (index int, ok bool, err error) {
+	groups := config.Config.DNS.ClientGroups
+	if len(groups) == 0 {
+		log.Info("No client groups configured")
+		return 0, false, nil
+	}
+
+	var options []huh.Option[int]
+	for i, group := range groups {
+		label := fmt.Sprintf("%s: %s (%d redirects)", group.Name, clientGroupMembers(group), len(group.Redirects))
+		options = append(options, huh.NewOption(label, i))
+	}
+
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[int]().
+				Title("Select client group").
+				Options(options...).
+				Value(&index),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return 0, false, err
+	}
+	return index, true, nil
+}
+
+// clientGroupForm adds a client group, or edits the one at index when index
+// is not negative
+func clientGroupForm(index int) error {
+	var group config.ClientGroup
+	if index >= 0 {
+		group = config.Config.DNS.ClientGroups[index]
+	}
+	name := group.Name
+	networks := strings.Join(group.Networks, ", ")
+	macs := strings.Join(group.MACs, ", ")
+	useGlobal := !group.IgnoreGlobalRedirects
+
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Group name").
+				Description("e.g., staging-testers").
+				Value(&name),
+			huh.NewInput().
+				Title("Networks").
+				Description("CIDRs or single IPs, comma-separated, e.g. 192.168.1.20, 192.168.1.64/28").
+				Value(&networks),
+			huh.NewInput().
+				Title("MAC addresses").
+				Description("Comma-separated; matched through the ARP table, so only for devices on this machine's LAN").
+				Value(&macs),
+			huh.NewConfirm().
+				Title("Fall back to the global redirects?").
+				Description("Names the group has no redirect for are answered from the global redirects").
+				Value(&useGlobal),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+
+	group.Name = strings.TrimSpace(name)
+	group.Networks = splitList(networks, ",")
+	group.MACs = splitList(macs, ",")
+	group.IgnoreGlobalRedirects = !useGlobal
+
+	if index < 0 {
+		if err := config.AddClientGroup(group); err != nil {
+			return err
+		}
+		log.Infof("Added client group %s; add its redirects with \"Manage a group's redirects\"", group.Name)
+		return nil
+	}
+
+	if err := config.UpdateClientGroup(index, group); err != nil {
+		return err
+	}
+	log.Infof("Updated client group %s", group.Name)
+	return nil
+}
+
+// removeClientGroupForm asks before removing the client group at index
+func removeClientGroupForm(index int) error {
+	group := config.Config.DNS.ClientGroups[index]
+
+	var confirm bool
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewConfirm().
+				Title(fmt.Sprintf("Remove client group %s?", group.Name)).
+				Description(fmt.Sprintf("Its %d redirects are removed too. This action cannot be undone", len(group.Redirects))).
+				Value(&confirm),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+	if !confirm {
+		return nil
+	}
+
+	if err := config.RemoveClientGroup(index); err != nil {
+		return err
+	}
+	log.Infof("Removed client group %s", group.Name)
+	return nil
+}
+
+// LANInterfaceForm asks which network interface LAN mode serves on. labels
+// describe the interfaces in names, in the same order.
+func LANInterfaceForm(names, labels []string) (string, error) {
+	var options []huh.Option[string]
+	for i, name := range names {
+		options = append(options, huh.NewOption(labels[i], name))
+	}
+
+	var selected string
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Serve other devices on which network?").
+				Description("Set lan.interface in config.json to skip this question").
+				Options(options...).
+				Value(&selected),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return "", err
+	}
+	return selected, nil
+}
+
 // ShowStartupMenu shows the main application startup menu
 func ShowStartupMenu() (string, error) {
 	var action string
@@ -756,6 +1511,7 @@ func ShowStartupMenu() (string, error) {
 					huh.NewOption("🚀 Start proxy server", "start"),
 					huh.NewOption("🌐 Manage DNS redirects", "dns"),
 					huh.NewOption("🔒 Select certificate", "cert"),
+					huh.NewOption("🔍 Query tool", "dig"),
 					huh.NewOption("⚙️  Configuration", "config"),
 					huh.NewOption("🚪 Exit", "exit"),
 				).
@@ -765,3 +1521,70 @@ func ShowStartupMenu() (string, error) {
 
 	return action, form.Run()
 }
+
+// QueryToolForm asks for a query and shows how Aegis answers it, with the
+// rules, cache and upstreams involved
+func QueryToolForm() error {
+	qtype, client := "A", "127.0.0.1"
+	var name string
+
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Name").
+				Description("A domain name, or an IP address for a reverse lookup").
+				Placeholder("fortnite-public-service-prod11.ol.epicgames.com").
+				Value(&name).
+				Validate(func(s string) error {
+					if strings.TrimSpace(s) == "" {
+						return fmt.Errorf("name is required")
+					}
+					return nil
+				}),
+			huh.NewSelect[string]().
+				Title("Type").
+				Options(
+					huh.NewOption("A", "A"),
+					huh.NewOption("AAAA", "AAAA"),
+					huh.NewOption("CNAME", "CNAME"),
+					huh.NewOption("TXT", "TXT"),
+					huh.NewOption("SRV", "SRV"),
+					huh.NewOption("MX", "MX"),
+					huh.NewOption("PTR", "PTR"),
+					huh.NewOption("HTTPS", "HTTPS"),
+					huh.NewOption("ANY", "ANY"),
+				).
+				Value(&qtype),
+			huh.NewInput().
+				Title("Client IP").
+				Description("The query is answered as for this client, with its ACL action and client group").
+				Value(&client).
+				Validate(func(s string) error {
+					if net.ParseIP(strings.TrimSpace(s)) == nil {
+						return fmt.Errorf("not an IP address")
+					}
+					return nil
+				}),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return err
+	}
+
+	// Addresses default to a reverse lookup
+	if net.ParseIP(strings.TrimSpace(name)) != nil && qtype == "A" {
+		qtype = ""
+	}
+	r, err := dns.NewQuery(name, qtype)
+	if err != nil {
+		return err
+	}
+	trace, err := dns.TraceQuery(r, strings.TrimSpace(client))
+	if err != nil {
+		return err
+	}
+	for _, line := range trace.Lines() {
+		log.Info(line)
+	}
+	return nil
+}